@@ -0,0 +1,158 @@
+package main
+
+import (
+	"errors"
+	"strconv"
+)
+
+// ============================== ADMIN SERVICE ===============================
+
+// AdminService represents the RPC service through which operators manage the
+// cluster. It is served on each backend's peer port, next to the consensus
+// module's own RPCs.
+type AdminService struct {
+	srv *BackendServer // The backend the service manages
+}
+
+/*
+ * validateMember checks the ID and endpoint of a node to be added. A member
+ * whose peer address can't be derived would be in the configuration of every
+ * node, so it must be rejected before it is replicated.
+ */
+func validateMember(args MembershipChangeArgs) error {
+	if args.ID < 0 {
+		return errors.New("node ID must not be negative")
+	}
+	_, err := PeerEndpoint(args.Endpoint)
+	return err
+}
+
+/*
+ * AddServer adds a node to the cluster. The node should already be running
+ * with --join so that it waits to be added instead of starting a new cluster.
+ * The reply is sent once the new configuration is committed.
+ */
+func (admin *AdminService) AddServer(args MembershipChangeArgs, reply *AdminReply) error {
+	if err := validateMember(args); err != nil {
+		reply.Message = err.Error()
+		return nil
+	}
+
+	err := admin.srv.replicate(func() (int, int, error) {
+		return admin.srv.consensus.AddServer(args.ID, args.Endpoint, false)
+	})
+
+	reply.Status = err == nil
+	if err != nil {
+		reply.Message = err.Error()
+	} else {
+		reply.Message = "added node " + strconv.Itoa(args.ID)
+	}
+	return nil
+}
+
+/*
+ * AddLearner adds a node to the cluster as a learner, which receives the log
+ * but doesn't vote. Like AddServer, the node should already be running with
+ * --join. The reply is sent once the new configuration is committed.
+ */
+func (admin *AdminService) AddLearner(args MembershipChangeArgs, reply *AdminReply) error {
+	if err := validateMember(args); err != nil {
+		reply.Message = err.Error()
+		return nil
+	}
+
+	err := admin.srv.replicate(func() (int, int, error) {
+		return admin.srv.consensus.AddServer(args.ID, args.Endpoint, true)
+	})
+
+	reply.Status = err == nil
+	if err != nil {
+		reply.Message = err.Error()
+	} else {
+		reply.Message = "added learner " + strconv.Itoa(args.ID)
+	}
+	return nil
+}
+
+/*
+ * PromoteLearner makes a learner that has caught up with the leader a voter.
+ * The reply is sent once the new configuration is committed.
+ */
+func (admin *AdminService) PromoteLearner(args MembershipChangeArgs, reply *AdminReply) error {
+	err := admin.srv.replicate(func() (int, int, error) {
+		return admin.srv.consensus.PromoteLearner(args.ID)
+	})
+
+	reply.Status = err == nil
+	if err != nil {
+		reply.Message = err.Error()
+	} else {
+		reply.Message = "promoted node " + strconv.Itoa(args.ID) + " to a voter"
+	}
+	return nil
+}
+
+/*
+ * RemoveServer removes a node from the cluster. The reply is sent once the
+ * new configuration is committed; the removed node can then be shut down.
+ */
+func (admin *AdminService) RemoveServer(args MembershipChangeArgs, reply *AdminReply) error {
+	err := admin.srv.replicate(func() (int, int, error) {
+		return admin.srv.consensus.RemoveServer(args.ID)
+	})
+
+	reply.Status = err == nil
+	if err != nil {
+		reply.Message = err.Error()
+	} else {
+		reply.Message = "removed node " + strconv.Itoa(args.ID)
+	}
+	return nil
+}
+
+/*
+ * TransferLeadership hands leadership to another node, e.g. before the
+ * current leader is restarted. It must be sent to the leader; the reply is
+ * sent once the leader has stepped down.
+ */
+func (admin *AdminService) TransferLeadership(args TransferLeadershipArgs, reply *AdminReply) error {
+	err := admin.srv.consensus.TransferLeadership(args.ID)
+
+	reply.Status = err == nil
+	if err != nil {
+		reply.Message = err.Error()
+	} else {
+		reply.Message = "transferred leadership to node " + strconv.Itoa(args.ID)
+	}
+	return nil
+}
+
+/*
+ * Status reports the backend's Raft state: its term, vote, log and who it
+ * thinks leads, and, on the leader, how far each peer's log has caught up.
+ */
+func (admin *AdminService) Status(args StatusArgs, reply *NodeStatus) error {
+	*reply = admin.srv.consensus.Status()
+	return nil
+}
+
+/*
+ * Albums returns the backend's whole database along with the index it has
+ * applied, so the admin tool can compare the databases of every node.
+ */
+func (admin *AdminService) Albums(args AlbumsArgs, reply *AlbumsReply) error {
+	srv := admin.srv
+	srv.mu.Lock()
+	defer srv.mu.Unlock()
+
+	reply.ID = srv.consensus.id
+	reply.AppliedIndex = srv.appliedIndex
+	reply.Checksum = srv.DB.Checksum()
+	reply.CurrID = srv.DB.CurrID
+	reply.Albums = make(map[int]Album, len(srv.DB.Data))
+	for id, album := range srv.DB.Data {
+		reply.Albums[id] = *album
+	}
+	return nil
+}
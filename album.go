@@ -1,8 +1,11 @@
 package main
 
 import (
+	"bytes"
+	"encoding/gob"
 	"errors"
 	"fmt"
+	"hash/fnv"
 	"log"
 	"strconv"
 )
@@ -16,6 +19,9 @@ type Album struct {
 	Year   string
 }
 
+// ErrAlbumNotFound is returned for an ID that no album has.
+var ErrAlbumNotFound = errors.New("Album does not exist")
+
 // hardcodedAlbums is a 2D slice of strings where each individual slice is an
 // album's metadata; this is used to store a hardcoded list of albums.
 var hardcodedAlbums = [][]string{
@@ -27,10 +33,14 @@ var hardcodedAlbums = [][]string{
 }
 
 // AlbumDB represents our in-memory database implemented as a map from integers
-// to an album pointer.
+// to an album pointer. It also holds the client sessions, which are replicated
+// along with the albums (see session.go).
 type AlbumDB struct {
-	Data   map[int]*Album
-	CurrID int
+	Data     map[int]*Album
+	CurrID   int
+	Sessions *SessionTable
+
+	digest uint64 // The sum of albumHash over Data, kept up to date as albums change (see Checksum)
 }
 
 /*
@@ -38,8 +48,9 @@ type AlbumDB struct {
  */
 func NewAlbumDB() *AlbumDB {
 	db := &AlbumDB{
-		Data:   make(map[int]*Album),
-		CurrID: 0,
+		Data:     make(map[int]*Album),
+		CurrID:   0,
+		Sessions: NewSessionTable(),
 	}
 
 	for _, album := range hardcodedAlbums {
@@ -60,6 +71,7 @@ func (db *AlbumDB) AddAlbum(title, artist, url, year string) {
 		URL:    url,
 		Year:   year,
 	}
+	db.digest += albumHash(db.CurrID, db.Data[db.CurrID])
 
 	// Increment the ID by 1 for the next AddAlbum call.
 	db.CurrID += 1
@@ -68,20 +80,14 @@ func (db *AlbumDB) AddAlbum(title, artist, url, year string) {
 /*
  * RemoveAlbum removes an album struct from our in-memory database.
  *
- * Returns an error if the ID is not valid or if there isn't an album
- * associated with the given ID.
+ * Returns an error if there isn't an album associated with the given ID.
  */
-func (db *AlbumDB) RemoveAlbum(id string) error {
-	idInt, err := strconv.Atoi(id)
-
-	if err != nil {
-		return err
-	}
-
-	if _, ok := db.Data[idInt]; ok {
-		delete(db.Data, idInt)
+func (db *AlbumDB) RemoveAlbum(id int) error {
+	if a, ok := db.Data[id]; ok {
+		db.digest -= albumHash(id, a)
+		delete(db.Data, id)
 	} else {
-		return errors.New("Album does not exist")
+		return ErrAlbumNotFound
 	}
 
 	return nil
@@ -92,19 +98,15 @@ func (db *AlbumDB) RemoveAlbum(id string) error {
  * to be updated with the given album fields if they are non-empty. If they are
  * empty, the fields are not modified.
  *
- * Returns an error if the ID is not valid or if there isn't an album
- * associated with the given ID.
+ * Returns an error if there isn't an album associated with the given ID.
  */
-func (db *AlbumDB) EditAlbum(id, title, artist, url, year string) error {
+func (db *AlbumDB) EditAlbum(id int, title, artist, url, year string) error {
 	log.Println("[album.go] EditAlbum")
-	idInt, err := strconv.Atoi(id)
-	if err != nil {
-		return err
-	}
 
-	if _, ok := db.Data[idInt]; ok {
+	if _, ok := db.Data[id]; ok {
 		// Retrieve the album using the ID.
-		a := db.Data[idInt]
+		a := db.Data[id]
+		db.digest -= albumHash(id, a)
 
 		// For each field, if the given value is mon-empty, update the fields
 		// using the new value; otherwise, leave the fields as is.
@@ -120,8 +122,9 @@ func (db *AlbumDB) EditAlbum(id, title, artist, url, year string) error {
 		if year != "" {
 			a.Year = year
 		}
+		db.digest += albumHash(id, a)
 	} else {
-		return errors.New("Album does not exist")
+		return ErrAlbumNotFound
 	}
 
 	log.Println("[album.go] EditAlbum DONE")
@@ -145,7 +148,7 @@ func (db *AlbumDB) GetAlbum(id string) (*Album, error) {
 		a := db.Data[idInt]
 		return a, nil
 	} else {
-		return nil, errors.New("Album does not exist")
+		return nil, ErrAlbumNotFound
 	}
 }
 
@@ -166,6 +169,84 @@ func (db *AlbumDB) GetAllAlbums() []*Album {
 	return lst
 }
 
+/*
+ * Snapshot encodes the whole in-memory database (the albums, the next ID to be
+ * assigned and the client sessions) so that it can be restored with
+ * RestoreSnapshot.
+ */
+func (db *AlbumDB) Snapshot() ([]byte, error) {
+	var buffer bytes.Buffer
+	if err := gob.NewEncoder(&buffer).Encode(db); err != nil {
+		return nil, err
+	}
+	return buffer.Bytes(), nil
+}
+
+/*
+ * RestoreSnapshot replaces the contents of the in-memory database with a
+ * snapshot taken by Snapshot.
+ */
+func (db *AlbumDB) RestoreSnapshot(data []byte) error {
+	restored := &AlbumDB{}
+	if err := gob.NewDecoder(bytes.NewReader(data)).Decode(restored); err != nil {
+		return err
+	}
+
+	db.Data = restored.Data
+	if db.Data == nil {
+		db.Data = make(map[int]*Album)
+	}
+	db.CurrID = restored.CurrID
+	db.digest = 0
+	for id, a := range db.Data {
+		db.digest += albumHash(id, a)
+	}
+	db.Sessions = restored.Sessions
+	if db.Sessions == nil {
+		db.Sessions = NewSessionTable()
+	} else if db.Sessions.Sessions == nil {
+		db.Sessions.Sessions = make(map[string]*ClientSession)
+	}
+
+	return nil
+}
+
+/*
+ * Checksum returns a hash of the whole database: the albums, the next ID to be
+ * assigned and the client sessions. Nodes that applied the same entries have
+ * the same checksum (see checksum.go).
+ *
+ * The albums' part is kept up to date by AddAlbum, EditAlbum and RemoveAlbum,
+ * so it costs the same however many albums there are; an album changed in
+ * some other way only shows once it is next edited or removed.
+ */
+func (db *AlbumDB) Checksum() uint64 {
+	hash := fnv.New64a()
+	fmt.Fprintf(hash, "%d;%d;%d", db.digest, db.CurrID, db.Sessions.Clock)
+
+	// The sessions are few, so they are hashed anew, in any order.
+	sessions := uint64(0)
+	for client, session := range db.Sessions.Sessions {
+		h := fnv.New64a()
+		fmt.Fprintf(h, "%s=%+v", client, *session)
+		sessions += h.Sum64()
+	}
+	fmt.Fprintf(hash, ";%d", sessions)
+
+	return hash.Sum64()
+}
+
+/*
+ * albumHash returns a hash of the album with the given ID. The database's
+ * checksum includes the sum of its albums' hashes, which doesn't depend on
+ * their order and can be updated one album at a time.
+ */
+func albumHash(id int, a *Album) uint64 {
+	hash := fnv.New64a()
+	fmt.Fprintf(hash, "%d=%+v", id, *a)
+	return hash.Sum64()
+}
+
 func (db *AlbumDB) PrintAlbumDB() {
 	for k := 0; k < len(db.Data); k++ {
 		v := db.Data[k]
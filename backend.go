@@ -2,12 +2,28 @@ package main
 
 import (
 	"encoding/gob"
+	"errors"
 	"fmt"
 	"log"
 	"net"
+	"net/http"
 	"os"
+	"os/signal"
+	"strconv"
+	"strings"
+	"sync"
+	"syscall"
+	"time"
 )
 
+// clientRequestTimeout is how long a client write waits for its command to be
+// committed before the backend gives up and replies with a failure.
+const clientRequestTimeout = 5 * time.Second
+
+// stopDrainTimeout is how long a stopping backend waits for the client
+// requests it is handling to finish before it closes their connections.
+const stopDrainTimeout = clientRequestTimeout + time.Second
+
 // ============================== BACKEND SERVER ==============================
 
 // BackendServer represents a backend TCP BackendServer.
@@ -17,42 +33,187 @@ type BackendServer struct {
 	Port string   // The port number of the backend server
 	DB   *AlbumDB // A pointer to the in-memory album database
 
-	consensus *ConsensusModule // The Consesus module
+	// Log compaction thresholds (0 disables a threshold)
+	SnapshotEntries int // Snapshot once this many applied entries are in the log
+	SnapshotBytes   int // Snapshot once the applied entries in the log take this many bytes
+
+	// Metrics (see metrics.go)
+	MetricsAddress string       // Address to serve /metrics on ("" to not serve it)
+	metrics        *Registry    // The backend's and the consensus module's metrics
+	metricsServer  *http.Server // Serves /metrics (nil until Start)
+	requestCount   *Counter     // Client requests, by method
+	requestLatency *Histogram   // Time to answer client requests, by method
+	requestErrors  *Counter     // Failed client requests, by error
+
+	consensus     *ConsensusModule        // The Consesus module
+	commitChannel chan EntryToCommit      // Committed entries from the consensus module
+	pending       map[int]*pendingRequest // Client writes waiting on a log index
+	appliedIndex  int                     // Index of the last entry applied to DB
+	applied       *sync.Cond              // Signaled whenever appliedIndex advances
+	checksums     *ChecksumLog            // DB's checksum after each applied entry (see checksum.go)
+	mu            sync.Mutex              // A mutex to protect DB, pending and appliedIndex
+
+	// Client connections (see Stop)
+	listener   net.Listener          // Accepts client connections (nil until Start)
+	conns      map[net.Conn]struct{} // The open client connections
+	requests   sync.WaitGroup        // The client requests being handled
+	stopping   bool                  // True once Stop was called
+	connsMu    sync.Mutex            // A mutex to protect listener, conns and stopping
+	applierEnd chan struct{}         // Closed once ApplyCommittedEntries returns
+}
+
+// pendingRequest represents a client write that has been appended to the
+// leader's log and is waiting to be committed and applied.
+type pendingRequest struct {
+	term int        // The term in which the command was appended
+	done chan error // Receives the result of applying the command
 }
 
 /*
- * NewBackendServer initializes a new backend BackendServer.
+ * NewBackendServer initializes a new backend BackendServer with the given ID,
+ * which serves clients at its endpoint in config and talks to the other
+ * backends through the transport.
+ *
+ * The node's Raft state is kept in a write-ahead log in dataDir; anything
+ * already in it is reloaded, and the committed commands are replayed to
+ * rebuild the in-memory database. A node with no state yet bootstraps a new
+ * cluster made of the members of config, unless join is set, in which case it
+ * waits to be added to an existing cluster (see Admin.AddServer).
  */
-func NewBackendServer(host, port string, endpoints []string) *BackendServer {
-	return &BackendServer{
-		Host: host,
-		Port: port,
-		DB:   NewAlbumDB(),
+func NewBackendServer(id int, config Configuration, transport Transport, dataDir string, join bool) *BackendServer {
+	host, port, err := net.SplitHostPort(config[id].Endpoint)
+	if err != nil {
+		fmt.Println(err)
+		os.Exit(1)
+	}
+
+	storage, err := OpenStorage(dataDir)
+	if err != nil {
+		fmt.Println(err)
+		os.Exit(1)
+	}
+	state, err := storage.Load()
+	if err != nil {
+		fmt.Println(err)
+		os.Exit(1)
+	}
+
+	// Restore the latest snapshot and replay the committed commands that
+	// follow it to rebuild the in-memory database.
+	db := NewAlbumDB()
+	first := 0
+	if state.Snapshot != nil {
+		if err := db.RestoreSnapshot(state.Snapshot.Data); err != nil {
+			fmt.Println(err)
+			os.Exit(1)
+		}
+		first = state.Snapshot.LastIncludedIndex + 1
+	}
+	if err := Reconstruct(db, &CommandLog{Entries: state.Log.Entries[:state.CommitIndex+1-first]}); err != nil {
+		fmt.Println(err)
+		os.Exit(1)
+	}
+
+	commitChannel := make(chan EntryToCommit)
+	consensus := NewConsensusModule(id, storage, transport, RealRuntime{}, commitChannel)
+	consensus.Restore(state)
+	checksums := NewChecksumLog()
+	checksums.Record(state.CommitIndex, db.Checksum())
+	consensus.SetChecksumLog(checksums)
+
+	if state.Snapshot == nil && len(state.Log.Entries) == 0 && !join {
+		consensus.Bootstrap(config)
+		log.Println("[BackendServer] Bootstrapped a new cluster with", config)
+	} else {
+		log.Printf("[BackendServer] Restored term %d and %d log entries (%d committed) from %s",
+			state.CurrentTerm, len(state.Log.Entries), state.CommitIndex+1, dataDir)
 	}
+
+	srv := &BackendServer{
+		Host:          host,
+		Port:          ":" + port,
+		DB:            db,
+		consensus:     consensus,
+		commitChannel: commitChannel,
+		pending:       make(map[int]*pendingRequest),
+		appliedIndex:  state.CommitIndex,
+		checksums:     checksums,
+		conns:         make(map[net.Conn]struct{}),
+		applierEnd:    make(chan struct{}),
+	}
+	srv.applied = sync.NewCond(&srv.mu)
+	srv.registerMetrics()
+
+	if err := consensus.RegisterService("Admin", &AdminService{srv: srv}); err != nil {
+		fmt.Println(err)
+		os.Exit(1)
+	}
+
+	return srv
 }
 
 /*
- * Start starts running the backend server; continously listens for incoming
- * requests from the frontend server(s).
+ * Start starts running the backend server; it listens for RPCs from the other
+ * backends and starts the consensus module, then continously listens for
+ * incoming requests from the frontend server(s) in the background. Returns an
+ * error if any of its ports can't be listened on.
  */
-func (srv *BackendServer) Start() {
-	log.Println("[BackendServer] Starting backend BackendServer on " + srv.Host + srv.Port)
+func (srv *BackendServer) Start() error {
+	log.Println("[BackendServer] Starting backend BackendServer on " + srv.GetAddress())
 
-	listener, err := net.Listen("tcp4", srv.Port)
+	listener, err := net.Listen("tcp", srv.Port)
 	if err != nil {
-		fmt.Println(err)
-		return
+		return err
 	}
 
-	// Continously listen for requests.
-	for {
-		conn, err := listener.Accept()
+	// Serve metrics to Prometheus.
+	var metricsListener net.Listener
+	if srv.MetricsAddress != "" {
+		metricsListener, err = net.Listen("tcp", srv.MetricsAddress)
 		if err != nil {
-			fmt.Println("Start", err)
-			return
+			listener.Close()
+			return err
 		}
-		go srv.HandleClientConn(conn)
 	}
+
+	// Serve RPCs from the other backends and admin clients.
+	if err := srv.consensus.ListenForPeers(srv.GetAddress()); err != nil {
+		listener.Close()
+		if metricsListener != nil {
+			metricsListener.Close()
+		}
+		return err
+	}
+
+	if metricsListener != nil {
+		mux := http.NewServeMux()
+		mux.Handle("/metrics", srv.metrics)
+		srv.metricsServer = &http.Server{Handler: mux}
+		go srv.metricsServer.Serve(metricsListener)
+	}
+
+	srv.consensus.Start()
+	go srv.ApplyCommittedEntries()
+
+	srv.connsMu.Lock()
+	srv.listener = listener
+	srv.connsMu.Unlock()
+
+	// Continously listen for requests, until Stop closes the listener.
+	go func() {
+		for {
+			conn, err := listener.Accept()
+			if err != nil {
+				if !srv.isStopping() {
+					log.Println("[BackendServer] Start", err)
+				}
+				return
+			}
+			go srv.HandleClientConn(conn)
+		}
+	}()
+
+	return nil
 }
 
 /*
@@ -61,41 +222,63 @@ func (srv *BackendServer) Start() {
 func (srv *BackendServer) HandleClientConn(conn net.Conn) {
 	log.Println("[BackendServer] Handling " + conn.RemoteAddr().String())
 
+	defer conn.Close()
+
+	if !srv.trackConn(conn) {
+		return
+	}
+	defer srv.untrackConn(conn)
+
 	for {
-		msg := srv.ReadClientMessage(conn)
+		msg, err := srv.ReadClientMessage(conn)
+		if err != nil {
+			log.Println("[BackendServer] Closing " + conn.RemoteAddr().String())
+			return
+		}
+
+		// A stopping backend drops new requests; the client resends them to
+		// another backend once the connection is closed.
+		if !srv.beginRequest() {
+			return
+		}
+		start := time.Now()
 		srv.HandleClientRequest(conn, msg)
+		method := methodLabel(msg.Method)
+		srv.requestCount.Inc(method)
+		srv.requestLatency.Observe(time.Since(start).Seconds(), method)
+		srv.requests.Done()
 	}
 }
 
 // ============================ READ/WRITE MESSAGES ===========================
 
 /*
- * ReadClientMessage reads a client message from a TCP connection.
+ * ReadClientMessage reads a client message from a TCP connection. Returns an
+ * error once the client has closed the connection.
  */
-func (srv *BackendServer) ReadClientMessage(conn net.Conn) *DataMessage {
+func (srv *BackendServer) ReadClientMessage(conn net.Conn) (*DataMessage, error) {
 	log.Print("[BackendServer] Reading message")
 
-	for {
-		msg := &DataMessage{}
+	msg := &DataMessage{}
 
-		decoder := gob.NewDecoder(conn)
-		if err := decoder.Decode(msg); err != nil {
-			panic(err)
-		}
-		log.Println(msg)
-		return msg
+	decoder := gob.NewDecoder(conn)
+	if err := decoder.Decode(msg); err != nil {
+		return nil, err
 	}
+	log.Println(msg)
+	return msg, nil
 }
 
 /*
- * WriteClientMessage writes a message to a client over a TCP connection.
+ * WriteClientMessage writes a message (a DataMessage, or a NodeMessage for
+ * GetLeader) to a client over a TCP connection.
  */
-func (srv *BackendServer) WriteClientMessage(conn net.Conn, msg *DataMessage) {
+func (srv *BackendServer) WriteClientMessage(conn net.Conn, msg interface{}) {
 	log.Println("[BackendServer] Sending message", msg)
 
 	encoder := gob.NewEncoder(conn)
 	if err := encoder.Encode(msg); err != nil {
-		panic(err)
+		log.Println("[BackendServer] WriteClientMessage", err)
 	}
 }
 
@@ -103,7 +286,344 @@ func (srv *BackendServer) WriteClientMessage(conn net.Conn, msg *DataMessage) {
 
 // Returns the address of the current node which is just the hostname and port.
 func (node *BackendServer) GetAddress() string {
-	return node.Host + node.Port
+	return net.JoinHostPort(node.Host, strings.TrimPrefix(node.Port, ":"))
+}
+
+// ================================== METRICS =================================
+
+/*
+ * registerMetrics sets up the backend's metrics: the client requests it
+ * handled, the albums in its database, how far applying the log lags behind
+ * committing it and the consensus module's own metrics.
+ */
+func (srv *BackendServer) registerMetrics() {
+	srv.metrics = NewRegistry()
+	srv.requestCount = NewCounter("musicdb_backend_requests_total",
+		"Client requests handled, by DataMessage method.", "method")
+	srv.requestLatency = NewHistogram("musicdb_backend_request_duration_seconds",
+		"Time to handle a client request, by DataMessage method.", latencyBuckets, "method")
+	srv.requestErrors = NewCounter("musicdb_backend_request_errors_total",
+		"Client requests that failed, by error.", "error")
+
+	srv.metrics.Register(
+		srv.requestCount,
+		srv.requestLatency,
+		srv.requestErrors,
+		NewGaugeFunc("musicdb_albums", "Albums in the in-memory database.", nil,
+			func(emit func(float64, ...string)) {
+				srv.mu.Lock()
+				defer srv.mu.Unlock()
+				emit(float64(len(srv.DB.Data)))
+			}),
+		NewGaugeFunc("musicdb_backend_applied_index", "Index of the last log entry applied to the database.", nil,
+			func(emit func(float64, ...string)) {
+				srv.mu.Lock()
+				defer srv.mu.Unlock()
+				emit(float64(srv.appliedIndex))
+			}),
+		NewGaugeFunc("musicdb_backend_apply_lag_entries", "Committed log entries not yet applied to the database.", nil,
+			func(emit func(float64, ...string)) {
+				commitIndex := srv.consensus.CommitIndex()
+				srv.mu.Lock()
+				defer srv.mu.Unlock()
+				lag := commitIndex - srv.appliedIndex
+				if lag < 0 {
+					lag = 0
+				}
+				emit(float64(lag))
+			}),
+	)
+	srv.consensus.RegisterMetrics(srv.metrics)
+}
+
+/*
+ * errorLabel returns the label a failed request is counted under: a short
+ * name for the errors clients are expected to handle, or "other".
+ */
+func errorLabel(err error) string {
+	switch err {
+	case ErrNotLeader:
+		return "not_leader"
+	case ErrStale:
+		return "stale"
+	case ErrSessionExpired:
+		return "session_expired"
+	case ErrAlbumNotFound:
+		return "album_not_found"
+	}
+	return "other"
+}
+
+/*
+ * methodLabel returns the label a request is counted under: its method if
+ * HandleClientRequest knows it, or "invalid", so that clients can't create
+ * any number of series.
+ */
+func methodLabel(method string) string {
+	switch method {
+	case "GetLeader", "RegisterClient", "GetAllAlbums", "GetAlbum", "AddAlbum", "EditAlbum", "DeleteAlbum":
+		return method
+	}
+	return "invalid"
+}
+
+// ================================= SHUTDOWN =================================
+
+/*
+ * Stop shuts the backend down gracefully. It stops accepting clients, waits
+ * (for up to stopDrainTimeout) for the requests being handled to finish, and,
+ * if transfer is set and this node is the leader, hands leadership to another
+ * member. It then stops the consensus module, which syncs and closes its
+ * storage and its connections to the other backends, waits for the committed
+ * entries to be applied and closes the client connections.
+ */
+func (srv *BackendServer) Stop(transfer bool) {
+	srv.connsMu.Lock()
+	if srv.stopping {
+		srv.connsMu.Unlock()
+		return
+	}
+	srv.stopping = true
+	if srv.listener != nil {
+		srv.listener.Close()
+	}
+	srv.connsMu.Unlock()
+	log.Println("[BackendServer] Stopping")
+
+	// 1. Let the requests being handled finish.
+	drained := make(chan struct{})
+	go func() {
+		srv.requests.Wait()
+		close(drained)
+	}()
+	select {
+	case <-drained:
+	case <-time.After(stopDrainTimeout):
+		log.Println("[BackendServer] Timed out waiting for client requests to finish")
+	}
+
+	// 2. Hand off leadership, so that the others don't have to wait for an
+	// election timeout to notice we're gone.
+	if transfer {
+		if err := srv.consensus.StepDown(); err != nil {
+			log.Println("[BackendServer] Leadership transfer failed:", err)
+		}
+	}
+
+	// 3. Stop the consensus module; it closes the commit channel, which ends
+	// ApplyCommittedEntries.
+	srv.consensus.Stop()
+	<-srv.applierEnd
+
+	// 4. Close the client connections, which ends their handlers, and stop
+	// serving metrics.
+	srv.connsMu.Lock()
+	for conn := range srv.conns {
+		conn.Close()
+	}
+	srv.connsMu.Unlock()
+	if srv.metricsServer != nil {
+		srv.metricsServer.Close()
+	}
+
+	log.Println("[BackendServer] Stopped")
+}
+
+/*
+ * trackConn records an open client connection so that Stop can close it.
+ * Returns false if the backend is stopping.
+ */
+func (srv *BackendServer) trackConn(conn net.Conn) bool {
+	srv.connsMu.Lock()
+	defer srv.connsMu.Unlock()
+
+	if srv.stopping {
+		return false
+	}
+	srv.conns[conn] = struct{}{}
+	return true
+}
+
+/*
+ * untrackConn forgets a client connection that was closed.
+ */
+func (srv *BackendServer) untrackConn(conn net.Conn) {
+	srv.connsMu.Lock()
+	defer srv.connsMu.Unlock()
+
+	delete(srv.conns, conn)
+}
+
+/*
+ * beginRequest counts a client request as being handled, so that Stop waits
+ * for it. Returns false if the backend is stopping.
+ */
+func (srv *BackendServer) beginRequest() bool {
+	srv.connsMu.Lock()
+	defer srv.connsMu.Unlock()
+
+	if srv.stopping {
+		return false
+	}
+	srv.requests.Add(1)
+	return true
+}
+
+/*
+ * isStopping returns true once Stop was called.
+ */
+func (srv *BackendServer) isStopping() bool {
+	srv.connsMu.Lock()
+	defer srv.connsMu.Unlock()
+
+	return srv.stopping
+}
+
+// ============================= REPLICATED WRITES ============================
+
+/*
+ * ApplyCommittedEntries applies every entry committed by the consensus module
+ * to the in-memory database, in log order, and replies to the client waiting
+ * on that entry (if any). Once enough applied entries pile up in the log, the
+ * database is snapshotted so that the log can be compacted.
+ */
+func (srv *BackendServer) ApplyCommittedEntries() {
+	defer close(srv.applierEnd)
+
+	for entry := range srv.commitChannel {
+		if entry.Snapshot != nil {
+			srv.installSnapshot(entry.Snapshot)
+			continue
+		}
+
+		srv.mu.Lock()
+		err := applyCommand(srv.DB, &LogEntry{Command: entry.Command, Term: entry.Term})
+
+		// Skipping a command would leave our database different from the
+		// other nodes', so a command we can't decode (e.g. one written by a
+		// newer build) stops the backend.
+		if errors.Is(err, ErrInvalidCommand) {
+			log.Fatalf("[BackendServer] Can't apply entry %d: %v", entry.Index, err)
+		}
+		srv.appliedIndex = entry.Index
+		srv.checksums.Record(entry.Index, srv.DB.Checksum())
+		srv.applied.Broadcast()
+
+		if request, ok := srv.pending[entry.Index]; ok {
+			delete(srv.pending, entry.Index)
+
+			// A different term means our entry was overwritten by a new
+			// leader and was never committed.
+			if request.term != entry.Term {
+				err = ErrNotCommitted
+			}
+			request.done <- err
+		}
+
+		if srv.shouldSnapshot() {
+			srv.takeSnapshot(entry.Index)
+		}
+		srv.mu.Unlock()
+	}
+}
+
+/*
+ * shouldSnapshot returns true if the applied entries in the log have reached
+ * either the entry count or the byte threshold.
+ */
+func (srv *BackendServer) shouldSnapshot() bool {
+	entries, bytes := srv.consensus.LogSize()
+	return (srv.SnapshotEntries > 0 && entries >= srv.SnapshotEntries) ||
+		(srv.SnapshotBytes > 0 && bytes >= srv.SnapshotBytes)
+}
+
+/*
+ * takeSnapshot snapshots the in-memory database, which reflects every entry
+ * up to and including index, and hands it to the consensus module so that it
+ * can compact its log. Must be called with srv.mu held.
+ */
+func (srv *BackendServer) takeSnapshot(index int) {
+	data, err := srv.DB.Snapshot()
+	if err != nil {
+		log.Println("[BackendServer] takeSnapshot", err)
+		return
+	}
+	srv.consensus.Snapshot(index, data)
+}
+
+/*
+ * installSnapshot replaces the in-memory database with a snapshot sent by the
+ * leader. Clients waiting on entries covered by the snapshot are told their
+ * command may not have been applied, since the entries themselves are gone.
+ */
+func (srv *BackendServer) installSnapshot(snapshot *Snapshot) {
+	srv.mu.Lock()
+	defer srv.mu.Unlock()
+
+	if err := srv.DB.RestoreSnapshot(snapshot.Data); err != nil {
+		log.Fatalln("[BackendServer] installSnapshot", err)
+	}
+	srv.appliedIndex = snapshot.LastIncludedIndex
+	srv.checksums.Record(snapshot.LastIncludedIndex, srv.DB.Checksum())
+	srv.applied.Broadcast()
+
+	for index, request := range srv.pending {
+		if index <= snapshot.LastIncludedIndex {
+			delete(srv.pending, index)
+			request.done <- ErrReplacedBySnapshot
+		}
+	}
+
+	log.Println("[BackendServer] Installed snapshot at index", snapshot.LastIncludedIndex)
+}
+
+/*
+ * submitCommand appends a command to the replicated log and waits until it
+ * has been committed and applied to the in-memory database. The command is
+ * stamped with this node's time, which is what client sessions expire by.
+ *
+ * Returns an error if this node is not the leader, if the command was not
+ * committed in time, or if applying it failed.
+ */
+func (srv *BackendServer) submitCommand(cmd *Command) error {
+	cmd.Timestamp = time.Now().UnixNano()
+	return srv.replicate(func() (int, int, error) {
+		index, term, isLeader := srv.consensus.Submit(cmd)
+		if !isLeader {
+			return -1, -1, ErrNotLeader
+		}
+		return index, term, nil
+	})
+}
+
+/*
+ * replicate calls propose, which appends an entry to the leader's log and
+ * returns its index and term, and waits until that entry has been committed
+ * and applied.
+ */
+func (srv *BackendServer) replicate(propose func() (int, int, error)) error {
+	// Hold the lock so that the entry can't be applied before we start
+	// waiting on it.
+	srv.mu.Lock()
+	index, term, err := propose()
+	if err != nil {
+		srv.mu.Unlock()
+		return err
+	}
+
+	request := &pendingRequest{term: term, done: make(chan error, 1)}
+	srv.pending[index] = request
+	srv.mu.Unlock()
+
+	select {
+	case err := <-request.done:
+		return err
+	case <-time.After(clientRequestTimeout):
+		srv.mu.Lock()
+		delete(srv.pending, index)
+		srv.mu.Unlock()
+		return ErrCommitTimeout
+	}
 }
 
 // ============================== CLIENT REQUESTS =============================
@@ -114,8 +634,12 @@ func (node *BackendServer) GetAddress() string {
  */
 func (srv *BackendServer) HandleClientRequest(conn net.Conn, request *DataMessage) {
 	switch request.Method {
+	case "GetLeader":
+		srv.handleGetLeader(conn)
+	case "RegisterClient":
+		srv.handleRegisterClient(conn, request)
 	case "GetAllAlbums":
-		srv.handleGetAllAlbums(conn)
+		srv.handleGetAllAlbums(conn, request)
 	case "GetAlbum":
 		srv.handleGetAlbum(conn, request)
 	case "AddAlbum":
@@ -125,18 +649,98 @@ func (srv *BackendServer) HandleClientRequest(conn net.Conn, request *DataMessag
 	case "DeleteAlbum":
 		srv.handleDeleteAlbum(conn, request)
 	default:
-		log.Println("[BackendServer] Invalid method", request.Method)
-		os.Exit(1)
+		srv.writeFailure(conn, fmt.Errorf("invalid method %q", request.Method))
+	}
+}
+
+/*
+ * lockForRead waits until the in-memory database can serve a read at the
+ * level the request asks for and returns with srv.mu held, or returns an
+ * error (without the lock) if this node can't serve the read.
+ */
+func (srv *BackendServer) lockForRead(request *DataMessage) error {
+	var index int
+	var err error
+
+	switch request.ReadLevel {
+	case READ_LINEARIZABLE:
+		index, err = srv.consensus.ReadIndex()
+	case READ_LOCAL:
+		index = -1
+	case READ_BOUNDED:
+		index, err = srv.consensus.BoundedReadIndex(request.MaxStaleness)
+	default:
+		err = fmt.Errorf("invalid read level %d", request.ReadLevel)
+	}
+	if err != nil {
+		return err
+	}
+
+	srv.mu.Lock()
+	for srv.appliedIndex < index {
+		srv.applied.Wait()
+	}
+	return nil
+}
+
+/*
+ * writeFailure tells the client its request failed and why. If this node
+ * isn't the leader (or is too far behind it), the reply names the leader so
+ * that the client can retry there.
+ */
+func (srv *BackendServer) writeFailure(conn net.Conn, err error) {
+	log.Println("[BackendServer]", err)
+	srv.requestErrors.Inc(errorLabel(err))
+
+	response := &DataMessage{
+		Status: false,
+		Error:  err.Error(),
+	}
+	if err == ErrNotLeader || err == ErrStale {
+		response.Leader = srv.consensus.LeaderEndpoint()
 	}
+	srv.WriteClientMessage(conn, response)
+}
+
+/*
+ * handleGetLeader tells the client which node this node thinks is the leader,
+ * so that it can send its writes there.
+ */
+func (srv *BackendServer) handleGetLeader(conn net.Conn) {
+	id, endpoint, term := srv.consensus.Leader()
+
+	response := &NodeMessage{
+		Method:   "GetLeader",
+		Term:     term,
+		Endpoint: endpoint,
+	}
+	if id != -1 {
+		response.ID = strconv.Itoa(id)
+	}
+
+	srv.WriteClientMessage(conn, response)
 }
 
 /*
  * handleGetAllAlbums gets all albums from the in-memory databse.
  */
-func (srv *BackendServer) handleGetAllAlbums(conn net.Conn) {
+func (srv *BackendServer) handleGetAllAlbums(conn net.Conn, request *DataMessage) {
+	if err := srv.lockForRead(request); err != nil {
+		srv.writeFailure(conn, err)
+		return
+	}
+	// The apply loop edits the stored albums in place, so the response is
+	// encoded from copies made under the lock.
+	albums := make([]*Album, 0, len(srv.DB.Data))
+	for _, album := range srv.DB.GetAllAlbums() {
+		copy := *album
+		albums = append(albums, &copy)
+	}
+	srv.mu.Unlock()
+
 	response := &DataMessage{
 		Method:     "GetAllAlbums",
-		AlbumArray: srv.DB.GetAllAlbums(),
+		AlbumArray: albums,
 		Status:     true,
 	}
 
@@ -147,16 +751,24 @@ func (srv *BackendServer) handleGetAllAlbums(conn net.Conn) {
  * handleGetAlbum gets an album from the in-memory database.
  */
 func (srv *BackendServer) handleGetAlbum(conn net.Conn, request *DataMessage) {
+	if err := srv.lockForRead(request); err != nil {
+		srv.writeFailure(conn, err)
+		return
+	}
 	album, err := srv.DB.GetAlbum(request.Index)
+	var copy Album
+	if err == nil {
+		copy = *album // See handleGetAllAlbums
+	}
+	srv.mu.Unlock()
 	if err != nil {
-		srv.WriteClientMessage(conn, &DataMessage{
-			Status: false,
-		})
+		srv.writeFailure(conn, err)
+		return
 	}
 
 	response := &DataMessage{
 		Method:     "GetAlbum",
-		AlbumArray: []*Album{album},
+		AlbumArray: []*Album{&copy},
 		Status:     true,
 	}
 
@@ -164,77 +776,310 @@ func (srv *BackendServer) handleGetAlbum(conn net.Conn, request *DataMessage) {
 }
 
 /*
- * handleAddAlbum adds an album to the in-memory database.
+ * handleRegisterClient opens a session for the client ID the client picked,
+ * so that its writes are applied exactly once.
+ */
+func (srv *BackendServer) handleRegisterClient(conn net.Conn, request *DataMessage) {
+	if request.ClientID == "" {
+		srv.writeFailure(conn, errors.New("missing client ID"))
+		return
+	}
+
+	command := NewCommand(&RegisterClientCommand{})
+	command.ClientID = request.ClientID
+	err := srv.submitCommand(command)
+	if err != nil {
+		srv.writeFailure(conn, err)
+		return
+	}
+
+	srv.WriteClientMessage(conn, &DataMessage{
+		Method:   "RegisterClient",
+		Status:   true,
+		ClientID: request.ClientID,
+	})
+}
+
+/*
+ * handleAddAlbum adds an album to the replicated in-memory database.
  */
 func (srv *BackendServer) handleAddAlbum(conn net.Conn, request *DataMessage) {
 	album := request.AlbumArray[0]
-	srv.DB.AddAlbum(album.Title, album.Artist, album.URL, album.Year)
+	command := NewCommand(&AddAlbumCommand{
+		Title:  album.Title,
+		Artist: album.Artist,
+		URL:    album.URL,
+		Year:   album.Year,
+	})
+	command.ClientID = request.ClientID
+	command.Sequence = request.Sequence
+	err := srv.submitCommand(command)
 
-	response := &DataMessage{
-		Status: true,
+	if err != nil {
+		srv.writeFailure(conn, err)
+		return
 	}
 
-	srv.WriteClientMessage(conn, response)
+	srv.WriteClientMessage(conn, &DataMessage{
+		Status: true,
+	})
 }
 
 /*
- * handleEditAlbum edits an album in the in-memory database.
+ * handleEditAlbum edits an album in the replicated in-memory database.
  */
 func (srv *BackendServer) handleEditAlbum(conn net.Conn, request *DataMessage) {
 	log.Println("[BackendServer] handleEditAlbum", request)
 	album := request.AlbumArray[0]
-	err := srv.DB.EditAlbum(request.Index, album.Title, album.Artist, album.URL, album.Year)
-
+	id, err := strconv.Atoi(request.Index)
 	if err != nil {
-		log.Println("[BackendServer]", err)
+		srv.writeFailure(conn, fmt.Errorf("invalid album ID %q", request.Index))
+		return
 	}
-	response := &DataMessage{
-		Status: err == nil,
+	command := NewCommand(&EditAlbumCommand{
+		ID:     id,
+		Title:  album.Title,
+		Artist: album.Artist,
+		URL:    album.URL,
+		Year:   album.Year,
+	})
+	command.ClientID = request.ClientID
+	command.Sequence = request.Sequence
+	err = srv.submitCommand(command)
+
+	if err != nil {
+		srv.writeFailure(conn, err)
+		return
 	}
 
-	srv.WriteClientMessage(conn, response)
+	srv.WriteClientMessage(conn, &DataMessage{
+		Status: true,
+	})
 }
 
 /*
- * handleDeleteAlbum deletes an album from the in-memory database.
+ * handleDeleteAlbum deletes an album from the replicated in-memory database.
  */
 func (srv *BackendServer) handleDeleteAlbum(conn net.Conn, request *DataMessage) {
 	fmt.Println("handleDeleteAlbum " + request.Index)
-	err := srv.DB.RemoveAlbum(request.Index)
+	id, err := strconv.Atoi(request.Index)
+	if err != nil {
+		srv.writeFailure(conn, fmt.Errorf("invalid album ID %q", request.Index))
+		return
+	}
+	command := NewCommand(&RemoveAlbumCommand{ID: id})
+	command.ClientID = request.ClientID
+	command.Sequence = request.Sequence
+	err = srv.submitCommand(command)
 
-	response := &DataMessage{
-		Status: err == nil,
+	if err != nil {
+		srv.writeFailure(conn, err)
+		return
 	}
 
-	srv.WriteClientMessage(conn, response)
+	srv.WriteClientMessage(conn, &DataMessage{
+		Status: true,
+	})
 }
 
 // ========================= MAIN & PARSING FUNCTIONS =========================
 
-func ParseBackendendCommandLineArgs() (string, []string) {
+// backendUsage describes how to invoke the backend.
+const backendUsage = `usage:
+    ./backend [--listen <port>] [--backend <host:port>,...] [--data-dir <dir>]
+              [--config <cluster.toml> --id <id>] [--join] [--no-pre-vote]
+              [--snapshot-entries <n>] [--snapshot-bytes <n>]
+              [--batch-entries <n>] [--batch-bytes <n>] [--max-inflight <n>]
+              [--transfer-on-stop] [--metrics <port>]`
+
+// BackendFlags represents the command line flags the backend was invoked with.
+type BackendFlags struct {
+	HTTPPort        string   // Port to listen to client requests
+	Endpoints       []string // Endpoints of every backend in the cluster
+	ConfigFile      string   // Cluster configuration file (instead of HTTPPort and Endpoints)
+	ID              int      // This node's ID in the cluster configuration file
+	DataDir         string   // Directory for the node's durable state
+	SnapshotEntries int      // Snapshot after this many applied log entries
+	SnapshotBytes   int      // Snapshot after this many bytes of applied log entries
+	Join            bool     // Join an existing cluster instead of bootstrapping one
+	PreVote         bool     // Run a pre-vote before each election
+	BatchEntries    int      // Most log entries per AppendEntries
+	BatchBytes      int      // Approximate most bytes of log entries per AppendEntries
+	MaxInflight     int      // Most AppendEntries in flight per follower
+	TransferOnStop  bool     // Hand off leadership before shutting down
+	MetricsPort     string   // Port (or address) to serve /metrics on ("" for the node's metrics address in the cluster file, or else the client port plus metricsPortOffset)
+}
+
+func ParseBackendendCommandLineArgs() *BackendFlags {
 	args := os.Args
-	endPoints := []string{}
-	httpPort := ":8090"
+	flags := &BackendFlags{
+		HTTPPort:        ":8090",
+		Endpoints:       []string{},
+		ID:              -1,
+		SnapshotEntries: 1000,
+		SnapshotBytes:   4 << 20,
+		PreVote:         true,
+		BatchEntries:    defaultBatchEntries,
+		BatchBytes:      defaultBatchBytes,
+		MaxInflight:     defaultMaxInflight,
+	}
+	listen := false
 	i := 1
 	for i < len(args) {
 		if args[i] == "--listen" {
-			httpPort = ParseListenFlag(args, i)
+			flags.HTTPPort = ParseListenFlag(args, i)
+			listen = true
 			i += 2
 		} else if args[i] == "--backend" {
-			endPoints = ParseBackendEndpointsFlag(args, i)
+			flags.Endpoints = ParseBackendEndpointsFlag(args, i)
+			i += 2
+		} else if args[i] == "--config" {
+			flags.ConfigFile = ParseValueFlag(args, i)
+			i += 2
+		} else if args[i] == "--id" {
+			flags.ID = ParseIntFlag(args, i)
+			i += 2
+		} else if args[i] == "--data-dir" {
+			flags.DataDir = ParseValueFlag(args, i)
+			i += 2
+		} else if args[i] == "--snapshot-entries" {
+			flags.SnapshotEntries = ParseIntFlag(args, i)
+			i += 2
+		} else if args[i] == "--snapshot-bytes" {
+			flags.SnapshotBytes = ParseIntFlag(args, i)
+			i += 2
+		} else if args[i] == "--join" {
+			flags.Join = true
+			i += 1
+		} else if args[i] == "--no-pre-vote" {
+			flags.PreVote = false
+			i += 1
+		} else if args[i] == "--batch-entries" {
+			flags.BatchEntries = ParseIntFlag(args, i)
+			i += 2
+		} else if args[i] == "--batch-bytes" {
+			flags.BatchBytes = ParseIntFlag(args, i)
+			i += 2
+		} else if args[i] == "--max-inflight" {
+			flags.MaxInflight = ParseIntFlag(args, i)
+			i += 2
+		} else if args[i] == "--transfer-on-stop" {
+			flags.TransferOnStop = true
+			i += 1
+		} else if args[i] == "--metrics" {
+			flags.MetricsPort = ParseListenFlag(args, i)
 			i += 2
 		} else {
-			fmt.Println("Incorrect usage")
+			fmt.Println("unknown flag " + args[i])
+			fmt.Println(backendUsage)
 			os.Exit(1)
 		}
 	}
-	return httpPort, endPoints
+
+	var err error
+	switch {
+	case flags.BatchEntries == 0 || flags.BatchBytes == 0 || flags.MaxInflight == 0:
+		err = errors.New("--batch-entries, --batch-bytes and --max-inflight must be at least 1")
+	case flags.ConfigFile != "" && (listen || len(flags.Endpoints) > 0):
+		err = errors.New("--config can't be combined with --listen or --backend")
+	case flags.ConfigFile != "" && flags.ID == -1:
+		err = errors.New("--config needs --id to say which node this is")
+	case flags.ConfigFile == "" && flags.ID != -1:
+		err = errors.New("--id needs --config")
+	}
+	if err != nil {
+		fmt.Println(err)
+		fmt.Println(backendUsage)
+		os.Exit(1)
+	}
+	return flags
+}
+
+/*
+ * Cluster returns this node's ID, the configuration a new cluster starts with
+ * and the peer address of each node by client endpoint. They come from the
+ * cluster configuration file if one was given, or else from --listen and
+ * --backend, in which case a node's ID is the position of its own address in
+ * the --backend list and the peer addresses are the defaults.
+ */
+func (flags *BackendFlags) Cluster() (int, Configuration, map[string]string, error) {
+	if flags.ConfigFile != "" {
+		cluster, err := LoadClusterConfig(flags.ConfigFile)
+		if err != nil {
+			return -1, nil, nil, err
+		}
+		node := cluster.Node(flags.ID)
+		if node == nil {
+			return -1, nil, nil, fmt.Errorf("%s: there is no node with id %d", flags.ConfigFile, flags.ID)
+		}
+		if flags.MetricsPort == "" {
+			// validate checked that no other node uses the address.
+			flags.MetricsPort = node.Metrics
+		}
+		return flags.ID, cluster.Configuration(), cluster.PeerAddresses(), nil
+	}
+
+	address := "localhost" + flags.HTTPPort
+	endpoints := flags.Endpoints
+	if len(endpoints) == 0 {
+		endpoints = []string{address}
+	}
+
+	id := -1
+	config := Configuration{}
+	for i, endpoint := range endpoints {
+		if endpoint == address {
+			id = i
+		}
+		config[i] = Member{Endpoint: endpoint}
+	}
+	if id == -1 {
+		return -1, nil, nil, errors.New("--backend must include this node's address " + address)
+	}
+	return id, config, nil, nil
 }
 
 func main() {
 
-	httpPort, endpoints := ParseBackendendCommandLineArgs()
+	flags := ParseBackendendCommandLineArgs()
+	id, config, addresses, err := flags.Cluster()
+	if err != nil {
+		fmt.Println(err)
+		os.Exit(1)
+	}
+
+	// By default, each backend keeps its data in a directory named after its
+	// port, so that several backends can run from the same directory, and
+	// serves metrics on its port plus metricsPortOffset.
+	_, port, _ := net.SplitHostPort(config[id].Endpoint)
+	if flags.DataDir == "" {
+		flags.DataDir = "data/" + port
+	}
+	if flags.MetricsPort == "" {
+		n, _ := strconv.Atoi(port)
+		flags.MetricsPort = ":" + strconv.Itoa(n+metricsPortOffset)
+	}
+
+	srv := NewBackendServer(id, config, NewTCPTransport(addresses), flags.DataDir, flags.Join)
+	srv.SnapshotEntries = flags.SnapshotEntries
+	srv.SnapshotBytes = flags.SnapshotBytes
+	srv.MetricsAddress = flags.MetricsPort
+	srv.consensus.SetPreVote(flags.PreVote)
+	srv.consensus.SetReplication(flags.BatchEntries, flags.BatchBytes, flags.MaxInflight)
+	if err := srv.Start(); err != nil {
+		fmt.Println(err)
+		os.Exit(1)
+	}
+
+	// Shut down gracefully on SIGINT or SIGTERM; a second signal exits right
+	// away.
+	signals := make(chan os.Signal, 2)
+	signal.Notify(signals, syscall.SIGINT, syscall.SIGTERM)
+	log.Println("[BackendServer] Received", <-signals)
+	go func() {
+		log.Println("[BackendServer] Received", <-signals, "while stopping")
+		os.Exit(1)
+	}()
 
-	srv := NewBackendServer("localhost", httpPort, endpoints)
-	srv.Start()
+	srv.Stop(flags.TransferOnStop)
 }
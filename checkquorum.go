@@ -0,0 +1,63 @@
+package main
+
+// The checkquorum.go file implements CheckQuorum, as described in section 6.2
+// of Diego Ongaro's dissertation "Consensus: Bridging Theory and Practice". A
+// leader that is cut off from the rest of the cluster would otherwise stay the
+// leader forever, and keep sending clients to its stale database; instead it
+// steps down once an election timeout passes without hearing from a majority,
+// since by then the others may well have elected a new leader.
+
+import "log"
+
+// checkQuorumTimeout is how long a leader goes without hearing from a quorum
+// before it steps down: the longest election timeout, after which every
+// follower that didn't hear from us has started an election.
+const checkQuorumTimeout = 2 * minElectionTimeout
+
+// =============================== CHECK QUORUM ===============================
+
+/*
+ * checkQuorum steps the leader down if fewer than a quorum of the voters
+ * (ourselves included) have answered an AppendEntries or InstallSnapshot
+ * within checkQuorumTimeout.
+ */
+func (node *ConsensusModule) checkQuorum() {
+	node.mu.Lock()
+	defer node.mu.Unlock()
+
+	if node.state != LEADER {
+		return
+	}
+
+	contacts := 0
+	if node.isVoter(node.id) {
+		contacts = 1
+	}
+	for _, peer := range node.voterPeers() {
+		progress := node.progress[peer]
+		if progress != nil &&
+			node.runtime.Now().Sub(progress.lastContact) < checkQuorumTimeout {
+			contacts += 1
+		}
+	}
+	if node.hasQuorum(contacts) {
+		return
+	}
+
+	log.Printf("[ConsensusModule] Heard from %d of %d voters within %v, stepping down",
+		contacts, node.config.Voters(), checkQuorumTimeout)
+	node.BecomeFollower(node.currentTerm)
+
+	// We no longer know who the leader is, so clients aren't sent back here.
+	node.leaderId = -1
+}
+
+/*
+ * heardFrom notes that a peer answered us as the leader of the current term.
+ * Must be called with the node's mutex held.
+ */
+func (node *ConsensusModule) heardFrom(peer int) {
+	if progress := node.progress[peer]; progress != nil {
+		progress.lastContact = node.runtime.Now()
+	}
+}
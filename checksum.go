@@ -0,0 +1,316 @@
+package main
+
+// The checksum.go file detects nodes whose databases have diverged, e.g.
+// because applying a command isn't deterministic or a node's memory or disk
+// was corrupted. Raft only guarantees that the nodes apply the same entries;
+// it can't tell whether applying them left the same state behind.
+//
+// After applying each entry, a node records the checksum of its database (see
+// AlbumDB.Checksum) in a ChecksumLog. The leader piggybacks its latest
+// checksum on every AppendEntries, and a follower compares it with its own
+// checksum at the same index as soon as it has applied that index. If they
+// differ, the follower asks the leader for its checksums since the last index
+// at which they agreed, finds the first index at which they differ and flags
+// the divergence, which is logged and shows in its status and metrics. The
+// admin tool's compare command then shows which albums differ.
+
+import (
+	"errors"
+	"log"
+	"sync"
+)
+
+// checksumHistory is how many of its latest checksums a node keeps, to find
+// where its database started to differ from the leader's.
+const checksumHistory = 4096
+
+// ================================ CHECKSUM LOG ==============================
+
+// ChecksumLog represents the checksums of a node's database after each of the
+// entries it applied last, and what comparing them with the leader's found.
+type ChecksumLog struct {
+	first       int                                 // Index of the first checksum in checksums
+	checksums   []uint64                            // The checksum after applying each entry from first on
+	agreed      int                                 // The last index at which the leader's checksum matched ours (-1 if none)
+	pending     *ChecksumPoint                      // The leader's checksum at an index we haven't applied yet
+	pendingFrom int                                 // The leader that sent pending
+	locating    bool                                // Whether we are asking the leader where we diverged
+	divergence  *Divergence                         // Where we diverged (nil until it's found)
+	mismatch    func(peer int, point ChecksumPoint) // Called when a leader's checksum differs from ours
+	mu          sync.Mutex                          // A mutex to protect the fields above
+}
+
+/*
+ * NewChecksumLog initializes an empty checksum log.
+ */
+func NewChecksumLog() *ChecksumLog {
+	return &ChecksumLog{agreed: -1}
+}
+
+/*
+ * Record records the database's checksum after applying the entry at index
+ * (or installing a snapshot that ends at index), and compares it with the
+ * leader's if the leader already sent its checksum at that index.
+ */
+func (l *ChecksumLog) Record(index int, checksum uint64) {
+	l.mu.Lock()
+	if len(l.checksums) > 0 && index == l.first+len(l.checksums) {
+		l.checksums = append(l.checksums, checksum)
+		if len(l.checksums) >= 2*checksumHistory {
+			drop := len(l.checksums) - checksumHistory
+			l.checksums = append([]uint64(nil), l.checksums[drop:]...)
+			l.first += drop
+		}
+	} else {
+		// A snapshot (or a restart) skipped the entries before index.
+		l.first = index
+		l.checksums = []uint64{checksum}
+	}
+
+	var point ChecksumPoint
+	var peer int
+	differs := false
+	if l.pending != nil && l.pending.Index <= index {
+		point, peer = *l.pending, l.pendingFrom
+		l.pending = nil
+		differs = l.compare(point)
+	}
+	mismatch := l.mismatch
+	l.mu.Unlock()
+
+	if differs && mismatch != nil {
+		mismatch(peer, point)
+	}
+}
+
+/*
+ * Compare compares the leader's checksum with ours at the same index, or keeps
+ * it until we have applied that index. Only one of the leader's checksums is
+ * kept at a time, so a follower that is behind still gets to compare one.
+ */
+func (l *ChecksumLog) Compare(peer int, point ChecksumPoint) {
+	l.mu.Lock()
+	differs := false
+	if point.Index >= l.first+len(l.checksums) {
+		if l.pending == nil {
+			l.pending = &point
+			l.pendingFrom = peer
+		}
+	} else {
+		differs = l.compare(point)
+	}
+	mismatch := l.mismatch
+	l.mu.Unlock()
+
+	if differs && mismatch != nil {
+		mismatch(peer, point)
+	}
+}
+
+/*
+ * compare returns true if the checksum differs from ours at its index, and we
+ * aren't already looking for (or haven't already found) where we diverged.
+ * Must be called with l.mu held.
+ */
+func (l *ChecksumLog) compare(point ChecksumPoint) bool {
+	ours, ok := l.at(point.Index)
+	if !ok || l.locating || l.divergence != nil {
+		return false
+	}
+	if ours == point.Checksum {
+		if point.Index > l.agreed {
+			l.agreed = point.Index
+		}
+		return false
+	}
+	l.locating = true
+	return true
+}
+
+/*
+ * at returns our checksum at index, if we still keep it. Must be called with
+ * l.mu held.
+ */
+func (l *ChecksumLog) at(index int) (uint64, bool) {
+	if index < l.first || index >= l.first+len(l.checksums) {
+		return 0, false
+	}
+	return l.checksums[index-l.first], true
+}
+
+/*
+ * Latest returns the checksum after the last entry applied, or false if none
+ * was recorded yet.
+ */
+func (l *ChecksumLog) Latest() (ChecksumPoint, bool) {
+	l.mu.Lock()
+	defer l.mu.Unlock()
+
+	if len(l.checksums) == 0 {
+		return ChecksumPoint{Index: -1}, false
+	}
+	last := len(l.checksums) - 1
+	return ChecksumPoint{Index: l.first + last, Checksum: l.checksums[last]}, true
+}
+
+/*
+ * Between returns the checksums we keep from index from to index to, along
+ * with the index of the first one returned.
+ */
+func (l *ChecksumLog) Between(from, to int) (int, []uint64) {
+	l.mu.Lock()
+	defer l.mu.Unlock()
+
+	if from < l.first {
+		from = l.first
+	}
+	if last := l.first + len(l.checksums) - 1; to > last {
+		to = last
+	}
+	if from > to {
+		return from, nil
+	}
+	return from, append([]uint64(nil), l.checksums[from-l.first:to-l.first+1]...)
+}
+
+/*
+ * Divergence returns where our database was found to differ from the
+ * leader's, or nil if it wasn't.
+ */
+func (l *ChecksumLog) Divergence() *Divergence {
+	l.mu.Lock()
+	defer l.mu.Unlock()
+
+	if l.divergence == nil {
+		return nil
+	}
+	divergence := *l.divergence
+	return &divergence
+}
+
+/*
+ * locate flags the first index at which our checksums differ from the peer's,
+ * given the peer's checksums starting at index from, up to the index at which
+ * they were found to differ, and returns it. If the peer no longer had the
+ * checksums we needed, the index at which they were found to differ is
+ * flagged instead.
+ */
+func (l *ChecksumLog) locate(peer int, point ChecksumPoint, from int, theirs []uint64) *Divergence {
+	l.mu.Lock()
+	defer l.mu.Unlock()
+
+	l.locating = false
+	l.divergence = &Divergence{Peer: peer, Index: point.Index, Theirs: point.Checksum}
+	l.divergence.Ours, _ = l.at(point.Index)
+
+	start := from
+	if start <= l.agreed {
+		start = l.agreed + 1
+	}
+	if start < l.first {
+		start = l.first
+	}
+	for index := start; index <= point.Index && index-from < len(theirs); index++ {
+		ours, ok := l.at(index)
+		if ok && ours != theirs[index-from] {
+			// The index is the first one only if they agreed on the one
+			// before it.
+			l.divergence = &Divergence{
+				Peer:   peer,
+				Index:  index,
+				Exact:  index > start || index-1 == l.agreed,
+				Ours:   ours,
+				Theirs: theirs[index-from],
+			}
+			break
+		}
+	}
+	divergence := *l.divergence
+	return &divergence
+}
+
+/*
+ * retryLocate lets the next mismatch look for where we diverged again, after
+ * the leader couldn't be asked.
+ */
+func (l *ChecksumLog) retryLocate() {
+	l.mu.Lock()
+	defer l.mu.Unlock()
+
+	l.locating = false
+}
+
+// ================================ COMPARISON ================================
+
+/*
+ * SetChecksumLog gives the node the log of its database's checksums, which
+ * the node's state machine records entries into. As the leader, the node then
+ * sends its latest checksum with every AppendEntries; as a follower, it checks
+ * the leader's against its own. Must be called before Start.
+ */
+func (node *ConsensusModule) SetChecksumLog(checksums *ChecksumLog) {
+	node.checksums = checksums
+
+	checksums.mu.Lock()
+	checksums.mismatch = func(peer int, point ChecksumPoint) {
+		node.runtime.Go(func() { node.locateDivergence(peer, point) })
+	}
+	checksums.mu.Unlock()
+}
+
+/*
+ * latestChecksum returns the checksum the leader sends with an AppendEntries,
+ * or nil if it has none.
+ */
+func (node *ConsensusModule) latestChecksum() *ChecksumPoint {
+	if node.checksums == nil {
+		return nil
+	}
+	point, ok := node.checksums.Latest()
+	if !ok {
+		return nil
+	}
+	return &point
+}
+
+/*
+ * locateDivergence asks the leader, whose checksum at point's index differs
+ * from ours, for its checksums since the last index at which we agreed, and
+ * flags the first index at which they differ. If the leader can't be asked,
+ * the next mismatch tries again.
+ */
+func (node *ConsensusModule) locateDivergence(peer int, point ChecksumPoint) {
+	node.checksums.mu.Lock()
+	from := node.checksums.agreed + 1
+	node.checksums.mu.Unlock()
+
+	var reply ChecksumsReply
+	err := node.DoRPC(peer, "ConsensusModule.Checksums", ChecksumsArgs{From: from, To: point.Index}, &reply)
+	if err != nil {
+		node.checksums.retryLocate()
+		log.Printf("[ConsensusModule] Our checksum at index %d differs from node %d's, but asking it for its checksums failed: %v",
+			point.Index, peer, err)
+		return
+	}
+
+	divergence := node.checksums.locate(peer, point, reply.From, reply.Checksums)
+	if divergence.Exact {
+		log.Printf("[ConsensusModule] DIVERGED: our database differs from node %d's from index %d on (checksum %016x, theirs %016x)",
+			peer, divergence.Index, divergence.Ours, divergence.Theirs)
+	} else {
+		log.Printf("[ConsensusModule] DIVERGED: our database differs from node %d's at index %d, and may have before (checksum %016x, theirs %016x)",
+			peer, divergence.Index, divergence.Ours, divergence.Theirs)
+	}
+}
+
+/*
+ * Checksums is the handler for the Checksums RPC, through which a follower
+ * whose checksum differs from ours finds where it diverged.
+ */
+func (node *ConsensusModule) Checksums(args ChecksumsArgs, reply *ChecksumsReply) error {
+	if node.checksums == nil {
+		return errors.New("no checksums are kept")
+	}
+	reply.From, reply.Checksums = node.checksums.Between(args.From, args.To)
+	return nil
+}
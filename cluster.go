@@ -0,0 +1,256 @@
+package main
+
+// The cluster.go file loads the static cluster configuration file, which
+// lists every node of the cluster with its ID, the address clients reach it
+// on, the address its peers reach it on and its role:
+//
+//     [[node]]
+//     id = 0
+//     client = "localhost:8090"
+//     peer = "localhost:9090"
+//     metrics = "localhost:10090"
+//     role = "voter"
+//
+// The peer address defaults to the client port plus peerPortOffset, the
+// metrics address to the client port plus metricsPortOffset, and the role to
+// "voter" ("learner" is the other choice; see membership.go).
+
+import (
+	"fmt"
+	"net"
+	"net/rpc"
+	"strconv"
+	"time"
+
+	"github.com/BurntSushi/toml"
+)
+
+// ============================= CLUSTER CONFIG ===============================
+
+// ClusterConfig represents the contents of a cluster configuration file.
+type ClusterConfig struct {
+	Nodes []NodeConfig `toml:"node"`
+}
+
+// NodeConfig represents one node in a cluster configuration file.
+type NodeConfig struct {
+	ID      int    `toml:"id"`      // The node's ID, which it keeps for good
+	Client  string `toml:"client"`  // The address clients (and the admin tool) use
+	Peer    string `toml:"peer"`    // The address the other backends send RPCs to
+	Metrics string `toml:"metrics"` // The address /metrics is served on
+	Role    string `toml:"role"`    // "voter" or "learner"
+}
+
+/*
+ * LoadClusterConfig reads and validates a cluster configuration file. The
+ * returned error names the file and, if it is about a node, the node.
+ */
+func LoadClusterConfig(path string) (*ClusterConfig, error) {
+	config := &ClusterConfig{}
+	meta, err := toml.DecodeFile(path, config)
+	if err != nil {
+		return nil, fmt.Errorf("%s: %v", path, err)
+	}
+	if undecoded := meta.Undecoded(); len(undecoded) > 0 {
+		return nil, fmt.Errorf("%s: unknown key %q", path, undecoded[0].String())
+	}
+	if err := config.validate(); err != nil {
+		return nil, fmt.Errorf("%s: %v", path, err)
+	}
+	return config, nil
+}
+
+/*
+ * validate checks that the nodes have distinct IDs and addresses and a valid
+ * role, and that at least one of them votes. Missing peer and metrics
+ * addresses and roles are filled in with their defaults, and addresses
+ * without a host get "localhost".
+ */
+func (config *ClusterConfig) validate() error {
+	if len(config.Nodes) == 0 {
+		return fmt.Errorf("no nodes; add a [[node]] table for each backend")
+	}
+
+	ids := make(map[int]bool)
+	addresses := make(map[string]int)
+	voters := 0
+	for i := range config.Nodes {
+		node := &config.Nodes[i]
+
+		if node.ID < 0 {
+			return fmt.Errorf("node %d: id must not be negative", node.ID)
+		}
+		if ids[node.ID] {
+			return fmt.Errorf("node %d: id is used by another node", node.ID)
+		}
+		ids[node.ID] = true
+
+		if node.Client == "" {
+			return fmt.Errorf("node %d: missing client address", node.ID)
+		}
+		client, err := normalizeAddress(node.Client)
+		if err != nil {
+			return fmt.Errorf("node %d: invalid client address %q: %v", node.ID, node.Client, err)
+		}
+		node.Client = client
+
+		if node.Peer == "" {
+			node.Peer, err = OffsetAddress(node.Client, peerPortOffset)
+			if err != nil {
+				return fmt.Errorf("node %d: can't derive the peer address from %s: %v", node.ID, node.Client, err)
+			}
+		}
+		peer, err := normalizeAddress(node.Peer)
+		if err != nil {
+			return fmt.Errorf("node %d: invalid peer address %q: %v", node.ID, node.Peer, err)
+		}
+		node.Peer = peer
+
+		if node.Metrics == "" {
+			node.Metrics, err = OffsetAddress(node.Client, metricsPortOffset)
+			if err != nil {
+				return fmt.Errorf("node %d: can't derive the metrics address from %s: %v", node.ID, node.Client, err)
+			}
+		}
+		metrics, err := normalizeAddress(node.Metrics)
+		if err != nil {
+			return fmt.Errorf("node %d: invalid metrics address %q: %v", node.ID, node.Metrics, err)
+		}
+		node.Metrics = metrics
+
+		// A default address can land on another node's port as easily as
+		// one that was given.
+		for _, address := range []string{node.Client, node.Peer, node.Metrics} {
+			if other, ok := addresses[address]; ok {
+				return fmt.Errorf("node %d: address %s is also used by node %d", node.ID, address, other)
+			}
+			addresses[address] = node.ID
+		}
+
+		switch node.Role {
+		case "", "voter":
+			node.Role = "voter"
+			voters++
+		case "learner":
+		default:
+			return fmt.Errorf("node %d: role must be \"voter\" or \"learner\", not %q", node.ID, node.Role)
+		}
+	}
+
+	if voters == 0 {
+		return fmt.Errorf("no voters; at least one node must have role \"voter\"")
+	}
+	return nil
+}
+
+/*
+ * normalizeAddress checks that an address is a host and a port, and returns
+ * it with "localhost" as the host if it had none.
+ */
+func normalizeAddress(address string) (string, error) {
+	host, port, err := net.SplitHostPort(address)
+	if err != nil {
+		return "", err
+	}
+	if n, err := strconv.Atoi(port); err != nil || n <= 0 || n > 65535 {
+		return "", fmt.Errorf("invalid port %q", port)
+	}
+	if host == "" {
+		host = "localhost"
+	}
+	return net.JoinHostPort(host, port), nil
+}
+
+/*
+ * Node returns the node with the given ID, or nil if there is none.
+ */
+func (config *ClusterConfig) Node(id int) *NodeConfig {
+	for i := range config.Nodes {
+		if config.Nodes[i].ID == id {
+			return &config.Nodes[i]
+		}
+	}
+	return nil
+}
+
+/*
+ * Configuration returns the membership configuration a new cluster of these
+ * nodes starts with.
+ */
+func (config *ClusterConfig) Configuration() Configuration {
+	members := Configuration{}
+	for _, node := range config.Nodes {
+		members[node.ID] = Member{Endpoint: node.Client, Learner: node.Role == "learner"}
+	}
+	return members
+}
+
+/*
+ * ClientEndpoints returns the client addresses of every node.
+ */
+func (config *ClusterConfig) ClientEndpoints() []string {
+	endpoints := []string{}
+	for _, node := range config.Nodes {
+		endpoints = append(endpoints, node.Client)
+	}
+	return endpoints
+}
+
+/*
+ * PeerAddresses returns each node's peer address, by client address.
+ */
+func (config *ClusterConfig) PeerAddresses() map[string]string {
+	addresses := make(map[string]string)
+	for _, node := range config.Nodes {
+		addresses[node.Client] = node.Peer
+	}
+	return addresses
+}
+
+// ============================== CLUSTER STATUS ==============================
+
+// statusTimeout is how long FetchNodeStatus (or FetchAlbums) waits for a
+// backend to connect and answer, so that one that is down doesn't hold up a
+// status page.
+const statusTimeout = 1 * time.Second
+
+/*
+ * FetchNodeStatus calls Admin.Status on the backend serving RPCs at the given
+ * peer address.
+ */
+func FetchNodeStatus(address string) (NodeStatus, error) {
+	var status NodeStatus
+	err := callWithTimeout(address, "Admin.Status", StatusArgs{}, &status)
+	return status, err
+}
+
+/*
+ * FetchAlbums calls Admin.Albums on the backend serving RPCs at the given peer
+ * address.
+ */
+func FetchAlbums(address string) (AlbumsReply, error) {
+	var albums AlbumsReply
+	err := callWithTimeout(address, "Admin.Albums", AlbumsArgs{}, &albums)
+	return albums, err
+}
+
+/*
+ * callWithTimeout calls an RPC on the backend serving RPCs at the given peer
+ * address, giving up after statusTimeout.
+ */
+func callWithTimeout(address, method string, args, reply interface{}) error {
+	conn, err := net.DialTimeout("tcp", address, statusTimeout)
+	if err != nil {
+		return err
+	}
+	client := rpc.NewClient(conn)
+	defer client.Close()
+
+	call := client.Go(method, args, reply, make(chan *rpc.Call, 1))
+	select {
+	case <-call.Done:
+		return call.Error
+	case <-time.After(statusTimeout):
+		return fmt.Errorf("%s didn't answer within %v", address, statusTimeout)
+	}
+}
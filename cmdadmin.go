@@ -0,0 +1,296 @@
+package main
+
+import (
+	"fmt"
+	"net/rpc"
+	"os"
+	"sort"
+	"strconv"
+	"text/tabwriter"
+	"time"
+)
+
+// ================================ ADMIN TOOL ================================
+
+// adminUsage describes how to invoke the admin tool.
+const adminUsage = `usage:
+    ./admin [--config <cluster.toml>] --backend host:port add <id> <host:port>
+    ./admin [--config <cluster.toml>] --backend host:port add-learner <id> <host:port>
+    ./admin [--config <cluster.toml>] --backend host:port promote <id>
+    ./admin [--config <cluster.toml>] --backend host:port remove <id>
+    ./admin [--config <cluster.toml>] --backend host:port transfer <id>
+    ./admin [--config <cluster.toml>] --backend host:port status
+    ./admin [--config <cluster.toml>] --backend host:port compare
+
+The admin RPCs go to the backend's peer address, which is looked up in the
+cluster configuration file if one is given.`
+
+/*
+ * CallAdmin calls an admin RPC on the backend serving RPCs at the given peer
+ * address and prints the result.
+ */
+func CallAdmin(address, method string, args interface{}) {
+	client, err := rpc.Dial("tcp", address)
+	if err != nil {
+		fmt.Println(err)
+		os.Exit(1)
+	}
+	defer client.Close()
+
+	var reply AdminReply
+	if err := client.Call("Admin."+method, args, &reply); err != nil {
+		fmt.Println(err)
+		os.Exit(1)
+	}
+
+	fmt.Println(reply.Message)
+	if !reply.Status {
+		os.Exit(1)
+	}
+}
+
+/*
+ * PrintStatus prints the Raft state of the backend serving RPCs at the given
+ * peer address, with a line per peer.
+ */
+func PrintStatus(address string) {
+	status, err := FetchNodeStatus(address)
+	if err != nil {
+		fmt.Println(err)
+		os.Exit(1)
+	}
+
+	role := "voter"
+	if status.Learner {
+		role = "learner"
+	}
+	fmt.Printf("node %d (%s, %s) at %s\n", status.ID, status.State, role, status.Endpoint)
+	fmt.Printf("term %d, voted for %d, leader %d (%s)\n",
+		status.CurrentTerm, status.VotedFor, status.LeaderID, status.LeaderEndpoint)
+	fmt.Printf("commit %d, applied %d, last log index %d, log length %d, snapshot %d\n",
+		status.CommitIndex, status.LastApplied, status.LastLogIndex, status.LogLength, status.SnapshotIndex)
+	if status.Checksum.Index >= 0 {
+		fmt.Printf("checksum %016x at index %d\n", status.Checksum.Checksum, status.Checksum.Index)
+	}
+	if divergence := status.Divergence; divergence != nil {
+		at := "from index"
+		if !divergence.Exact {
+			at = "at or before index"
+		}
+		fmt.Printf("DIVERGED from node %d %s %d (checksum %016x, node %d's %016x)\n",
+			divergence.Peer, at, divergence.Index, divergence.Ours, divergence.Peer, divergence.Theirs)
+	}
+	if len(status.Peers) == 0 {
+		return
+	}
+
+	fmt.Println()
+	w := tabwriter.NewWriter(os.Stdout, 0, 0, 2, ' ', 0)
+	fmt.Fprintln(w, "PEER\tENDPOINT\tROLE\tNEXT\tMATCH\tCONNECTED\tLAST ERROR")
+	for _, peer := range status.Peers {
+		role := "voter"
+		if peer.Learner {
+			role = "learner"
+		}
+		fmt.Fprintf(w, "%d\t%s\t%s\t%d\t%d\t%t\t%s\n",
+			peer.ID, peer.Endpoint, role, peer.NextIndex, peer.MatchIndex, peer.Connected, peer.LastError)
+	}
+	w.Flush()
+}
+
+// compareAttempts is how many times CompareDatabases fetches the databases,
+// waiting compareRetryDelay in between, until every node has applied the same
+// index.
+const (
+	compareAttempts   = 10
+	compareRetryDelay = 100 * time.Millisecond
+)
+
+/*
+ * CompareDatabases fetches the database of the backend serving RPCs at the
+ * given peer address and of each of its peers, whose peer addresses are looked
+ * up in addresses, and prints every album that isn't the same on all of them.
+ * Exits with status 1 if any differ.
+ *
+ * A node that is behind is missing the latest writes, so the databases are
+ * fetched again until every node has applied the same index; if writes keep
+ * coming, the differences are printed anyway, along with each node's index.
+ */
+func CompareDatabases(address string, addresses map[string]string) {
+	status, err := FetchNodeStatus(address)
+	if err != nil {
+		fmt.Println(err)
+		os.Exit(1)
+	}
+	nodes := []string{address}
+	for _, peer := range status.Peers {
+		peerAddress, ok := addresses[peer.Endpoint]
+		if !ok {
+			peerAddress, err = PeerEndpoint(peer.Endpoint)
+			if err != nil {
+				fmt.Println(err)
+				os.Exit(1)
+			}
+		}
+		nodes = append(nodes, peerAddress)
+	}
+
+	var databases []AlbumsReply
+	sameIndex := false
+	for attempt := 0; attempt < compareAttempts && !sameIndex; attempt++ {
+		if attempt > 0 {
+			time.Sleep(compareRetryDelay)
+		}
+		databases = databases[:0]
+		for _, node := range nodes {
+			database, err := FetchAlbums(node)
+			if err != nil {
+				fmt.Println(err)
+				os.Exit(1)
+			}
+			databases = append(databases, database)
+		}
+		sameIndex = true
+		for _, database := range databases {
+			sameIndex = sameIndex && database.AppliedIndex == databases[0].AppliedIndex
+		}
+	}
+	sort.Slice(databases, func(i, j int) bool { return databases[i].ID < databases[j].ID })
+
+	w := tabwriter.NewWriter(os.Stdout, 0, 0, 2, ' ', 0)
+	fmt.Fprintln(w, "NODE\tAPPLIED\tCHECKSUM\tALBUMS\tNEXT ID")
+	for _, database := range databases {
+		fmt.Fprintf(w, "%d\t%d\t%016x\t%d\t%d\n",
+			database.ID, database.AppliedIndex, database.Checksum, len(database.Albums), database.CurrID)
+	}
+	w.Flush()
+	if !sameIndex {
+		fmt.Println("\nThe nodes had applied different indexes, so the writes in between show as differences.")
+	}
+
+	ids := []int{}
+	seen := make(map[int]bool)
+	for _, database := range databases {
+		for id := range database.Albums {
+			if !seen[id] {
+				seen[id] = true
+				ids = append(ids, id)
+			}
+		}
+	}
+	sort.Ints(ids)
+
+	differ := 0
+	for _, id := range ids {
+		first, firstOk := databases[0].Albums[id]
+		same := true
+		for _, database := range databases[1:] {
+			album, ok := database.Albums[id]
+			same = same && ok == firstOk && album == first
+		}
+		if same {
+			continue
+		}
+
+		differ++
+		fmt.Printf("\nalbum %d:\n", id)
+		for _, database := range databases {
+			if album, ok := database.Albums[id]; ok {
+				fmt.Printf("    node %d: %q by %q (%s) %q\n", database.ID, album.Title, album.Artist, album.Year, album.URL)
+			} else {
+				fmt.Printf("    node %d: missing\n", database.ID)
+			}
+		}
+	}
+
+	sameNextID := true
+	for _, database := range databases {
+		sameNextID = sameNextID && database.CurrID == databases[0].CurrID
+	}
+	if differ == 0 && sameNextID {
+		fmt.Println("\nEvery node's database is the same.")
+		return
+	}
+	fmt.Printf("\n%d of %d albums differ", differ, len(ids))
+	if !sameNextID {
+		fmt.Printf(", and the next album ID differs")
+	}
+	fmt.Println(".")
+	os.Exit(1)
+}
+
+// ========================= MAIN & PARSING FUNCTIONS =========================
+
+/*
+ * ParseNodeID parses a node ID given on the command line.
+ */
+func ParseNodeID(arg string) int {
+	id, err := strconv.Atoi(arg)
+	if err != nil || id < 0 {
+		fmt.Println(adminUsage)
+		os.Exit(1)
+	}
+	return id
+}
+
+func main() {
+	args := os.Args
+	addresses := map[string]string{}
+	if len(args) > 2 && args[1] == "--config" {
+		cluster, err := LoadClusterConfig(args[2])
+		if err != nil {
+			fmt.Println(err)
+			os.Exit(1)
+		}
+		addresses = cluster.PeerAddresses()
+		args = append(args[:1], args[3:]...)
+	}
+	if len(args) < 4 || args[1] != "--backend" {
+		fmt.Println(adminUsage)
+		os.Exit(1)
+	}
+	endpoint := ParseEndpoint(args[2])
+	command := args[3:]
+
+	address, ok := addresses[endpoint]
+	if !ok {
+		var err error
+		address, err = PeerEndpoint(endpoint)
+		if err != nil {
+			fmt.Println(err)
+			os.Exit(1)
+		}
+	}
+
+	switch {
+	case command[0] == "add" && len(command) == 3:
+		CallAdmin(address, "AddServer", MembershipChangeArgs{
+			ID:       ParseNodeID(command[1]),
+			Endpoint: ParseEndpoint(command[2]),
+		})
+	case command[0] == "add-learner" && len(command) == 3:
+		CallAdmin(address, "AddLearner", MembershipChangeArgs{
+			ID:       ParseNodeID(command[1]),
+			Endpoint: ParseEndpoint(command[2]),
+		})
+	case command[0] == "promote" && len(command) == 2:
+		CallAdmin(address, "PromoteLearner", MembershipChangeArgs{
+			ID: ParseNodeID(command[1]),
+		})
+	case command[0] == "remove" && len(command) == 2:
+		CallAdmin(address, "RemoveServer", MembershipChangeArgs{
+			ID: ParseNodeID(command[1]),
+		})
+	case command[0] == "transfer" && len(command) == 2:
+		CallAdmin(address, "TransferLeadership", TransferLeadershipArgs{
+			ID: ParseNodeID(command[1]),
+		})
+	case command[0] == "status" && len(command) == 1:
+		PrintStatus(address)
+	case command[0] == "compare" && len(command) == 1:
+		CompareDatabases(address, addresses)
+	default:
+		fmt.Println(adminUsage)
+		os.Exit(1)
+	}
+}
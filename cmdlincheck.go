@@ -0,0 +1,538 @@
+package main
+
+import (
+	crand "crypto/rand"
+	"encoding/gob"
+	"encoding/hex"
+	"errors"
+	"fmt"
+	"math/rand"
+	"net"
+	"os"
+	"os/exec"
+	"os/signal"
+	"path/filepath"
+	"strconv"
+	"strings"
+	"sync"
+	"syscall"
+	"time"
+)
+
+// ========================== LINEARIZABILITY CHECKER =========================
+
+// lincheckUsage describes how to invoke the linearizability checker.
+const lincheckUsage = `usage:
+    ./lincheck [--backend-binary ./backend] [--nodes <n>] [--port <port>]
+               [--clients <n>] [--duration <seconds>] [--faults pause|crash|none]
+               [--read-level linearizable|local] [--keep]`
+
+// lincheckRequestTimeout is how long a client waits for a backend to answer
+// before trying again, possibly at another backend.
+const lincheckRequestTimeout = 2 * time.Second
+
+// lincheckOperationTimeout is how long a client keeps trying an operation
+// before giving up on learning its outcome.
+const lincheckOperationTimeout = 10 * time.Second
+
+// lincheckRetry is how long a client waits before retrying when it doesn't
+// know where to send a request.
+const lincheckRetry = 50 * time.Millisecond
+
+// lincheckAlbums is the range of album IDs the clients read and write, so
+// that they often touch the same albums.
+const lincheckAlbums = 12
+
+// ================================ LOCAL CLUSTER =============================
+
+// LocalCluster represents a cluster of backend processes on this machine,
+// which can be paused, crashed and restarted.
+type LocalCluster struct {
+	binary    string      // The backend binary
+	dir       string      // The directory holding the backends' data and logs
+	endpoints []string    // The backends' client endpoints
+	processes []*exec.Cmd // The running backends (nil if crashed)
+	mu        sync.Mutex  // A mutex to protect processes
+}
+
+/*
+ * StartLocalCluster starts a new cluster of backends listening on
+ * consecutive ports, with their data and logs in dir.
+ */
+func StartLocalCluster(binary, dir string, nodes, port int) (*LocalCluster, error) {
+	cluster := &LocalCluster{
+		binary:    binary,
+		dir:       dir,
+		processes: make([]*exec.Cmd, nodes),
+	}
+	for i := 0; i < nodes; i++ {
+		cluster.endpoints = append(cluster.endpoints, "localhost:"+strconv.Itoa(port+i))
+	}
+
+	for i := range cluster.endpoints {
+		if err := cluster.Start(i); err != nil {
+			cluster.Stop()
+			return nil, err
+		}
+	}
+	return cluster, nil
+}
+
+/*
+ * Start starts backend i, with the data it had if it ran before.
+ */
+func (cluster *LocalCluster) Start(i int) error {
+	logFile, err := os.OpenFile(filepath.Join(cluster.dir, fmt.Sprintf("node%d.log", i)),
+		os.O_CREATE|os.O_WRONLY|os.O_APPEND, 0644)
+	if err != nil {
+		return err
+	}
+	defer logFile.Close()
+
+	port := cluster.endpoints[i][strings.LastIndex(cluster.endpoints[i], ":")+1:]
+	cmd := exec.Command(cluster.binary,
+		"--listen", port,
+		"--backend", strings.Join(cluster.endpoints, ","),
+		"--data-dir", filepath.Join(cluster.dir, fmt.Sprintf("node%d", i)))
+	cmd.Stdout = logFile
+	cmd.Stderr = logFile
+	if err := cmd.Start(); err != nil {
+		return err
+	}
+
+	cluster.mu.Lock()
+	defer cluster.mu.Unlock()
+
+	cluster.processes[i] = cmd
+	return nil
+}
+
+/*
+ * signal sends a signal to backend i, if it is running.
+ */
+func (cluster *LocalCluster) signal(i int, sig os.Signal) {
+	cluster.mu.Lock()
+	defer cluster.mu.Unlock()
+
+	if cluster.processes[i] != nil {
+		cluster.processes[i].Process.Signal(sig)
+	}
+}
+
+/*
+ * Pause stops backend i from running, without closing its connections.
+ */
+func (cluster *LocalCluster) Pause(i int) {
+	cluster.signal(i, syscall.SIGSTOP)
+}
+
+/*
+ * Resume lets a paused backend run again.
+ */
+func (cluster *LocalCluster) Resume(i int) {
+	cluster.signal(i, syscall.SIGCONT)
+}
+
+/*
+ * Crash kills backend i.
+ */
+func (cluster *LocalCluster) Crash(i int) {
+	cluster.mu.Lock()
+	cmd := cluster.processes[i]
+	cluster.processes[i] = nil
+	cluster.mu.Unlock()
+
+	if cmd != nil {
+		cmd.Process.Kill()
+		cmd.Wait()
+	}
+}
+
+/*
+ * Stop kills every backend.
+ */
+func (cluster *LocalCluster) Stop() {
+	for i := range cluster.processes {
+		cluster.Resume(i)
+		cluster.Crash(i)
+	}
+}
+
+/*
+ * WaitForLeader waits until one of the backends knows who the leader is.
+ */
+func (cluster *LocalCluster) WaitForLeader(timeout time.Duration) error {
+	deadline := time.Now().Add(timeout)
+	for time.Now().Before(deadline) {
+		for _, endpoint := range cluster.endpoints {
+			response := &NodeMessage{}
+			if exchangeWithTimeout(endpoint, &DataMessage{Method: "GetLeader"}, response) == nil &&
+				response.Endpoint != "" {
+				return nil
+			}
+		}
+		time.Sleep(100 * time.Millisecond)
+	}
+	return errors.New("no leader was elected")
+}
+
+/*
+ * InjectFaults pauses or crashes a random backend every 1-3 seconds, for
+ * 0.5-3 seconds at a time, until the deadline. Returns a description of each
+ * fault, with times relative to start.
+ */
+func InjectFaults(cluster *LocalCluster, kind string, start, deadline time.Time) []string {
+	faults := []string{}
+	if kind == "none" {
+		return faults
+	}
+
+	for {
+		time.Sleep(time.Duration(1000+rand.Intn(2000)) * time.Millisecond)
+		if time.Now().After(deadline) {
+			return faults
+		}
+
+		i := rand.Intn(len(cluster.endpoints))
+		from := time.Since(start)
+		if kind == "pause" {
+			cluster.Pause(i)
+		} else {
+			cluster.Crash(i)
+		}
+
+		time.Sleep(time.Duration(500+rand.Intn(2500)) * time.Millisecond)
+
+		if kind == "pause" {
+			cluster.Resume(i)
+			faults = append(faults, fmt.Sprintf("node %d paused from %v to %v",
+				i, from.Round(time.Millisecond), time.Since(start).Round(time.Millisecond)))
+		} else {
+			if err := cluster.Start(i); err != nil {
+				fmt.Println("couldn't restart node", i, err)
+			}
+			faults = append(faults, fmt.Sprintf("node %d crashed at %v, restarted at %v",
+				i, from.Round(time.Millisecond), time.Since(start).Round(time.Millisecond)))
+		}
+	}
+}
+
+// ================================== CLIENTS =================================
+
+/*
+ * exchangeWithTimeout sends a request to the backend at endpoint and decodes
+ * its reply into response, giving up after lincheckRequestTimeout.
+ */
+func exchangeWithTimeout(endpoint string, request *DataMessage, response interface{}) error {
+	conn, err := net.DialTimeout("tcp", endpoint, lincheckRequestTimeout)
+	if err != nil {
+		return err
+	}
+	defer conn.Close()
+
+	conn.SetDeadline(time.Now().Add(lincheckRequestTimeout))
+	if err := gob.NewEncoder(conn).Encode(request); err != nil {
+		return err
+	}
+	return gob.NewDecoder(conn).Decode(response)
+}
+
+// LincheckClient represents a client of the cluster that records the
+// operations it runs. Its writes belong to a client session, so that it can
+// resend a write until it learns the outcome without applying it twice.
+type LincheckClient struct {
+	ID        int
+	endpoints []string
+	leader    string    // Where the client sends its requests ("" if unknown)
+	readLevel ReadLevel // The level reads are served at
+	clientID  string    // The client's session ("" if none)
+	sequence  int       // The sequence number of the client's last write
+}
+
+/*
+ * send sends a request until a backend gives an answer that settles it, and
+ * returns that answer. A rejection from a backend that isn't the leader, a
+ * timeout or a lost connection only means the request should be retried; the
+ * request is given up on at the deadline. Local reads go to random backends.
+ */
+func (client *LincheckClient) send(request *DataMessage, deadline time.Time) (*DataMessage, error) {
+	for time.Now().Before(deadline) {
+		endpoint := client.leader
+		if endpoint == "" || (request.Method == "GetAlbum" && client.readLevel == READ_LOCAL) {
+			endpoint = client.endpoints[rand.Intn(len(client.endpoints))]
+		}
+
+		response := &DataMessage{}
+		if err := exchangeWithTimeout(endpoint, request, response); err != nil {
+			client.leader = ""
+			time.Sleep(lincheckRetry)
+			continue
+		}
+
+		if response.Status || response.Error == ErrAlbumNotFound.Error() ||
+			response.Error == ErrSessionExpired.Error() {
+			client.leader = endpoint
+			return response, nil
+		}
+
+		client.leader = response.Leader
+		if response.Leader == "" {
+			time.Sleep(lincheckRetry)
+		}
+	}
+	return nil, errors.New("gave up on the request")
+}
+
+/*
+ * register opens a client session.
+ */
+func (client *LincheckClient) register() error {
+	id := make([]byte, 16)
+	if _, err := crand.Read(id); err != nil {
+		return err
+	}
+
+	request := &DataMessage{Method: "RegisterClient", ClientID: hex.EncodeToString(id)}
+	if _, err := client.send(request, time.Now().Add(lincheckOperationTimeout)); err != nil {
+		return err
+	}
+	client.clientID = request.ClientID
+	client.sequence = 0
+	return nil
+}
+
+/*
+ * Run runs an operation and records its outcome in op. Returns false if the
+ * operation should be left out of the history: a read that got no answer, or
+ * a write that was certainly not applied.
+ */
+func (client *LincheckClient) Run(op *LinOperation) bool {
+	request := &DataMessage{Method: op.Method, Index: strconv.Itoa(op.ID)}
+	if op.Method == "GetAlbum" {
+		request.ReadLevel = client.readLevel
+	} else {
+		if client.clientID == "" {
+			if err := client.register(); err != nil {
+				return false
+			}
+		}
+		client.sequence += 1
+		request.ClientID = client.clientID
+		request.Sequence = client.sequence
+		if op.Method == "AddAlbum" || op.Method == "EditAlbum" {
+			request.AlbumArray = []*Album{&op.Album}
+		}
+	}
+
+	op.Client = client.ID
+	op.Call = time.Now()
+	response, err := client.send(request, op.Call.Add(lincheckOperationTimeout))
+	op.Return = time.Now()
+
+	if err != nil {
+		op.Pending = true
+		return op.Method != "GetAlbum"
+	}
+	if response.Error == ErrSessionExpired.Error() {
+		client.clientID = ""
+		return false
+	}
+
+	op.Found = response.Status
+	if op.Method == "GetAlbum" && response.Status {
+		op.Album = *response.AlbumArray[0]
+	}
+	return true
+}
+
+/*
+ * RandomOperation returns a random operation for the client to run.
+ */
+func (client *LincheckClient) RandomOperation(n int) *LinOperation {
+	id := rand.Intn(lincheckAlbums)
+	title := fmt.Sprintf("c%d-%d", client.ID, n)
+
+	switch choice := rand.Intn(100); {
+	case choice < 40:
+		return &LinOperation{Method: "GetAlbum", ID: id}
+	case choice < 60:
+		return &LinOperation{Method: "AddAlbum", Album: Album{Title: title, Artist: "lincheck", Year: "2024"}}
+	case choice < 85:
+		return &LinOperation{Method: "EditAlbum", ID: id, Album: Album{Title: title}}
+	default:
+		return &LinOperation{Method: "DeleteAlbum", ID: id}
+	}
+}
+
+// ========================= MAIN & PARSING FUNCTIONS =========================
+
+// LincheckFlags represents the command line flags the checker was invoked
+// with.
+type LincheckFlags struct {
+	Binary    string    // The backend binary
+	Nodes     int       // Number of backends
+	Port      int       // Client port of the first backend
+	Clients   int       // Number of concurrent clients
+	Duration  int       // Seconds of client operations
+	Faults    string    // The faults to inject: pause, crash or none
+	ReadLevel ReadLevel // The level reads are served at
+	Keep      bool      // Keep the backends' data and logs
+}
+
+func ParseLincheckCommandLineArgs() *LincheckFlags {
+	args := os.Args
+	flags := &LincheckFlags{
+		Binary:    "./backend",
+		Nodes:     3,
+		Port:      8190,
+		Clients:   4,
+		Duration:  20,
+		Faults:    "pause",
+		ReadLevel: READ_LINEARIZABLE,
+	}
+	i := 1
+	for i < len(args) {
+		if args[i] == "--backend-binary" {
+			flags.Binary = ParseValueFlag(args, i)
+			i += 2
+		} else if args[i] == "--nodes" {
+			flags.Nodes = ParseIntFlag(args, i)
+			i += 2
+		} else if args[i] == "--port" {
+			flags.Port = ParseIntFlag(args, i)
+			i += 2
+		} else if args[i] == "--clients" {
+			flags.Clients = ParseIntFlag(args, i)
+			i += 2
+		} else if args[i] == "--duration" {
+			flags.Duration = ParseIntFlag(args, i)
+			i += 2
+		} else if args[i] == "--faults" {
+			flags.Faults = ParseValueFlag(args, i)
+			i += 2
+		} else if args[i] == "--read-level" {
+			switch ParseValueFlag(args, i) {
+			case "linearizable":
+				flags.ReadLevel = READ_LINEARIZABLE
+			case "local":
+				flags.ReadLevel = READ_LOCAL
+			default:
+				fmt.Println(lincheckUsage)
+				os.Exit(1)
+			}
+			i += 2
+		} else if args[i] == "--keep" {
+			flags.Keep = true
+			i += 1
+		} else {
+			fmt.Println(lincheckUsage)
+			os.Exit(1)
+		}
+	}
+
+	if flags.Nodes == 0 || flags.Clients == 0 ||
+		(flags.Faults != "pause" && flags.Faults != "crash" && flags.Faults != "none") {
+		fmt.Println(lincheckUsage)
+		os.Exit(1)
+	}
+	return flags
+}
+
+func main() {
+	flags := ParseLincheckCommandLineArgs()
+
+	binary, err := filepath.Abs(flags.Binary)
+	if err != nil {
+		fmt.Println(err)
+		os.Exit(1)
+	}
+	dir, err := os.MkdirTemp("", "lincheck")
+	if err != nil {
+		fmt.Println(err)
+		os.Exit(1)
+	}
+
+	cluster, err := StartLocalCluster(binary, dir, flags.Nodes, flags.Port)
+	if err != nil {
+		fmt.Println(err)
+		os.Exit(1)
+	}
+
+	// Don't leave paused backends behind if interrupted.
+	interrupt := make(chan os.Signal, 1)
+	signal.Notify(interrupt, os.Interrupt, syscall.SIGTERM)
+	go func() {
+		<-interrupt
+		cluster.Stop()
+		os.Exit(1)
+	}()
+
+	if err := cluster.WaitForLeader(10 * time.Second); err != nil {
+		cluster.Stop()
+		fmt.Println(err)
+		os.Exit(1)
+	}
+
+	fmt.Printf("running %d clients against %d backends for %ds with %s faults (logs in %s)\n",
+		flags.Clients, flags.Nodes, flags.Duration, flags.Faults, dir)
+	start := time.Now()
+	deadline := start.Add(time.Duration(flags.Duration) * time.Second)
+
+	var faults []string
+	injected := make(chan struct{})
+	go func() {
+		faults = InjectFaults(cluster, flags.Faults, start, deadline)
+		close(injected)
+	}()
+
+	histories := make([][]LinOperation, flags.Clients)
+	var wg sync.WaitGroup
+	for c := 0; c < flags.Clients; c++ {
+		wg.Add(1)
+		go func(c int) {
+			defer wg.Done()
+			client := &LincheckClient{ID: c, endpoints: cluster.endpoints, readLevel: flags.ReadLevel}
+			for n := 0; time.Now().Before(deadline); n++ {
+				op := client.RandomOperation(n)
+				if client.Run(op) {
+					histories[c] = append(histories[c], *op)
+				}
+			}
+		}(c)
+	}
+	wg.Wait()
+	<-injected
+	cluster.Stop()
+
+	history := []LinOperation{}
+	reads, pending := 0, 0
+	for _, ops := range histories {
+		for _, op := range ops {
+			history = append(history, op)
+			if op.Method == "GetAlbum" {
+				reads += 1
+			}
+			if op.Pending {
+				pending += 1
+			}
+		}
+	}
+	fmt.Printf("recorded %d operations: %d reads, %d writes (%d with an unknown outcome)\n",
+		len(history), reads, len(history)-reads, pending)
+	for _, fault := range faults {
+		fmt.Println("  " + fault)
+	}
+
+	checked := time.Now()
+	result := CheckLinearizability(history)
+	fmt.Printf("checked in %v\n\n", time.Since(checked).Round(time.Millisecond))
+	fmt.Print(result.Report(history, start))
+
+	if !result.Linearizable {
+		fmt.Println("\nbackend logs are in", dir)
+		os.Exit(1)
+	}
+	if !flags.Keep {
+		os.RemoveAll(dir)
+	}
+}
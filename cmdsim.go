@@ -0,0 +1,571 @@
+package main
+
+import (
+	"fmt"
+	"io"
+	"log"
+	"os"
+	"strconv"
+	"strings"
+	"time"
+)
+
+// ================================= SIMULATOR ================================
+
+// simUsage describes how to invoke the simulator.
+const simUsage = `usage:
+    ./sim [--seed <n>] [--seeds <count>] [--nodes <n>] [--learners <n>]
+          [--duration <seconds>] [--drop <percent>] [--snapshot-entries <n>]
+          [--no-pre-vote] [--scenario random|prevote|catchup|checkquorum|learner|divergence]
+          [--trace]`
+
+// SimFlags represents the command line flags the simulator was invoked with.
+type SimFlags struct {
+	Seed            int64  // Seed of the first run
+	Seeds           int    // Number of runs, with consecutive seeds
+	Nodes           int    // Number of nodes in the cluster
+	Learners        int    // How many of the nodes are learners
+	Duration        int    // Virtual seconds of faults and client commands per run
+	DropPercent     int    // Percentage of messages lost
+	SnapshotEntries int    // Snapshot after this many applied log entries (0 never)
+	PreVote         bool   // Run a pre-vote before each election
+	Scenario        string // What to simulate (see scenarios)
+	Trace           bool   // Print the nodes' logs, stamped with the virtual time
+}
+
+// scenarios are the simulations the simulator can run, by name. Each runs a
+// cluster with the given seed and returns the first problem it finds.
+var scenarios = map[string]func(flags *SimFlags, cluster *SimCluster) error{
+	"random":      RandomScenario,
+	"prevote":     PreVoteScenario,
+	"catchup":     CatchUpScenario,
+	"checkquorum": CheckQuorumScenario,
+	"learner":     LearnerScenario,
+	"divergence":  DivergenceScenario,
+}
+
+// simSettleTime is how long a cluster is left alone at the end of a random
+// run, with no faults, before checking that every node has caught up.
+const simSettleTime = 3 * time.Second
+
+/*
+ * RandomScenario runs the cluster under a random workload while the network
+ * loses messages and is partitioned and healed at random. Afterwards the
+ * network is fixed and the client stops, and every node should catch up with
+ * the leader.
+ */
+func RandomScenario(flags *SimFlags, cluster *SimCluster) error {
+	running := true
+	cluster.Network.DropRate = float64(flags.DropPercent) / 100
+	cluster.Network.MaxDelay = 20 * time.Millisecond
+	cluster.Start()
+	SimulateClient(cluster, &running)
+	SimulatePartitions(cluster, &running)
+
+	if err := cluster.Run(time.Duration(flags.Duration) * time.Second); err != nil {
+		return err
+	}
+
+	running = false
+	cluster.Network.Heal()
+	cluster.Network.DropRate = 0
+	if err := cluster.Run(simSettleTime); err != nil {
+		return err
+	}
+	return cluster.CheckConverged()
+}
+
+/*
+ * PreVoteScenario cuts a follower off from a healthy cluster for a while and
+ * then lets it back in. The leader should stay the leader, in the same term;
+ * without pre-vote, the returning node forces it to step down.
+ */
+func PreVoteScenario(flags *SimFlags, cluster *SimCluster) error {
+	cluster.Start()
+	if err := cluster.Run(2 * time.Second); err != nil {
+		return err
+	}
+	leader := cluster.Leader()
+	if leader == nil {
+		return fmt.Errorf("no leader was elected")
+	}
+	term, _ := leader.State()
+
+	follower := cluster.Nodes[(leader.ID+1)%len(cluster.Nodes)]
+	cluster.Network.Partition([]string{follower.Endpoint})
+	if err := cluster.Run(2 * time.Second); err != nil {
+		return err
+	}
+	isolatedTerm, _ := follower.State()
+
+	cluster.Network.Heal()
+	if err := cluster.Run(2 * time.Second); err != nil {
+		return err
+	}
+
+	current := cluster.Leader()
+	if current == nil {
+		return fmt.Errorf("no leader after node %d rejoined (it reached term %d while cut off)",
+			follower.ID, isolatedTerm)
+	}
+	if currentTerm, _ := current.State(); current != leader || currentTerm != term {
+		return fmt.Errorf("node %d (leader in term %d) was replaced by node %d in term %d after node %d rejoined (it reached term %d while cut off)",
+			leader.ID, term, current.ID, currentTerm, follower.ID, isolatedTerm)
+	}
+	return nil
+}
+
+/*
+ * CheckQuorumScenario cuts the leader off from the rest of the cluster. Within
+ * an election timeout or so it should notice that it can't reach a majority
+ * and step down, while the others elect a new leader.
+ */
+func CheckQuorumScenario(flags *SimFlags, cluster *SimCluster) error {
+	cluster.Start()
+	if err := cluster.Run(2 * time.Second); err != nil {
+		return err
+	}
+	leader := cluster.Leader()
+	if leader == nil {
+		return fmt.Errorf("no leader was elected")
+	}
+
+	cluster.Network.Partition([]string{leader.Endpoint})
+	if err := cluster.Run(time.Second); err != nil {
+		return err
+	}
+	if _, isLeader := leader.State(); isLeader {
+		return fmt.Errorf("node %d is still the leader a second after it was cut off", leader.ID)
+	}
+	if current := cluster.Leader(); current == nil {
+		return fmt.Errorf("no leader was elected without node %d", leader.ID)
+	}
+	return nil
+}
+
+// catchUpEntries is how many entries the CatchUpScenario submits to each
+// side of the partition.
+const catchUpEntries = 500
+
+/*
+ * CatchUpScenario cuts the leader off right after submitting entries to it,
+ * which the rest of the cluster never sees, and lets the others elect a new
+ * leader and commit as many entries. Then the new leader is cut off instead,
+ * and the next leader starts out assuming the old leader's log matches its
+ * own; in fact they conflict over hundreds of entries. The old leader should
+ * still catch up within a few heartbeats, not one entry per heartbeat.
+ * Snapshots are off, so it has to catch up from the log. Finally a node with
+ * an empty log joins the cluster, and has to catch up from the first entry.
+ */
+func CatchUpScenario(flags *SimFlags, cluster *SimCluster) error {
+	cluster.SnapshotEntries = 0
+	cluster.Start()
+	if err := cluster.Run(2 * time.Second); err != nil {
+		return err
+	}
+	stale := cluster.Leader()
+	if stale == nil {
+		return fmt.Errorf("no leader was elected")
+	}
+
+	cluster.Network.Partition([]string{stale.Endpoint})
+	for i := 0; i < catchUpEntries; i++ {
+		cluster.Submit(stale, NewCommand(&AddAlbumCommand{
+			Title: "Lost album " + strconv.Itoa(i), Artist: "Artist", Year: "2020"}))
+	}
+	if err := cluster.Run(2 * time.Second); err != nil {
+		return err
+	}
+
+	leader := cluster.Leader()
+	if leader == nil || leader == stale {
+		return fmt.Errorf("no leader was elected without node %d", stale.ID)
+	}
+	for i := 0; i < catchUpEntries; i++ {
+		cluster.Submit(leader, NewCommand(&AddAlbumCommand{
+			Title: "Album " + strconv.Itoa(i), Artist: "Artist", Year: "2020"}))
+	}
+	if err := cluster.Run(2 * time.Second); err != nil {
+		return err
+	}
+
+	cluster.Network.Partition([]string{leader.Endpoint})
+	if err := cluster.Run(2 * time.Second); err != nil {
+		return err
+	}
+	cluster.Network.Heal()
+	if err := cluster.Run(time.Second); err != nil {
+		return err
+	}
+	if err := cluster.CheckConverged(); err != nil {
+		return err
+	}
+
+	// A node that joins with an empty log needs every entry from the first
+	// one on, and should catch up just as quickly.
+	joiner := cluster.AddNode(flags.PreVote)
+	leader = cluster.Leader()
+	if leader == nil {
+		return fmt.Errorf("no leader after the network was healed")
+	}
+	if _, _, err := leader.Consensus.AddServer(joiner.ID, joiner.Endpoint, false); err != nil {
+		return fmt.Errorf("adding node %d: %v", joiner.ID, err)
+	}
+	if err := cluster.Run(time.Second); err != nil {
+		return err
+	}
+	return cluster.CheckConverged()
+}
+
+/*
+ * LearnerScenario cuts the leader and the learners off from the other voters.
+ * The leader's side has most of the nodes but not a majority of the voters, so
+ * it must not commit anything, while the other side elects a new leader. Once
+ * the network is healed and the learners have caught up, one of them is
+ * promoted to a voter.
+ */
+func LearnerScenario(flags *SimFlags, cluster *SimCluster) error {
+	if flags.Learners == 0 || flags.Nodes-flags.Learners < 3 {
+		return fmt.Errorf("the learner scenario needs at least 3 voters and a learner")
+	}
+	learners := cluster.Nodes[flags.Nodes-flags.Learners:]
+
+	cluster.Start()
+	if err := cluster.Run(2 * time.Second); err != nil {
+		return err
+	}
+	stranded := cluster.Leader()
+	if stranded == nil {
+		return fmt.Errorf("no leader was elected")
+	}
+
+	side := []string{stranded.Endpoint}
+	for _, learner := range learners {
+		side = append(side, learner.Endpoint)
+	}
+	cluster.Network.Partition(side)
+	for i := 0; i < 10; i++ {
+		cluster.Submit(stranded, NewCommand(&AddAlbumCommand{
+			Title: "Stranded album " + strconv.Itoa(i), Artist: "Artist", Year: "2020"}))
+	}
+	if err := cluster.Run(2 * time.Second); err != nil {
+		return err
+	}
+
+	for _, node := range cluster.Nodes {
+		for _, album := range node.DB.GetAllAlbums() {
+			if strings.HasPrefix(album.Title, "Stranded album") {
+				return fmt.Errorf("node %d applied %q, which only node %d and the learners had",
+					node.ID, album.Title, stranded.ID)
+			}
+		}
+	}
+	leader := cluster.Leader()
+	if leader == nil || leader == stranded {
+		return fmt.Errorf("no leader was elected by the voters without node %d", stranded.ID)
+	}
+
+	cluster.Network.Heal()
+	if err := cluster.Run(time.Second); err != nil {
+		return err
+	}
+	if err := cluster.CheckConverged(); err != nil {
+		return err
+	}
+
+	leader = cluster.Leader()
+	if leader == nil {
+		return fmt.Errorf("no leader after the network was healed")
+	}
+	if _, _, err := leader.Consensus.PromoteLearner(learners[0].ID); err != nil {
+		return fmt.Errorf("promoting node %d: %v", learners[0].ID, err)
+	}
+	if err := cluster.Run(time.Second); err != nil {
+		return err
+	}
+	if learners[0].Learner() {
+		return fmt.Errorf("node %d is still a learner a second after it was promoted", learners[0].ID)
+	}
+	return cluster.CheckConverged()
+}
+
+// divergenceDelay is how many entries after the one it has applied a follower
+// is made to diverge at in the DivergenceScenario.
+const divergenceDelay = 10
+
+/*
+ * DivergenceScenario makes a follower apply an entry differently from the
+ * other nodes, as if the command weren't deterministic, while the leader keeps
+ * committing entries. The follower should find that its database differs from
+ * the leader's, and the exact index at which it started to, within a second.
+ */
+func DivergenceScenario(flags *SimFlags, cluster *SimCluster) error {
+	cluster.Start()
+	if err := cluster.Run(2 * time.Second); err != nil {
+		return err
+	}
+	leader := cluster.Leader()
+	if leader == nil {
+		return fmt.Errorf("no leader was elected")
+	}
+
+	follower := cluster.Nodes[(leader.ID+1)%len(cluster.Nodes)]
+	follower.corruptAt = follower.applied + divergenceDelay
+	for i := 0; i < 2*divergenceDelay; i++ {
+		cluster.Submit(leader, NewCommand(&AddAlbumCommand{
+			Title: "Album " + strconv.Itoa(i), Artist: "Artist", Year: "2020"}))
+	}
+	if err := cluster.Run(time.Second); err != nil {
+		return err
+	}
+
+	if follower.applied < follower.corruptAt {
+		return fmt.Errorf("node %d only applied up to index %d, not %d", follower.ID, follower.applied, follower.corruptAt)
+	}
+	divergence := follower.Checksums.Divergence()
+	if divergence == nil {
+		return fmt.Errorf("node %d didn't find that its database differs from index %d on", follower.ID, follower.corruptAt)
+	}
+	if divergence.Index != follower.corruptAt || !divergence.Exact {
+		return fmt.Errorf("node %d found that its database differs from index %d on (exact: %t), not %d",
+			follower.ID, divergence.Index, divergence.Exact, follower.corruptAt)
+	}
+	return nil
+}
+
+/*
+ * SimulateClient submits a random command to a random node every 5-50ms, as
+ * a client that doesn't know who the leader is would, as long as running is
+ * true. Some of the commands belong to a client session, and some of those are
+ * retries.
+ */
+func SimulateClient(cluster *SimCluster, running *bool) {
+	sim := cluster.Sim
+	sequence := 0
+
+	var submit func()
+	submit = func() {
+		if !*running {
+			return
+		}
+
+		var command *Command
+		switch choice := sim.Intn(100); {
+		case choice < 35:
+			command = NewCommand(&AddAlbumCommand{
+				Title: "Album " + strconv.Itoa(sim.Intn(1000)), Artist: "Artist", Year: "2020"})
+		case choice < 50:
+			command = NewCommand(&EditAlbumCommand{
+				ID: sim.Intn(20), Title: "Title " + strconv.Itoa(sim.Intn(1000))})
+		case choice < 55:
+			// A command in the original positional format, as an older build
+			// wrote them, which every node upgrades when applying it (see
+			// commands.go).
+			command = &Command{Method: "EditAlbum", Arguments: []string{
+				strconv.Itoa(sim.Intn(20)), "Old title " + strconv.Itoa(sim.Intn(1000)), "", "", ""}}
+		case choice < 70:
+			command = NewCommand(&RemoveAlbumCommand{ID: sim.Intn(20)})
+		case choice < 75:
+			command = NewCommand(&RegisterClientCommand{})
+			command.ClientID = "sim"
+		default:
+			// Either retry the last command of the session or send a new one.
+			if sequence == 0 || sim.Intn(4) != 0 {
+				sequence += 1
+			}
+			command = NewCommand(&AddAlbumCommand{
+				Title: "Session album " + strconv.Itoa(sequence), Artist: "Artist", Year: "2020"})
+			command.ClientID = "sim"
+			command.Sequence = sequence
+		}
+
+		node := cluster.Nodes[sim.Intn(len(cluster.Nodes))]
+		cluster.Submit(node, command)
+		sim.After(time.Duration(5+sim.Intn(46))*time.Millisecond, submit)
+	}
+	sim.After(0, submit)
+}
+
+/*
+ * SimulatePartitions partitions and heals the network at random every
+ * 0.2-2s, as long as faults is true. A partition splits the nodes into two or
+ * three groups, which may leave no group with a majority.
+ */
+func SimulatePartitions(cluster *SimCluster, faults *bool) {
+	sim := cluster.Sim
+	partitioned := false
+
+	var change func()
+	change = func() {
+		if !*faults {
+			return
+		}
+
+		if partitioned {
+			cluster.Network.Heal()
+			partitioned = false
+		} else if sim.Intn(2) == 0 {
+			groups := make([][]string, 2+sim.Intn(2))
+			for _, node := range cluster.Nodes {
+				i := sim.Intn(len(groups))
+				groups[i] = append(groups[i], node.Endpoint)
+			}
+			cluster.Network.Partition(groups...)
+			partitioned = true
+		}
+		sim.After(time.Duration(200+sim.Intn(1801))*time.Millisecond, change)
+	}
+	sim.After(0, change)
+}
+
+// simLogWriter represents a writer for the log package that stamps each line
+// with the virtual time of the simulation.
+type simLogWriter struct {
+	sim *Simulator
+}
+
+func (writer *simLogWriter) Write(p []byte) (int, error) {
+	fmt.Printf("%12v %s", writer.sim.Elapsed(), p)
+	return len(p), nil
+}
+
+/*
+ * RunSimulation runs the scenario with the given seed and reports the
+ * outcome. Returns false if the run failed.
+ */
+func RunSimulation(flags *SimFlags, seed int64) bool {
+	cluster := NewSimCluster(seed, flags.Nodes, flags.Learners, flags.PreVote)
+	defer cluster.Stop()
+	cluster.SnapshotEntries = flags.SnapshotEntries
+
+	if flags.Trace {
+		log.SetFlags(0)
+		log.SetOutput(&simLogWriter{sim: cluster.Sim})
+	} else {
+		log.SetOutput(io.Discard)
+	}
+
+	err := scenarios[flags.Scenario](flags, cluster)
+	if err != nil {
+		fmt.Printf("seed %d: FAILED at %v (event %d): %v\n", seed, cluster.Sim.Elapsed(), cluster.Sim.Steps, err)
+		fmt.Print(cluster.Summary())
+		fmt.Println("replay with:", ReplayCommand(flags, seed))
+		return false
+	}
+
+	fmt.Printf("seed %d: ok\n", seed)
+	if flags.Seeds == 1 {
+		fmt.Print(cluster.Summary())
+	}
+	return true
+}
+
+/*
+ * ReplayCommand returns the command line that replays the run with the given
+ * seed, with tracing on.
+ */
+func ReplayCommand(flags *SimFlags, seed int64) string {
+	args := []string{"./sim", "--seed", strconv.FormatInt(seed, 10),
+		"--nodes", strconv.Itoa(flags.Nodes),
+		"--learners", strconv.Itoa(flags.Learners),
+		"--duration", strconv.Itoa(flags.Duration),
+		"--drop", strconv.Itoa(flags.DropPercent),
+		"--snapshot-entries", strconv.Itoa(flags.SnapshotEntries),
+		"--scenario", flags.Scenario}
+	if !flags.PreVote {
+		args = append(args, "--no-pre-vote")
+	}
+	return strings.Join(append(args, "--trace"), " ")
+}
+
+// ========================= MAIN & PARSING FUNCTIONS =========================
+
+func ParseSimCommandLineArgs() *SimFlags {
+	args := os.Args
+	flags := &SimFlags{
+		Seed:            time.Now().UnixNano(),
+		Seeds:           1,
+		Nodes:           5,
+		Learners:        -1,
+		Duration:        30,
+		DropPercent:     5,
+		SnapshotEntries: 50,
+		PreVote:         true,
+		Scenario:        "random",
+	}
+	i := 1
+	for i < len(args) {
+		if args[i] == "--seed" {
+			seed, err := strconv.ParseInt(ParseValueFlag(args, i), 10, 64)
+			if err != nil {
+				fmt.Println(simUsage)
+				os.Exit(1)
+			}
+			flags.Seed = seed
+			i += 2
+		} else if args[i] == "--seeds" {
+			flags.Seeds = ParseIntFlag(args, i)
+			i += 2
+		} else if args[i] == "--nodes" {
+			flags.Nodes = ParseIntFlag(args, i)
+			i += 2
+		} else if args[i] == "--learners" {
+			flags.Learners = ParseIntFlag(args, i)
+			i += 2
+		} else if args[i] == "--duration" {
+			flags.Duration = ParseIntFlag(args, i)
+			i += 2
+		} else if args[i] == "--drop" {
+			flags.DropPercent = ParseIntFlag(args, i)
+			i += 2
+		} else if args[i] == "--snapshot-entries" {
+			flags.SnapshotEntries = ParseIntFlag(args, i)
+			i += 2
+		} else if args[i] == "--no-pre-vote" {
+			flags.PreVote = false
+			i += 1
+		} else if args[i] == "--scenario" {
+			flags.Scenario = ParseValueFlag(args, i)
+			i += 2
+		} else if args[i] == "--trace" {
+			flags.Trace = true
+			i += 1
+		} else {
+			fmt.Println(simUsage)
+			os.Exit(1)
+		}
+	}
+
+	// The learner scenario runs with two learners unless told otherwise.
+	if flags.Learners == -1 {
+		flags.Learners = 0
+		if flags.Scenario == "learner" {
+			flags.Learners = 2
+		}
+	}
+
+	if _, ok := scenarios[flags.Scenario]; !ok || flags.Nodes == 0 || flags.Seeds == 0 || flags.DropPercent > 100 ||
+		flags.Learners >= flags.Nodes {
+		fmt.Println(simUsage)
+		os.Exit(1)
+	}
+	return flags
+}
+
+func main() {
+	flags := ParseSimCommandLineArgs()
+
+	failed := 0
+	for i := 0; i < flags.Seeds; i++ {
+		if !RunSimulation(flags, flags.Seed+int64(i)) {
+			failed += 1
+		}
+	}
+
+	if flags.Seeds > 1 {
+		fmt.Printf("%d of %d runs failed\n", failed, flags.Seeds)
+	}
+	if failed > 0 {
+		os.Exit(1)
+	}
+}
@@ -0,0 +1,275 @@
+package main
+
+// The commands.go file defines the commands applied to the replicated state
+// machine (the album database). Each kind of command is a struct; a log
+// entry's Command carries the command's name, the schema version it was
+// written with and the struct encoded as JSON, whose fields are always
+// written in the same order, so every node stores the same bytes for it.
+//
+// Entries written with an older schema are brought up to date by the upgrade
+// shims in commandUpgrades when they are applied, so a log written by an older
+// build can still be replayed. A command that can't be decoded (an unknown
+// name, or a version newer than this build's) fails with ErrInvalidCommand
+// rather than being skipped, since skipping it would leave this node's
+// database different from the others'.
+
+import (
+	"bytes"
+	"encoding/json"
+	"errors"
+	"fmt"
+	"log"
+	"strconv"
+	"strings"
+)
+
+// commandVersion is the schema version of the commands this build writes.
+// Version 0 is the original format, in which a command's arguments were a
+// list of strings matched by position.
+const commandVersion = 1
+
+// ErrInvalidCommand is returned for a command this build can't decode.
+var ErrInvalidCommand = errors.New("invalid command")
+
+// StateCommand represents a typed command.
+type StateCommand interface {
+	// CommandName returns the name the command is stored under.
+	CommandName() string
+
+	// Apply applies the command to the database, and returns the error the
+	// database reports, if any.
+	Apply(db *AlbumDB) error
+}
+
+// commandTypes maps each command's name to a function returning a new,
+// empty command of its type to decode into.
+var commandTypes = map[string]func() StateCommand{
+	"AddAlbum":       func() StateCommand { return &AddAlbumCommand{} },
+	"EditAlbum":      func() StateCommand { return &EditAlbumCommand{} },
+	"RemoveAlbum":    func() StateCommand { return &RemoveAlbumCommand{} },
+	"RegisterClient": func() StateCommand { return &RegisterClientCommand{} },
+	"Configuration":  func() StateCommand { return &ConfigurationCommand{} },
+	"NoOp":           func() StateCommand { return &NoOpCommand{} },
+}
+
+// ================================= COMMANDS =================================
+
+// AddAlbumCommand adds an album, with the next free ID.
+type AddAlbumCommand struct {
+	Title  string `json:"title"`
+	Artist string `json:"artist"`
+	URL    string `json:"url"`
+	Year   string `json:"year"`
+}
+
+func (c *AddAlbumCommand) CommandName() string { return "AddAlbum" }
+
+func (c *AddAlbumCommand) Apply(db *AlbumDB) error {
+	db.AddAlbum(c.Title, c.Artist, c.URL, c.Year)
+	return nil
+}
+
+// EditAlbumCommand changes the fields of an album that are non-empty in the
+// command.
+type EditAlbumCommand struct {
+	ID     int    `json:"id"`
+	Title  string `json:"title"`
+	Artist string `json:"artist"`
+	URL    string `json:"url"`
+	Year   string `json:"year"`
+}
+
+func (c *EditAlbumCommand) CommandName() string { return "EditAlbum" }
+
+func (c *EditAlbumCommand) Apply(db *AlbumDB) error {
+	return db.EditAlbum(c.ID, c.Title, c.Artist, c.URL, c.Year)
+}
+
+// RemoveAlbumCommand removes an album.
+type RemoveAlbumCommand struct {
+	ID int `json:"id"`
+}
+
+func (c *RemoveAlbumCommand) CommandName() string { return "RemoveAlbum" }
+
+func (c *RemoveAlbumCommand) Apply(db *AlbumDB) error {
+	return db.RemoveAlbum(c.ID)
+}
+
+// RegisterClientCommand opens a session for the client whose ID the command
+// carries (see session.go). applyCommand handles it, since it needs the ID.
+type RegisterClientCommand struct{}
+
+func (c *RegisterClientCommand) CommandName() string { return "RegisterClient" }
+
+func (c *RegisterClientCommand) Apply(db *AlbumDB) error { return nil }
+
+// ConfigurationCommand holds a new cluster configuration. It's handled by the
+// consensus module (see membership.go) and doesn't touch the database.
+type ConfigurationCommand struct {
+	Members []ConfigurationMember `json:"members"` // Ordered by ID
+}
+
+// ConfigurationMember represents a member in a ConfigurationCommand.
+type ConfigurationMember struct {
+	ID       int    `json:"id"`
+	Endpoint string `json:"endpoint"`
+	Learner  bool   `json:"learner"`
+}
+
+func (c *ConfigurationCommand) CommandName() string { return "Configuration" }
+
+func (c *ConfigurationCommand) Apply(db *AlbumDB) error { return nil }
+
+// NoOpCommand is appended by a new leader so that it commits an entry from
+// its own term; it doesn't touch the database.
+type NoOpCommand struct{}
+
+func (c *NoOpCommand) CommandName() string { return "NoOp" }
+
+func (c *NoOpCommand) Apply(db *AlbumDB) error { return nil }
+
+// ================================= ENCODING =================================
+
+/*
+ * NewCommand returns a Command carrying the typed command in the current
+ * schema version. The caller fills in the session fields, if any.
+ */
+func NewCommand(typed StateCommand) *Command {
+	payload, err := json.Marshal(typed)
+	if err != nil {
+		// The command structs only hold strings, numbers and booleans.
+		log.Panicln("[commands.go] NewCommand", err)
+	}
+	return &Command{
+		Method:  typed.CommandName(),
+		Version: commandVersion,
+		Payload: payload,
+	}
+}
+
+/*
+ * Decode returns the typed command a Command carries, upgrading it from an
+ * older schema version first if needed. The error wraps ErrInvalidCommand if
+ * the command can't be decoded.
+ */
+func (cmd *Command) Decode() (StateCommand, error) {
+	upgraded, err := cmd.upgrade()
+	if err != nil {
+		return nil, err
+	}
+
+	newCommand, ok := commandTypes[upgraded.Method]
+	if !ok {
+		return nil, fmt.Errorf("%w: unknown command %q", ErrInvalidCommand, upgraded.Method)
+	}
+	typed := newCommand()
+
+	decoder := json.NewDecoder(bytes.NewReader(upgraded.Payload))
+	decoder.DisallowUnknownFields()
+	if err := decoder.Decode(typed); err != nil {
+		return nil, fmt.Errorf("%w: %s: %v", ErrInvalidCommand, upgraded.Method, err)
+	}
+	return typed, nil
+}
+
+// ============================== UPGRADE SHIMS ===============================
+
+// commandUpgrades maps a schema version to the shim that upgrades a command
+// from that version to the next. A new schema version adds a shim here that
+// converts the previous version's commands.
+var commandUpgrades = map[int]func(cmd *Command) (*Command, error){
+	0: upgradePositionalCommand,
+}
+
+/*
+ * upgrade returns the command in the current schema version, running every
+ * shim from the command's version on. The command itself is left as is.
+ */
+func (cmd *Command) upgrade() (*Command, error) {
+	if cmd.Version > commandVersion {
+		return nil, fmt.Errorf("%w: %s has schema version %d, but this build only knows up to %d",
+			ErrInvalidCommand, cmd.Method, cmd.Version, commandVersion)
+	}
+
+	for cmd.Version < commandVersion {
+		shim, ok := commandUpgrades[cmd.Version]
+		if !ok {
+			return nil, fmt.Errorf("%w: no upgrade for schema version %d", ErrInvalidCommand, cmd.Version)
+		}
+		upgraded, err := shim(cmd)
+		if err != nil {
+			return nil, fmt.Errorf("%w: upgrading %s from schema version %d: %v",
+				ErrInvalidCommand, cmd.Method, cmd.Version, err)
+		}
+		cmd = upgraded
+	}
+	return cmd, nil
+}
+
+/*
+ * upgradePositionalCommand upgrades a version 0 command, whose arguments are
+ * a list of strings, to version 1. Album IDs that aren't numbers (which the
+ * database used to reject) become -1, which no album has.
+ */
+func upgradePositionalCommand(cmd *Command) (*Command, error) {
+	args := cmd.Arguments
+	wantArgs := map[string]int{"AddAlbum": 4, "EditAlbum": 5, "RemoveAlbum": 1}
+	if want, ok := wantArgs[cmd.Method]; ok && len(args) != want {
+		return nil, fmt.Errorf("%s takes %d arguments, not %d", cmd.Method, want, len(args))
+	}
+
+	var typed StateCommand
+	switch cmd.Method {
+	case "AddAlbum":
+		typed = &AddAlbumCommand{Title: args[0], Artist: args[1], URL: args[2], Year: args[3]}
+	case "EditAlbum":
+		typed = &EditAlbumCommand{ID: positionalID(args[0]), Title: args[1], Artist: args[2], URL: args[3], Year: args[4]}
+	case "RemoveAlbum":
+		typed = &RemoveAlbumCommand{ID: positionalID(args[0])}
+	case "RegisterClient":
+		typed = &RegisterClientCommand{}
+	case "NoOp":
+		typed = &NoOpCommand{}
+	case "Configuration":
+		// Each argument is an "id=endpoint" pair, followed by " learner" for
+		// learners.
+		configuration := &ConfigurationCommand{}
+		for _, argument := range args {
+			member := ConfigurationMember{}
+			if strings.HasSuffix(argument, " learner") {
+				member.Learner = true
+				argument = strings.TrimSuffix(argument, " learner")
+			}
+			arr := strings.SplitN(argument, "=", 2)
+			id, err := strconv.Atoi(arr[0])
+			if len(arr) != 2 || err != nil {
+				return nil, fmt.Errorf("invalid configuration member %q", argument)
+			}
+			member.ID = id
+			member.Endpoint = arr[1]
+			configuration.Members = append(configuration.Members, member)
+		}
+		typed = configuration
+	default:
+		return nil, fmt.Errorf("unknown command %q", cmd.Method)
+	}
+
+	upgraded := NewCommand(typed)
+	upgraded.Version = 1
+	upgraded.ClientID = cmd.ClientID
+	upgraded.Sequence = cmd.Sequence
+	upgraded.Timestamp = cmd.Timestamp
+	return upgraded, nil
+}
+
+/*
+ * positionalID parses an album ID from a version 0 command.
+ */
+func positionalID(arg string) int {
+	id, err := strconv.Atoi(arg)
+	if err != nil {
+		return -1
+	}
+	return id
+}
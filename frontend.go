@@ -1,34 +1,83 @@
 package main
 
 import (
+	crand "crypto/rand"
 	"encoding/gob"
+	"encoding/hex"
+	"errors"
 	"fmt"
 	"log"
 	"math/rand"
 	"net"
 	"os"
 	"strconv"
+	"sync"
+	"time"
 
 	"github.com/kataras/iris/v12"
 )
 
+// maxReadStaleness is how far behind the leader the album list on the
+// homepage may be, which lets any backend serve it.
+const maxReadStaleness = 1 * time.Second
+
+// maxRedirects bounds how many times a request follows a "not the leader"
+// reply or reconnects before the frontend gives up on it.
+const maxRedirects = 5
+
+// findLeaderRounds is how many times FindLeader asks every backend for the
+// leader, waiting findLeaderRetry in between, before it gives up.
+const findLeaderRounds = 10
+const findLeaderRetry = 200 * time.Millisecond
+
+// writeRetryTimeout is how long WriteCommand keeps resending a write whose
+// outcome is unknown before it reports the failure.
+const writeRetryTimeout = 30 * time.Second
+
+// errUnreachable is reported for a request that still had no answer from the
+// leader after maxRedirects attempts.
+var errUnreachable = errors.New("couldn't reach the leader")
+
+// errNoLeader is reported when none of the backends knows of a leader.
+var errNoLeader = errors.New("no leader found")
+
 // ============================== FRONTEND SERVER ==============================
 
 // FrontendServer represents the frontend server
 type FrontendServer struct {
-	HTTPPort  string       // Port to listen to HTTP requests
-	Endpoints []string     // Endpoints to the backend servers
-	Conn      *net.TCPConn // TCP connection to backend server (leader)
+	HTTPPort  string            // Port to listen to HTTP requests
+	Endpoints []string          // Endpoints to the backend servers
+	Addresses map[string]string // Peer address of each endpoint, for admin RPCs (see cluster.go)
+	Conn      *net.TCPConn      // TCP connection to backend server (leader), nil if disconnected
+	Leader    string            // Endpoint Conn is connected to
+	ClientID  string            // The frontend's client session ("" until registered)
+	Sequence  int               // Sequence number of the last write sent in the session
+	Unsettled *DataMessage      // That write, if its outcome is still unknown (see WriteCommand)
+	mu        sync.Mutex        // A mutex to protect Conn, Leader and the session
+
+	// Metrics (see metrics.go)
+	metrics        *Registry  // Served on /metrics
+	routeLatency   *Histogram // Time to answer HTTP requests, by method, route and status code
+	backendLatency *Histogram // Round trips to the backends, by DataMessage method
 }
 
 /*
  * NewFrontendServer initializes a new frontend server.
  */
-func NewFrontendServer(httpPort string, endpoints []string) *FrontendServer {
-	return &FrontendServer{
+func NewFrontendServer(httpPort string, endpoints []string, addresses map[string]string) *FrontendServer {
+	srv := &FrontendServer{
 		HTTPPort:  httpPort,
 		Endpoints: endpoints,
+		Addresses: addresses,
+		metrics:   NewRegistry(),
+		routeLatency: NewHistogram("musicdb_frontend_http_request_duration_seconds",
+			"Time to answer an HTTP request, by method, route and status code.", latencyBuckets,
+			"method", "route", "code"),
+		backendLatency: NewHistogram("musicdb_frontend_backend_request_duration_seconds",
+			"Round trip time of a request to a backend, by DataMessage method.", latencyBuckets, "method"),
 	}
+	srv.metrics.Register(srv.routeLatency, srv.backendLatency)
+	return srv
 }
 
 /*
@@ -40,29 +89,46 @@ func (srv *FrontendServer) Start() {
 	// Initialize an Iris app.
 	app := iris.Default()
 
-	// Connect to the backend server via TCP
-	srv.ConnectToBackend(srv.PickRandom())
+	// Connect to the leader via TCP. If there is no leader yet, the frontend
+	// looks for one again on the first request.
+	if err := srv.FindLeader(); err != nil {
+		log.Println("[FrontendServer]", err)
+	}
 
 	// Register a folder for HTML templates.
 	app.RegisterView(iris.HTML("./views", ".html"))
 
+	// Every route's latency is recorded, by the route's pattern.
+	get := func(route string, handler iris.Handler) {
+		app.Get(route, srv.observeRoute("GET", route, handler))
+	}
+	post := func(route string, handler iris.Handler) {
+		app.Post(route, srv.observeRoute("POST", route, handler))
+	}
+
 	// Show the homepage of the app.
-	app.Get("/", srv.ShowHomePage)
+	get("/", srv.ShowHomePage)
 
 	// Handle the add album route.
-	app.Post("/add", srv.HandleAddAlbumRoute)
+	post("/add", srv.HandleAddAlbumRoute)
 
 	// Show the add album page.
-	app.Get("/add", srv.ShowAddPage)
+	get("/add", srv.ShowAddPage)
 
 	// Show the album page for a particular album.
-	app.Get("/album/{id:uint64}", srv.ShowAlbumPage)
+	get("/album/{id:uint64}", srv.ShowAlbumPage)
 
 	// Handle the delete album route.
-	app.Post("/delete/{id:uint64}", srv.HandleDeleteAlbumRoute)
+	post("/delete/{id:uint64}", srv.HandleDeleteAlbumRoute)
 
 	// Handle the edit album page for a particular album.
-	app.Post("/edit/{id:uint64}", srv.HandleEditAlbumRoute)
+	post("/edit/{id:uint64}", srv.HandleEditAlbumRoute)
+
+	// Show the status of every backend.
+	get("/cluster", srv.ShowClusterPage)
+
+	// Export metrics to Prometheus.
+	app.Get("/metrics", srv.ShowMetrics)
 
 	// Set Iris to listen on a specified port.
 	app.Listen(srv.HTTPPort)
@@ -71,6 +137,27 @@ func (srv *FrontendServer) Start() {
 
 // ================================ GET ROUTES ================================
 
+/*
+ * observeRoute wraps a route's handler to record how long it takes to answer
+ * each request.
+ */
+func (srv *FrontendServer) observeRoute(method, route string, handler iris.Handler) iris.Handler {
+	return func(ctx iris.Context) {
+		start := time.Now()
+		handler(ctx)
+		srv.routeLatency.Observe(time.Since(start).Seconds(), method, route, strconv.Itoa(ctx.GetStatusCode()))
+	}
+}
+
+/*
+ * ShowMetrics handles a GET request for the "/metrics" route, which
+ * Prometheus scrapes.
+ */
+func (srv *FrontendServer) ShowMetrics(ctx iris.Context) {
+	ctx.ContentType(metricsContentType)
+	srv.metrics.Write(ctx)
+}
+
 /*
  * ShowHomePage handles a GET request for the "/" route. This page is shown
  * when the user first starts up the application.
@@ -87,19 +174,78 @@ func (srv *FrontendServer) ShowHomePage(ctx iris.Context) {
 }
 
 /*
- * GetAllAlbums returns all the albums in the key-value store
+ * GetAllAlbums returns all the albums in the key-value store. The list may be
+ * up to maxReadStaleness behind the leader, so that any backend can serve it.
  */
 func (srv *FrontendServer) GetAllAlbums() []*Album {
 	request := &DataMessage{
-		Method: "GetAllAlbums",
+		Method:       "GetAllAlbums",
+		ReadLevel:    READ_BOUNDED,
+		MaxStaleness: maxReadStaleness,
 	}
 
-	srv.WriteMessage(request)
-	response := srv.ReadMessage()
+	response := srv.ReadFromAny(request)
 
 	return response.AlbumArray
 }
 
+/*
+ * ShowClusterPage handles a GET request for the "/cluster" route. This page
+ * shows the Raft state of every backend in a single table.
+ *
+ * It sets the view to "cluster.html".
+ */
+func (srv *FrontendServer) ShowClusterPage(ctx iris.Context) {
+	log.Println("GET:		/cluster")
+
+	ctx.View("cluster.html", iris.Map{
+		"Nodes": srv.GetClusterStatus(),
+	})
+}
+
+// ClusterNode represents a row of the cluster page: a backend's status, or
+// why it couldn't be fetched.
+type ClusterNode struct {
+	Endpoint string     // The backend's client endpoint
+	Status   NodeStatus // The backend's reply to Admin.Status
+	Error    string     // Why the backend didn't reply ("" if it did)
+}
+
+/*
+ * GetClusterStatus asks every backend for its status, all at once, and
+ * returns the replies in the order of srv.Endpoints. A backend that is down
+ * costs at most statusTimeout.
+ */
+func (srv *FrontendServer) GetClusterStatus() []ClusterNode {
+	nodes := make([]ClusterNode, len(srv.Endpoints))
+
+	var wg sync.WaitGroup
+	for i, endpoint := range srv.Endpoints {
+		address, ok := srv.Addresses[endpoint]
+		if !ok {
+			var err error
+			address, err = PeerEndpoint(endpoint)
+			if err != nil {
+				nodes[i] = ClusterNode{Endpoint: endpoint, Error: err.Error()}
+				continue
+			}
+		}
+
+		wg.Add(1)
+		go func(i int, endpoint, address string) {
+			defer wg.Done()
+			status, err := FetchNodeStatus(address)
+			nodes[i] = ClusterNode{Endpoint: endpoint, Status: status}
+			if err != nil {
+				nodes[i].Error = err.Error()
+			}
+		}(i, endpoint, address)
+	}
+	wg.Wait()
+
+	return nodes
+}
+
 /*
  * ShowAlbumPage handles a GET request for the "/album/{id}" route. This page
  * is shown when the user requests to view a specific album.
@@ -117,6 +263,10 @@ func (srv *FrontendServer) ShowAlbumPage(ctx iris.Context) {
 		Index:  albumIDString,
 	}
 	response := srv.WriteAndReadMessage(request)
+	if !response.Status {
+		srv.ShowError(ctx, iris.StatusNotFound, response)
+		return
+	}
 	album := response.AlbumArray[0]
 
 	// Set the HTML elements equal to the values in the album struct.
@@ -171,9 +321,10 @@ func (srv *FrontendServer) HandleAddAlbumRoute(ctx iris.Context) {
 		AlbumArray: []*Album{album},
 	}
 
-	response := srv.WriteAndReadMessage(request)
+	response := srv.WriteCommand(request)
 	if !response.Status {
-		os.Exit(1)
+		srv.ShowError(ctx, iris.StatusServiceUnavailable, response)
+		return
 	}
 
 	// Return to the homepage.
@@ -197,9 +348,10 @@ func (srv *FrontendServer) HandleDeleteAlbumRoute(ctx iris.Context) {
 		Index:  albumIDString,
 	}
 
-	response := srv.WriteAndReadMessage(request)
+	response := srv.WriteCommand(request)
 	if !response.Status {
-		log.Fatal("HandleDeleteAlbum")
+		srv.ShowError(ctx, iris.StatusServiceUnavailable, response)
+		return
 	}
 
 	ctx.Redirect("/")
@@ -236,57 +388,298 @@ func (srv *FrontendServer) HandleEditAlbumRoute(ctx iris.Context) {
 		Index:      albumIDString,
 		AlbumArray: []*Album{album},
 	}
-	response := srv.WriteAndReadMessage(request)
+	response := srv.WriteCommand(request)
 	if !response.Status {
-		log.Fatalln("Error editing album")
+		srv.ShowError(ctx, iris.StatusServiceUnavailable, response)
+		return
 	}
 
 	// Return to the homepage.
 	ctx.Redirect("/")
 }
 
+/*
+ * ShowError responds with the given status code and the reason the backend
+ * gave for failing the request.
+ */
+func (srv *FrontendServer) ShowError(ctx iris.Context, statusCode int, response *DataMessage) {
+	log.Println("[FrontendServer] request failed:", response.Error)
+
+	ctx.StatusCode(statusCode)
+	ctx.WriteString("Request failed: " + response.Error)
+}
+
 // ============================ READ/WRITE MESSAGES ===========================
 
 /*
  * ReadMessage receives a message from the backend server by decoding the bytes
  * sent over a TCP connection.
  */
-func (srv *FrontendServer) ReadMessage() *DataMessage {
+func (srv *FrontendServer) ReadMessage() (*DataMessage, error) {
 	msg := &DataMessage{}
 
 	decoder := gob.NewDecoder(srv.Conn)
 	if err := decoder.Decode(msg); err != nil {
-		panic(err)
+		return nil, err
 	}
 
 	fmt.Println("[FrontendServer] received", msg)
-	return msg
+	return msg, nil
 }
 
 /*
  * WriteMessage sends a message to the backend server by encoding a DataMessage
  * struct into bytes and sending it over a TCP connection.
  */
-func (srv *FrontendServer) WriteMessage(msg *DataMessage) {
+func (srv *FrontendServer) WriteMessage(msg *DataMessage) error {
 	log.Println("[FrontendServer] sending", msg)
 
 	encoder := gob.NewEncoder(srv.Conn)
-	if err := encoder.Encode(msg); err != nil {
-		panic(err)
-	}
+	return encoder.Encode(msg)
 }
 
 // ====================== FRONTEND/BACKEND COMMUNICATION ======================
 
 /*
  * WriteAndReadMessage is a wrapper function to send a request to and recieve a
- * response from the backend server.
+ * response from the leader.
+ *
+ * A backend that isn't the leader names the leader in its reply, and the
+ * request is sent there instead. If the connection breaks (e.g. the leader
+ * crashed), the backend doesn't know the leader (e.g. an election is in
+ * progress), or the leader can't tell whether a write was applied (e.g. it
+ * lost its leadership while replicating it), the frontend looks for the
+ * leader again and resends the request.
  */
 func (srv *FrontendServer) WriteAndReadMessage(request *DataMessage) *DataMessage {
-	srv.WriteMessage(request)
+	srv.mu.Lock()
+	defer srv.mu.Unlock()
+
+	return srv.sendToLeader(request)
+}
+
+/*
+ * sendToLeader does the work of WriteAndReadMessage; the caller must hold the
+ * lock.
+ */
+func (srv *FrontendServer) sendToLeader(request *DataMessage) *DataMessage {
+	for attempt := 0; attempt < maxRedirects; attempt++ {
+		if srv.Conn == nil {
+			if err := srv.FindLeader(); err != nil {
+				return &DataMessage{Status: false, Error: err.Error()}
+			}
+		}
+
+		response, err := srv.exchange(request)
+		if err != nil {
+			log.Println("[FrontendServer] lost connection to", srv.Leader, err)
+			srv.Disconnect()
+			continue
+		}
+
+		// The leader may have changed while the write was being
+		// replicated; the new one tells us whether it was applied.
+		if outcomeUnknown(response) {
+			log.Println("[FrontendServer] outcome unknown, resending:", response.Error)
+			srv.Disconnect()
+			continue
+		}
+
+		if !response.Status && response.Error == ErrNotLeader.Error() {
+			srv.Disconnect()
+			if response.Leader != "" {
+				log.Println("[FrontendServer] redirected to", response.Leader)
+				srv.ConnectToBackend(response.Leader)
+			} else {
+				time.Sleep(findLeaderRetry)
+			}
+			continue
+		}
+
+		return response
+	}
+
+	return &DataMessage{Status: false, Error: errUnreachable.Error()}
+}
+
+/*
+ * outcomeUnknown returns true if the response says that a write may or may
+ * not have been applied: the leader lost track of it, or the frontend couldn't
+ * get an answer at all.
+ */
+func outcomeUnknown(response *DataMessage) bool {
+	if response.Status {
+		return false
+	}
+	switch response.Error {
+	case ErrCommitTimeout.Error(), ErrNotCommitted.Error(), ErrReplacedBySnapshot.Error(),
+		errUnreachable.Error(), errNoLeader.Error():
+		return true
+	}
+	return false
+}
+
+/*
+ * WriteCommand sends a write to the leader as part of the frontend's client
+ * session, so that resending it (after a redirect or a lost connection) can't
+ * apply it twice. A session is registered before the first write, and again
+ * if the session expired.
+ *
+ * A write whose outcome is unknown is resent, with the same sequence number,
+ * until the leader says whether it was applied; only then does the session
+ * move on to the next sequence number. If that takes longer than
+ * writeRetryTimeout, the failure is reported, and the write is settled before
+ * the next one is sent, since the session only remembers the latest write.
+ */
+func (srv *FrontendServer) WriteCommand(request *DataMessage) *DataMessage {
+	srv.mu.Lock()
+	defer srv.mu.Unlock()
+
+	if srv.Unsettled != nil {
+		if response := srv.settle(srv.Unsettled); outcomeUnknown(response) {
+			return response
+		}
+	}
+
+	response := srv.sendCommand(request)
+	if !response.Status && response.Error == ErrSessionExpired.Error() {
+		// A command in an expired session is never applied, so it's safe to
+		// send it again in a new session.
+		log.Println("[FrontendServer] session expired, registering again")
+		srv.ClientID = ""
+		response = srv.sendCommand(request)
+	}
+	return response
+}
+
+/*
+ * sendCommand numbers a write within the session, registering one first if
+ * there is none, and sends it to the leader; the caller must hold the lock.
+ */
+func (srv *FrontendServer) sendCommand(request *DataMessage) *DataMessage {
+	if srv.ClientID == "" {
+		if err := srv.registerClient(); err != nil {
+			return &DataMessage{Status: false, Error: err.Error()}
+		}
+	}
+
+	srv.Sequence += 1
+	request.ClientID = srv.ClientID
+	request.Sequence = srv.Sequence
+	return srv.settle(request)
+}
+
+/*
+ * settle sends a numbered write to the leader, and resends it as it is until
+ * its outcome is known or writeRetryTimeout has passed, in which case it is
+ * left in Unsettled; the caller must hold the lock.
+ */
+func (srv *FrontendServer) settle(request *DataMessage) *DataMessage {
+	deadline := time.Now().Add(writeRetryTimeout)
+	for {
+		response := srv.sendToLeader(request)
+		if !outcomeUnknown(response) {
+			srv.Unsettled = nil
+			return response
+		}
+		if time.Now().After(deadline) {
+			srv.Unsettled = request
+			return response
+		}
+
+		log.Printf("[FrontendServer] outcome of write %d unknown, resending: %s", request.Sequence, response.Error)
+		time.Sleep(findLeaderRetry)
+	}
+}
+
+/*
+ * registerClient opens a new client session with a random ID; the caller must
+ * hold the lock.
+ */
+func (srv *FrontendServer) registerClient() error {
+	id := make([]byte, 16)
+	if _, err := crand.Read(id); err != nil {
+		return err
+	}
+
+	response := srv.sendToLeader(&DataMessage{
+		Method:   "RegisterClient",
+		ClientID: hex.EncodeToString(id),
+	})
+	if !response.Status {
+		return errors.New("couldn't register a session: " + response.Error)
+	}
+
+	srv.ClientID = response.ClientID
+	srv.Sequence = 0
+	log.Println("[FrontendServer] registered session", srv.ClientID)
+	return nil
+}
+
+/*
+ * exchange sends a request over the connection to the leader and reads the
+ * response.
+ */
+func (srv *FrontendServer) exchange(request *DataMessage) (*DataMessage, error) {
+	start := time.Now()
+	defer func() { srv.backendLatency.Observe(time.Since(start).Seconds(), request.Method) }()
+
+	if err := srv.WriteMessage(request); err != nil {
+		return nil, err
+	}
 	return srv.ReadMessage()
 }
 
+/*
+ * ReadFromAny sends a read to a random backend, so that reads are spread
+ * across the cluster. A backend that is too far behind names the leader, and
+ * the read is retried there; if that fails too, the read goes to the backend
+ * the frontend is connected to.
+ */
+func (srv *FrontendServer) ReadFromAny(request *DataMessage) *DataMessage {
+	response, err := srv.exchangeWith(srv.PickRandom(), request)
+	if err == nil && !response.Status && response.Leader != "" {
+		response, err = srv.exchangeWith(response.Leader, request)
+	}
+	if err != nil || !response.Status {
+		return srv.WriteAndReadMessage(request)
+	}
+	return response
+}
+
+/*
+ * exchangeWith sends a single request to the backend at the given endpoint,
+ * like ExchangeMessage, and records how long it took.
+ */
+func (srv *FrontendServer) exchangeWith(endpoint string, request *DataMessage) (*DataMessage, error) {
+	start := time.Now()
+	defer func() { srv.backendLatency.Observe(time.Since(start).Seconds(), request.Method) }()
+
+	return ExchangeMessage(endpoint, request)
+}
+
+/*
+ * ExchangeMessage sends a single request to the backend at the given endpoint
+ * over a new TCP connection and returns its response.
+ */
+func ExchangeMessage(endpoint string, request *DataMessage) (*DataMessage, error) {
+	conn, err := net.Dial("tcp", endpoint)
+	if err != nil {
+		return nil, err
+	}
+	defer conn.Close()
+
+	if err := gob.NewEncoder(conn).Encode(request); err != nil {
+		return nil, err
+	}
+
+	response := &DataMessage{}
+	if err := gob.NewDecoder(conn).Decode(response); err != nil {
+		return nil, err
+	}
+	return response, nil
+}
+
 func (srv *FrontendServer) PickRandom() string {
 	return srv.Endpoints[rand.Intn(len(srv.Endpoints))]
 }
@@ -295,45 +688,98 @@ func (srv *FrontendServer) PickRandom() string {
  * ConnectToBackend connects the frontend server to the backend server by
  * dialing a TCP connection.
  */
-func (srv *FrontendServer) ConnectToBackend(address string) {
+func (srv *FrontendServer) ConnectToBackend(address string) error {
 	tcp, err := net.ResolveTCPAddr("tcp", address)
 	if err != nil {
-		fmt.Println(err)
-		os.Exit(1)
+		return err
 	}
 
 	conn, err := net.DialTCP("tcp", nil, tcp)
 	if err != nil {
-		fmt.Println(err)
-		os.Exit(1)
-
+		return err
 	}
 
 	srv.Conn = conn
+	srv.Leader = address
+	return nil
 }
 
-func (srv *FrontendServer) AskForLeader() {
-
+/*
+ * Disconnect closes the connection to the backend server, if any.
+ */
+func (srv *FrontendServer) Disconnect() {
+	if srv.Conn != nil {
+		srv.Conn.Close()
+	}
+	srv.Conn = nil
+	srv.Leader = ""
 }
 
-func (srv *FrontendServer) FindLeader() {
-	// Pick a random backend to connect to.
-	curr := srv.PickRandom()
+/*
+ * AskForLeader asks the backend at the given endpoint which node it thinks is
+ * the leader, and returns the leader's endpoint ("" if it doesn't know).
+ */
+func (srv *FrontendServer) AskForLeader(endpoint string) (string, error) {
+	conn, err := net.Dial("tcp", endpoint)
+	if err != nil {
+		return "", err
+	}
+	defer conn.Close()
 
-	//
-	srv.ConnectToBackend(curr)
+	if err := gob.NewEncoder(conn).Encode(&DataMessage{Method: "GetLeader"}); err != nil {
+		return "", err
+	}
 
+	response := &NodeMessage{}
+	if err := gob.NewDecoder(conn).Decode(response); err != nil {
+		return "", err
+	}
+	return response.Endpoint, nil
+}
+
+/*
+ * FindLeader connects to the leader. It asks the backends, starting from a
+ * random one, who the leader is until one of them knows, and retries a few
+ * times in case an election is in progress.
+ */
+func (srv *FrontendServer) FindLeader() error {
+	for round := 0; round < findLeaderRounds; round++ {
+		start := rand.Intn(len(srv.Endpoints))
+		for i := range srv.Endpoints {
+			endpoint := srv.Endpoints[(start+i)%len(srv.Endpoints)]
+
+			leader, err := srv.AskForLeader(endpoint)
+			if err != nil || leader == "" {
+				continue
+			}
+			if err := srv.ConnectToBackend(leader); err == nil {
+				log.Println("[FrontendServer] connected to the leader at", leader)
+				return nil
+			}
+		}
+		time.Sleep(findLeaderRetry)
+	}
+
+	return errNoLeader
 }
 
 // ========================= MAIN & PARSING FUNCTIONS =========================
 
+// frontendUsage describes how to invoke the frontend.
+const frontendUsage = `usage:
+    ./frontend [--listen <port>] [--backend <host:port>,... | --config <cluster.toml>]`
+
 /*
  * ParseFrontendCommandLineArgs parses the command line flags used to invoike
- * the program and returns the HTTP port and the TCP endpoints.
+ * the program and returns the HTTP port and the TCP endpoints, which come
+ * from --backend or from the client addresses in a cluster configuration file,
+ * and the peer address of each endpoint if a configuration file was given.
  */
-func ParseFrontendCommandLineArgs() (string, []string) {
+func ParseFrontendCommandLineArgs() (string, []string, map[string]string) {
 	args := os.Args
 	endPoints := []string{}
+	configFile := ""
+	addresses := map[string]string{}
 	httpPort := ":8080"
 	i := 1
 	for i < len(args) {
@@ -343,17 +789,36 @@ func ParseFrontendCommandLineArgs() (string, []string) {
 		} else if args[i] == "--backend" {
 			endPoints = ParseBackendEndpointsFlag(args, i)
 			i += 2
+		} else if args[i] == "--config" {
+			configFile = ParseValueFlag(args, i)
+			i += 2
 		} else {
-			fmt.Println("Incorrect usage")
+			fmt.Println("unknown flag " + args[i])
+			fmt.Println(frontendUsage)
+			os.Exit(1)
+		}
+	}
+
+	if configFile != "" {
+		if len(endPoints) > 0 {
+			fmt.Println("--config can't be combined with --backend")
+			fmt.Println(frontendUsage)
+			os.Exit(1)
+		}
+		cluster, err := LoadClusterConfig(configFile)
+		if err != nil {
+			fmt.Println(err)
 			os.Exit(1)
 		}
+		endPoints = cluster.ClientEndpoints()
+		addresses = cluster.PeerAddresses()
 	}
-	return httpPort, endPoints
+	return httpPort, endPoints, addresses
 }
 
 func main() {
-	httpPort, endpoints := ParseFrontendCommandLineArgs()
+	httpPort, endpoints, addresses := ParseFrontendCommandLineArgs()
 
-	srv := NewFrontendServer(httpPort, endpoints)
+	srv := NewFrontendServer(httpPort, endpoints, addresses)
 	srv.Start()
 }
@@ -0,0 +1,480 @@
+package main
+
+// The linearizability.go file checks whether a history of client operations on
+// the album store is linearizable: whether every operation can be given a
+// single point in time, between when it was sent and when its answer came
+// back, such that applying the operations one at a time in that order to an
+// AlbumDB gives every operation the answer it actually got.
+//
+// The search follows Porcupine, which implements the algorithm of Wing and
+// Gong with the improvements from Gavin Lowe's "Testing for Linearizability":
+// operations are linearized in the order of a list of call and return events,
+// and the search backtracks when it reaches the return of an operation it
+// couldn't place. Pairs of (operations placed so far, resulting state) that
+// were already tried are remembered, so that they aren't explored twice.
+
+import (
+	"bytes"
+	"encoding/binary"
+	"fmt"
+	"hash/fnv"
+	"sort"
+	"strconv"
+	"strings"
+	"time"
+)
+
+// ================================== HISTORY =================================
+
+// LinOperation represents an operation in a client history: what the client
+// asked for, what it got back, and when it sent the request and got the
+// answer. An operation whose outcome the client never learned is pending; it
+// may have taken effect at any time after its call, or never.
+type LinOperation struct {
+	Client  int       // The client that sent the operation
+	Method  string    // GetAlbum, AddAlbum, EditAlbum or DeleteAlbum
+	ID      int       // The album the operation is about (unused for AddAlbum)
+	Album   Album     // The album added, the fields edited, or the album read
+	Found   bool      // Whether the album existed (for all but AddAlbum)
+	Pending bool      // The outcome is unknown
+	Call    time.Time // When the request was sent
+	Return  time.Time // When the answer came back (unset if pending)
+}
+
+/*
+ * String describes the operation and its outcome.
+ */
+func (op *LinOperation) String() string {
+	var call, outcome string
+	switch op.Method {
+	case "GetAlbum":
+		call = fmt.Sprintf("GetAlbum(%d)", op.ID)
+		outcome = "missing"
+		if op.Found {
+			outcome = strconv.Quote(op.Album.Title)
+		}
+	case "AddAlbum":
+		call = fmt.Sprintf("AddAlbum(%q)", op.Album.Title)
+		outcome = "ok"
+	case "EditAlbum":
+		call = fmt.Sprintf("EditAlbum(%d, %q)", op.ID, op.Album.Title)
+		outcome = "missing"
+		if op.Found {
+			outcome = "ok"
+		}
+	case "DeleteAlbum":
+		call = fmt.Sprintf("DeleteAlbum(%d)", op.ID)
+		outcome = "missing"
+		if op.Found {
+			outcome = "ok"
+		}
+	}
+
+	if op.Pending {
+		outcome = "?"
+	}
+	return call + " -> " + outcome
+}
+
+// ============================== SEQUENTIAL MODEL ============================
+
+// albumModel represents the state of an AlbumDB as far as clients can observe
+// it. Steps never modify a state; they return a new one.
+type albumModel struct {
+	albums map[int]Album
+	nextID int
+}
+
+/*
+ * newAlbumModel returns the state of a new AlbumDB.
+ */
+func newAlbumModel() albumModel {
+	db := NewAlbumDB()
+	model := albumModel{albums: make(map[int]Album), nextID: db.CurrID}
+	for id, album := range db.Data {
+		model.albums[id] = *album
+	}
+	return model
+}
+
+/*
+ * with returns a copy of the state in which album id is set to album (or
+ * removed if album is nil).
+ */
+func (model albumModel) with(id int, album *Album) albumModel {
+	albums := make(map[int]Album, len(model.albums)+1)
+	for i, a := range model.albums {
+		albums[i] = a
+	}
+	if album == nil {
+		delete(albums, id)
+	} else {
+		albums[id] = *album
+	}
+	return albumModel{albums: albums, nextID: model.nextID}
+}
+
+/*
+ * step applies an operation to the state, like AlbumDB would. Returns false
+ * if the operation couldn't have gotten the answer it got in this state.
+ * Pending operations take effect whatever the answer would have been.
+ */
+func (model albumModel) step(op *LinOperation) (bool, albumModel) {
+	current, found := model.albums[op.ID]
+	if op.Method != "AddAlbum" && !op.Pending && found != op.Found {
+		return false, model
+	}
+
+	switch op.Method {
+	case "GetAlbum":
+		return !found || current == op.Album, model
+
+	case "AddAlbum":
+		album := op.Album
+		album.Id = strconv.Itoa(model.nextID)
+		next := model.with(model.nextID, &album)
+		next.nextID += 1
+		return true, next
+
+	case "EditAlbum":
+		if !found {
+			return true, model
+		}
+		if op.Album.Title != "" {
+			current.Title = op.Album.Title
+		}
+		if op.Album.Artist != "" {
+			current.Artist = op.Album.Artist
+		}
+		if op.Album.URL != "" {
+			current.URL = op.Album.URL
+		}
+		if op.Album.Year != "" {
+			current.Year = op.Album.Year
+		}
+		return true, model.with(op.ID, &current)
+
+	case "DeleteAlbum":
+		if !found {
+			return true, model
+		}
+		return true, model.with(op.ID, nil)
+	}
+	return false, model
+}
+
+/*
+ * key returns a string that identifies the state: a 128-bit hash of its
+ * contents.
+ */
+func (model albumModel) key() string {
+	ids := make([]int, 0, len(model.albums))
+	for id := range model.albums {
+		ids = append(ids, id)
+	}
+	sort.Ints(ids)
+
+	hash := fnv.New128a()
+	fmt.Fprintf(hash, "%d;", model.nextID)
+	for _, id := range ids {
+		fmt.Fprintf(hash, "%d=%+v;", id, model.albums[id])
+	}
+	return string(hash.Sum(nil))
+}
+
+// ================================== CHECKER =================================
+
+// linEvent represents the call or the return of an operation, in a doubly
+// linked list of events ordered by time.
+type linEvent struct {
+	op    int       // Index of the operation in the history
+	call  bool      // A call (otherwise a return)
+	match *linEvent // For a call, the operation's return
+	at    time.Time
+	prev  *linEvent
+	next  *linEvent
+}
+
+/*
+ * lift removes a call and its return from the list.
+ */
+func (event *linEvent) lift() {
+	event.prev.next = event.next
+	event.next.prev = event.prev
+	match := event.match
+	match.prev.next = match.next
+	if match.next != nil {
+		match.next.prev = match.prev
+	}
+}
+
+/*
+ * unlift puts back a call and its return that were removed by lift.
+ */
+func (event *linEvent) unlift() {
+	match := event.match
+	match.prev.next = match
+	if match.next != nil {
+		match.next.prev = match
+	}
+	event.prev.next = event
+	event.next.prev = event
+}
+
+// linBitset represents a set of operations, by index.
+type linBitset []uint64
+
+func (set linBitset) set(i int)   { set[i/64] |= 1 << uint(i%64) }
+func (set linBitset) clear(i int) { set[i/64] &^= 1 << uint(i%64) }
+
+func (set linBitset) key() string {
+	buffer := make([]byte, 8*len(set))
+	for i, word := range set {
+		binary.LittleEndian.PutUint64(buffer[8*i:], word)
+	}
+	return string(buffer)
+}
+
+// LinResult represents the outcome of a linearizability check. If the history
+// isn't linearizable, it describes the furthest the search got: the longest
+// sequence of operations it managed to linearize, and the operation that
+// couldn't be placed after it.
+type LinResult struct {
+	Linearizable bool
+	Order        []int      // The longest linearization found, as operation indices
+	Failed       int        // The operation that couldn't be linearized next (-1 if none)
+	State        albumModel // The state after Order
+}
+
+/*
+ * CheckLinearizability checks a history against the sequential model of the
+ * album store.
+ */
+func CheckLinearizability(history []LinOperation) *LinResult {
+	// Pending operations never return, so their returns go last.
+	never := time.Unix(1<<40, 0)
+
+	events := make([]*linEvent, 0, 2*len(history))
+	completed := 0
+	for i := range history {
+		op := &history[i]
+		returned := op.Return
+		if op.Pending {
+			returned = never
+		} else {
+			completed += 1
+		}
+		ret := &linEvent{op: i, at: returned}
+		events = append(events, &linEvent{op: i, call: true, match: ret, at: op.Call}, ret)
+	}
+
+	// A call and a return at the same time are taken as overlapping.
+	sort.SliceStable(events, func(i, j int) bool {
+		if !events[i].at.Equal(events[j].at) {
+			return events[i].at.Before(events[j].at)
+		}
+		return events[i].call && !events[j].call
+	})
+
+	head := &linEvent{op: -1}
+	last := head
+	for _, event := range events {
+		event.prev = last
+		last.next = event
+		last = event
+	}
+
+	type frame struct {
+		event *linEvent
+		state albumModel
+	}
+
+	state := newAlbumModel()
+	linearized := make(linBitset, len(history)/64+1)
+	seen := make(map[string]bool)
+	stack := []frame{}
+	result := &LinResult{Failed: -1, State: state}
+
+	event := head.next
+	for completed > 0 {
+		if event.call {
+			op := &history[event.op]
+			ok, next := state.step(op)
+			if ok {
+				linearized.set(event.op)
+				key := linearized.key() + next.key()
+				if !seen[key] {
+					seen[key] = true
+					stack = append(stack, frame{event: event, state: state})
+					state = next
+					if !op.Pending {
+						completed -= 1
+					}
+					event.lift()
+					event = head.next
+					continue
+				}
+				linearized.clear(event.op)
+			}
+			event = event.next
+			continue
+		}
+
+		// The operation returning here wasn't linearized, and no operation
+		// called after this point can go before it: undo the latest choice.
+		if len(stack) >= len(result.Order) {
+			result.Order = result.Order[:0]
+			for _, f := range stack {
+				result.Order = append(result.Order, f.event.op)
+			}
+			result.Failed = event.op
+			result.State = state
+		}
+		if len(stack) == 0 {
+			return result
+		}
+
+		top := stack[len(stack)-1]
+		stack = stack[:len(stack)-1]
+		state = top.state
+		linearized.clear(top.event.op)
+		if !history[top.event.op].Pending {
+			completed += 1
+		}
+		top.event.unlift()
+		event = top.event.next
+	}
+
+	result.Linearizable = true
+	result.Failed = -1
+	result.Order = result.Order[:0]
+	for _, f := range stack {
+		result.Order = append(result.Order, f.event.op)
+	}
+	result.State = state
+	return result
+}
+
+// =================================== REPORT =================================
+
+// linReportWidth is the width of the timeline in a report, in characters.
+const linReportWidth = 60
+
+// linReportContext is how many of the operations that completed just before
+// the failed one are shown along with those that overlap it.
+const linReportContext = 6
+
+/*
+ * Report describes why a history isn't linearizable: the operation that
+ * couldn't be linearized, what the album it reads or writes looked like at
+ * that point of the longest linearization, and a timeline of the operations
+ * around it. start is the time the history is measured from.
+ */
+func (result *LinResult) Report(history []LinOperation, start time.Time) string {
+	if result.Linearizable {
+		return "history is linearizable\n"
+	}
+
+	failed := &history[result.Failed]
+	var buffer bytes.Buffer
+	fmt.Fprintf(&buffer, "history is NOT linearizable\n\n")
+	fmt.Fprintf(&buffer, "The longest linearization places %d of %d operations; after it, no order works\n",
+		len(result.Order), len(history))
+	fmt.Fprintf(&buffer, "for client %d's %s (%v to %v).\n", failed.Client, failed,
+		failed.Call.Sub(start).Round(time.Microsecond), failed.Return.Sub(start).Round(time.Microsecond))
+	if failed.Method != "AddAlbum" {
+		if album, ok := result.State.albums[failed.ID]; ok {
+			fmt.Fprintf(&buffer, "At that point album %d is %q.\n", failed.ID, album.Title)
+		} else {
+			fmt.Fprintf(&buffer, "At that point album %d doesn't exist.\n", failed.ID)
+		}
+	}
+
+	// The sub-history: the operations that overlap the failed one, and the
+	// ones that completed just before it.
+	window := []int{}
+	before := []int{}
+	for i := range history {
+		op := &history[i]
+		returned := op.Return
+		if op.Pending {
+			returned = failed.Return
+		}
+		if !op.Call.After(failed.Return) && !returned.Before(failed.Call) {
+			window = append(window, i)
+		} else if returned.Before(failed.Call) {
+			before = append(before, i)
+		}
+	}
+	sort.Slice(before, func(a, b int) bool { return history[before[a]].Return.Before(history[before[b]].Return) })
+	if len(before) > linReportContext {
+		before = before[len(before)-linReportContext:]
+	}
+	window = append(window, before...)
+	sort.Slice(window, func(a, b int) bool { return history[window[a]].Call.Before(history[window[b]].Call) })
+
+	from, to := failed.Call, failed.Return
+	for _, i := range window {
+		if history[i].Call.Before(from) {
+			from = history[i].Call
+		}
+		if !history[i].Pending && history[i].Return.After(to) {
+			to = history[i].Return
+		}
+	}
+	span := to.Sub(from)
+	if span <= 0 {
+		span = 1
+	}
+	column := func(t time.Time) int {
+		return int(int64(t.Sub(from)) * (linReportWidth - 1) / int64(span))
+	}
+
+	position := make(map[int]int)
+	for n, i := range result.Order {
+		position[i] = n + 1
+	}
+
+	fmt.Fprintf(&buffer, "\nOperations around it, numbered by their place in the longest linearization:\n\n")
+	indent := len(fmt.Sprintf("%3s client %-2d %-33.33s |", "", 0, ""))
+	fromLabel := from.Sub(start).Round(time.Microsecond).String()
+	toLabel := to.Sub(start).Round(time.Microsecond).String()
+	padding := linReportWidth - len(fromLabel) - len(toLabel)
+	if padding < 1 {
+		padding = 1
+	}
+	fmt.Fprintf(&buffer, "%*s%s%s%s\n", indent, "", fromLabel, strings.Repeat(" ", padding), toLabel)
+	for _, i := range window {
+		op := &history[i]
+		bar := []byte(strings.Repeat(" ", linReportWidth))
+		first := column(op.Call)
+		last := linReportWidth - 1
+		if !op.Pending {
+			last = column(op.Return)
+		}
+		for c := first; c <= last; c++ {
+			bar[c] = '='
+		}
+		if op.Pending {
+			bar[last] = '>'
+		} else {
+			bar[last] = ']'
+		}
+		if first < last {
+			bar[first] = '['
+		} else if !op.Pending {
+			bar[first] = '|'
+		}
+
+		order := "   "
+		if n, ok := position[i]; ok {
+			order = fmt.Sprintf("%3d", n)
+		}
+		mark := ""
+		if i == result.Failed {
+			mark = " <- not linearizable"
+		}
+		fmt.Fprintf(&buffer, "%s client %-2d %-33.33s |%s|%s\n", order, op.Client, op.String(), bar, mark)
+	}
+	return buffer.String()
+}
@@ -1,13 +1,29 @@
 package main
 
-import "fmt"
+import (
+	"errors"
+	"fmt"
+	"sort"
+	"strconv"
+	"strings"
+)
 
 // ================================ COMMAND LOG ===============================
 
-// Command represents a command to be executed to our in-memory database.
+// Command represents a command to be executed to our in-memory database: the
+// name of a typed command and the command itself, encoded in the given schema
+// version (see commands.go). Commands sent by a client session carry the
+// client's ID and the command's sequence number (see session.go); commands
+// submitted for clients carry the leader's time, which is what sessions
+// expire by.
 type Command struct {
 	Method    string
-	Arguments []string
+	Version   int      // Schema version of Payload (0 for commands with Arguments instead)
+	Payload   []byte   // The typed command, encoded as JSON
+	Arguments []string // The arguments of a version 0 command, by position
+	ClientID  string   // The client session the command belongs to ("" if none)
+	Sequence  int      // The command's sequence number within the session
+	Timestamp int64    // The leader's time when the command was submitted (unix nanoseconds)
 }
 
 // LogEntry represents an entry in our log, consisting of a command and a term.
@@ -16,6 +32,19 @@ type LogEntry struct {
 	Term    int
 }
 
+// Size returns the approximate size of the entry in bytes.
+func (entry *LogEntry) Size() int {
+	// Account for the term and the encoding overhead of each field.
+	size := 16
+	if entry.Command != nil {
+		size += len(entry.Command.Method) + len(entry.Command.ClientID) + len(entry.Command.Payload) + 24
+		for _, argument := range entry.Command.Arguments {
+			size += len(argument) + 2
+		}
+	}
+	return size
+}
+
 // CommandLog represents a log of commands in our consensus module. When
 // applied sequentially to our in-memory database, it should result in a
 // reproducable state.
@@ -28,51 +57,171 @@ func (l *CommandLog) AppendEntry(entry *LogEntry) {
 	l.Entries = append(l.Entries, *entry)
 }
 
-// applyCommand applied a given command to our in-memory database.
-func applyCommand(db *AlbumDB, entry *LogEntry) {
+// applyCommand applied a given command to our in-memory database. Returns the
+// error reported by the database, if any, or an error wrapping
+// ErrInvalidCommand if the command can't be decoded, in which case the
+// database is left untouched. A command from a client session is applied at
+// most once; a retry gets the result of the first attempt.
+func applyCommand(db *AlbumDB, entry *LogEntry) error {
 	cmd := entry.Command
-	if cmd.Method == "AddAlbum" {
-		if len(cmd.Arguments) == 4 {
-			db.AddAlbum(cmd.Arguments[0],
-				cmd.Arguments[1],
-				cmd.Arguments[2],
-				cmd.Arguments[3])
-		} else {
-			fmt.Println("Invalid arguments for AddAlbum")
-		}
-	} else if cmd.Method == "EditAlbum" {
-		if len(cmd.Arguments) == 5 {
-			db.EditAlbum(cmd.Arguments[0],
-				cmd.Arguments[1],
-				cmd.Arguments[2],
-				cmd.Arguments[3],
-				cmd.Arguments[4])
-		} else {
-			fmt.Println("Invalid arguments for AddAlbum")
-		}
-	} else if cmd.Method == "RemoveAlbum" {
-		if len(cmd.Arguments) == 1 {
-			db.RemoveAlbum(cmd.Arguments[0])
-		} else {
-			fmt.Println("Invalid arguments for RemoveAlbum")
-		}
-	} else {
-		fmt.Println("Unknown command")
+	typed, err := cmd.Decode()
+	if err != nil {
+		return err
+	}
+
+	if cmd.Timestamp != 0 {
+		db.Sessions.Advance(cmd.Timestamp)
+	}
+
+	if _, ok := typed.(*RegisterClientCommand); ok {
+		db.Sessions.Register(cmd.ClientID)
+		return nil
+	}
+	if cmd.ClientID != "" {
+		return db.Sessions.Apply(cmd, func() error {
+			return typed.Apply(db)
+		})
 	}
+	return typed.Apply(db)
 }
 
-func Reconstruct(db *AlbumDB, log *CommandLog) {
-	for _, entry := range log.Entries {
-		applyCommand(db, &entry)
+// Reconstruct applies the commands in a log to our in-memory database. Returns
+// an error if one of them can't be decoded.
+func Reconstruct(db *AlbumDB, log *CommandLog) error {
+	for i := range log.Entries {
+		if err := applyCommand(db, &log.Entries[i]); errors.Is(err, ErrInvalidCommand) {
+			return err
+		}
 	}
+	return nil
 }
 
 // ================================ COMMIT LOG ================================
 
 // EntryToCommit represents an entry (simillar to LogEntry) for which a
-// consensus has been reached by a quorum and is ready to be committed.
+// consensus has been reached by a quorum and is ready to be committed. If
+// Snapshot is set, the entry carries a snapshot from the leader instead of a
+// command, and the state machine should be replaced by it.
 type EntryToCommit struct {
-	Command *Command
-	Term    int
-	Index   int
+	Command  *Command
+	Term     int
+	Index    int
+	Snapshot *Snapshot
+}
+
+// ============================== CONFIGURATION ===============================
+
+// Configuration represents the members of the cluster: a map from each node's
+// ID to its client endpoint and role. Configurations are replicated as log
+// entries holding the complete new configuration; a node always uses the
+// latest one in its log.
+type Configuration map[int]Member
+
+// Member represents a node in a configuration. Learners receive the log like
+// any other member, but they don't vote and don't count toward a quorum (see
+// membership.go).
+type Member struct {
+	Endpoint string // The node's client endpoint
+	Learner  bool   // True if the node is a learner rather than a voter
+}
+
+/*
+ * IDs returns the IDs of the members of the configuration (voters and
+ * learners) in increasing order.
+ */
+func (config Configuration) IDs() []int {
+	ids := make([]int, 0, len(config))
+	for id := range config {
+		ids = append(ids, id)
+	}
+	sort.Ints(ids)
+	return ids
+}
+
+/*
+ * Voters returns the number of voting members.
+ */
+func (config Configuration) Voters() int {
+	voters := 0
+	for _, member := range config {
+		if !member.Learner {
+			voters++
+		}
+	}
+	return voters
+}
+
+/*
+ * Command returns the command that replicates the configuration.
+ */
+func (config Configuration) Command() *Command {
+	command := &ConfigurationCommand{Members: []ConfigurationMember{}}
+	for _, id := range config.IDs() {
+		command.Members = append(command.Members, ConfigurationMember{
+			ID:       id,
+			Endpoint: config[id].Endpoint,
+			Learner:  config[id].Learner,
+		})
+	}
+	return NewCommand(command)
+}
+
+/*
+ * String returns the configuration's members as "id=endpoint" pairs ordered
+ * by ID, followed by " learner" for learners.
+ */
+func (config Configuration) String() string {
+	members := []string{}
+	for _, id := range config.IDs() {
+		member := strconv.Itoa(id) + "=" + config[id].Endpoint
+		if config[id].Learner {
+			member += " learner"
+		}
+		members = append(members, member)
+	}
+	return "[" + strings.Join(members, ", ") + "]"
+}
+
+/*
+ * ParseConfiguration returns the configuration held by a Configuration
+ * command. Returns an error if the command can't be decoded.
+ */
+func ParseConfiguration(cmd *Command) (Configuration, error) {
+	typed, err := cmd.Decode()
+	if err != nil {
+		return nil, err
+	}
+	command, ok := typed.(*ConfigurationCommand)
+	if !ok {
+		return nil, fmt.Errorf("%w: %s isn't a configuration", ErrInvalidCommand, cmd.Method)
+	}
+
+	config := Configuration{}
+	for _, member := range command.Members {
+		config[member.ID] = Member{Endpoint: member.Endpoint, Learner: member.Learner}
+	}
+	return config, nil
+}
+
+/*
+ * Copy returns a copy of the configuration.
+ */
+func (config Configuration) Copy() Configuration {
+	copied := Configuration{}
+	for id, member := range config {
+		copied[id] = member
+	}
+	return copied
+}
+
+// ================================= SNAPSHOT =================================
+
+// Snapshot represents the state of our in-memory database after applying every
+// log entry up to and including LastIncludedIndex. Once a snapshot is taken,
+// those entries no longer need to be kept in the log.
+type Snapshot struct {
+	LastIncludedIndex int           // Index of the last entry included in the snapshot
+	LastIncludedTerm  int           // Term of that entry
+	Configuration     Configuration // The cluster configuration as of that entry
+	Data              []byte        // The encoded in-memory database
 }
@@ -0,0 +1,279 @@
+package main
+
+// The membership.go file implements cluster membership changes one server at
+// a time, as described in chapter 4 of Diego Ongaro's dissertation "Consensus:
+// Bridging Theory and Practice". Any two configurations that differ by a
+// single server share a majority, so the cluster can switch directly from one
+// to the next.
+//
+// A server can also join as a learner (section 4.2.1): it is replicated to
+// like any other member, but it doesn't vote or count toward any quorum, so
+// adding it can't stall the cluster while it catches up. Once it has caught
+// up, it can be promoted to a voter.
+
+import (
+	"errors"
+	"fmt"
+	"log"
+	"time"
+)
+
+// ============================= CONFIGURATIONS ===============================
+
+/*
+ * hasConfiguration returns true if any of the entries holds a configuration.
+ */
+func hasConfiguration(entries []LogEntry) bool {
+	for _, entry := range entries {
+		if entry.Command != nil && entry.Command.Method == "Configuration" {
+			return true
+		}
+	}
+	return false
+}
+
+/*
+ * configAt returns the configuration in effect at the given log index: the
+ * latest configuration entry at or before it, or the snapshot's configuration
+ * if there is none.
+ */
+func (node *ConsensusModule) configAt(index int) Configuration {
+	for i := index; i > node.snapshotIndex; i-- {
+		entry := node.log[i-node.snapshotIndex-1]
+		if entry.Command != nil && entry.Command.Method == "Configuration" {
+			config, err := ParseConfiguration(entry.Command)
+			if err != nil {
+				log.Fatalln("[ConsensusModule] configAt", err)
+			}
+			return config
+		}
+	}
+	return node.snapshotConfig
+}
+
+/*
+ * updateConfig makes the latest configuration in the log the active one. The
+ * peers that joined are connected to (and, on a leader, start being
+ * replicated to) and the peers that left are disconnected from.
+ */
+func (node *ConsensusModule) updateConfig() {
+	node.config = node.configAt(node.lastLogIndex())
+	node.configIndex = -1
+	for i := node.lastLogIndex(); i > node.snapshotIndex; i-- {
+		if hasConfiguration(node.log[i-node.snapshotIndex-1 : i-node.snapshotIndex]) {
+			node.configIndex = i
+			break
+		}
+	}
+
+	previousPeers := node.peerIds
+	oldPeers := make(map[int]bool)
+	for _, peer := range previousPeers {
+		oldPeers[peer] = true
+	}
+
+	node.peerIds = []int{}
+	for _, id := range node.config.IDs() {
+		if id == node.id {
+			continue
+		}
+		node.peerIds = append(node.peerIds, id)
+
+		if !oldPeers[id] {
+			if node.state == LEADER {
+				node.resetProgress(id)
+			}
+			id := id
+			node.runtime.Go(func() { node.connectToPeer(id) })
+		}
+		delete(oldPeers, id)
+	}
+
+	// The peers that left, in order (so that a simulated cluster starts the
+	// same goroutines every time).
+	for _, peer := range previousPeers {
+		if !oldPeers[peer] {
+			continue
+		}
+		delete(node.nextIndex, peer)
+		delete(node.matchIndex, peer)
+		delete(node.progress, peer)
+		peer := peer
+		node.runtime.Go(func() { node.DisconnectFromPeer(peer) })
+	}
+}
+
+/*
+ * isMember returns true if the node with the given ID is a member of the
+ * active configuration, as a voter or a learner.
+ */
+func (node *ConsensusModule) isMember(id int) bool {
+	_, ok := node.config[id]
+	return ok
+}
+
+/*
+ * isVoter returns true if the node with the given ID is a voting member of the
+ * active configuration.
+ */
+func (node *ConsensusModule) isVoter(id int) bool {
+	member, ok := node.config[id]
+	return ok && !member.Learner
+}
+
+/*
+ * voterPeers returns the peers that are voting members.
+ */
+func (node *ConsensusModule) voterPeers() []int {
+	voters := []int{}
+	for _, peer := range node.peerIds {
+		if node.isVoter(peer) {
+			voters = append(voters, peer)
+		}
+	}
+	return voters
+}
+
+// peerConnectRetry is how long a node waits before retrying to connect to a
+// peer that isn't reachable yet.
+const peerConnectRetry = 500 * time.Millisecond
+
+/*
+ * connectToPeer tells the transport where a member of the configuration is,
+ * retrying until the transport accepts it (the in-memory transports only
+ * accept peers that are listening) or it is no longer a member.
+ */
+func (node *ConsensusModule) connectToPeer(peer int) {
+	for {
+		node.mu.Lock()
+		member, ok := node.config[peer]
+		node.mu.Unlock()
+		if !ok {
+			return
+		}
+
+		if node.ConnectToPeer(peer, member.Endpoint) == nil {
+			log.Println("[ConsensusModule] Added peer", peer, "at", member.Endpoint)
+			return
+		}
+		node.runtime.Sleep(peerConnectRetry)
+	}
+}
+
+// ============================ MEMBERSHIP CHANGES ============================
+
+/*
+ * Bootstrap makes the given configuration the first entry of a brand new
+ * cluster's log. Every initial member bootstraps with the same configuration,
+ * so their first entries are identical and committed from the start; nodes
+ * that join later receive it from the leader instead. Must be called before
+ * Start, and only on a node with an empty log.
+ */
+func (node *ConsensusModule) Bootstrap(config Configuration) {
+	node.mu.Lock()
+	defer node.mu.Unlock()
+
+	node.appendToLog(0, []LogEntry{{Command: config.Command(), Term: 0}})
+	node.commitIndex = 0
+	node.lastApplied = 0
+	node.persistCommitIndex()
+}
+
+/*
+ * AddServer appends a configuration that adds the given node to the cluster,
+ * as a voter or (if learner is set) as a learner. Returns the index and term
+ * of the new entry.
+ */
+func (node *ConsensusModule) AddServer(id int, endpoint string, learner bool) (int, int, error) {
+	node.mu.Lock()
+	defer node.mu.Unlock()
+
+	if node.state != LEADER {
+		return -1, -1, ErrNotLeader
+	}
+	if node.isMember(id) {
+		return -1, -1, fmt.Errorf("node %d is already a member", id)
+	}
+
+	config := node.config.Copy()
+	config[id] = Member{Endpoint: endpoint, Learner: learner}
+	return node.changeConfig(config)
+}
+
+/*
+ * PromoteLearner appends a configuration that makes the given learner a
+ * voter. The learner must have caught up with the leader, so that the cluster
+ * doesn't wait on it to commit new ones. Returns the index and term of the new
+ * entry.
+ */
+func (node *ConsensusModule) PromoteLearner(id int) (int, int, error) {
+	node.mu.Lock()
+	defer node.mu.Unlock()
+
+	if node.state != LEADER {
+		return -1, -1, ErrNotLeader
+	}
+	member, ok := node.config[id]
+	if !ok || !member.Learner {
+		return -1, -1, fmt.Errorf("node %d is not a learner", id)
+	}
+	// Under a steady stream of writes a learner is always a few entries
+	// behind; within one batch of the commit index is caught up enough.
+	progress := node.progress[id]
+	if progress == nil || progress.probing || node.commitIndex-node.matchIndex[id] > node.batchEntries {
+		return -1, -1, fmt.Errorf("node %d hasn't caught up yet (%d of %d entries)",
+			id, node.matchIndex[id]+1, node.commitIndex+1)
+	}
+
+	config := node.config.Copy()
+	config[id] = Member{Endpoint: member.Endpoint}
+	return node.changeConfig(config)
+}
+
+/*
+ * RemoveServer appends a configuration that removes the given node from the
+ * cluster. Returns the index and term of the new entry.
+ */
+func (node *ConsensusModule) RemoveServer(id int) (int, int, error) {
+	node.mu.Lock()
+	defer node.mu.Unlock()
+
+	if node.state != LEADER {
+		return -1, -1, ErrNotLeader
+	}
+	if !node.isMember(id) {
+		return -1, -1, fmt.Errorf("node %d is not a member", id)
+	}
+	if node.isVoter(id) && node.config.Voters() == 1 {
+		return -1, -1, errors.New("can't remove the last voter of the cluster")
+	}
+
+	config := node.config.Copy()
+	delete(config, id)
+	return node.changeConfig(config)
+}
+
+/*
+ * changeConfig appends a new configuration to the leader's log; the caller
+ * must have checked that the node is the leader. Only one
+ * change may be in progress at a time, and a new leader must first commit an
+ * entry from its own term, so that no earlier change is still pending.
+ */
+func (node *ConsensusModule) changeConfig(config Configuration) (int, int, error) {
+	if node.transferTarget != -1 {
+		return -1, -1, errors.New("leadership is being transferred")
+	}
+	if node.configIndex > node.commitIndex {
+		return -1, -1, errors.New("another membership change is in progress")
+	}
+	if node.termAt(node.commitIndex) != node.currentTerm {
+		return -1, -1, errors.New("leader hasn't committed an entry in its term yet")
+	}
+
+	node.appendProposals()
+	node.appendToLog(node.lastLogIndex()+1, []LogEntry{{Command: config.Command(), Term: node.currentTerm}})
+	node.advanceCommitIndex()
+
+	log.Println("[ConsensusModule] Changing configuration to", config)
+	return node.lastLogIndex(), node.currentTerm, nil
+}
@@ -0,0 +1,291 @@
+package main
+
+import (
+	"bytes"
+	"encoding/gob"
+	"fmt"
+	"reflect"
+	"strings"
+	"sync"
+	"time"
+)
+
+// ============================ IN-MEMORY TRANSPORT ===========================
+
+// InMemoryNetwork represents a network connecting nodes that run in the same
+// process, such as a whole cluster inside one binary. Each listening node has
+// an inbox channel; a call is delivered to the callee's inbox and answered on
+// a channel of its own.
+type InMemoryNetwork struct {
+	listeners map[string]*inMemoryListener // The listening nodes, by endpoint
+	mu        sync.Mutex                   // A mutex to protect listeners
+}
+
+// inMemoryListener represents a node listening on an InMemoryNetwork.
+type inMemoryListener struct {
+	inbox   chan *inMemoryCall // Calls delivered to the node
+	stopped chan struct{}      // Closed once the node stops listening
+}
+
+// inMemoryCall represents a call in flight on an InMemoryNetwork. Arguments
+// and replies are gob-encoded, as they would be on the wire, so that caller
+// and callee never share memory.
+type inMemoryCall struct {
+	method string              // "Service.Method"
+	args   []byte              // The encoded arguments
+	done   chan inMemoryResult // Receives the result
+}
+
+// inMemoryResult represents the result of an inMemoryCall.
+type inMemoryResult struct {
+	reply []byte // The encoded reply
+	err   error  // The error returned by the method, or a dispatch error
+}
+
+/*
+ * NewInMemoryNetwork initializes an empty in-memory network.
+ */
+func NewInMemoryNetwork() *InMemoryNetwork {
+	return &InMemoryNetwork{
+		listeners: make(map[string]*inMemoryListener),
+	}
+}
+
+/*
+ * listener returns the node listening on endpoint, or nil.
+ */
+func (network *InMemoryNetwork) listener(endpoint string) *inMemoryListener {
+	network.mu.Lock()
+	defer network.mu.Unlock()
+
+	return network.listeners[endpoint]
+}
+
+/*
+ * deliver puts a call in the inbox of the node listening on endpoint. If the
+ * node stops listening before it takes the call, the call fails with
+ * ErrUnreachable.
+ */
+func (network *InMemoryNetwork) deliver(endpoint string, call *inMemoryCall) {
+	listener := network.listener(endpoint)
+	if listener == nil {
+		call.done <- inMemoryResult{err: ErrUnreachable}
+		return
+	}
+
+	select {
+	case listener.inbox <- call:
+	case <-listener.stopped:
+		call.done <- inMemoryResult{err: ErrUnreachable}
+	}
+}
+
+// rpcServices represents the services registered with a transport that calls
+// them in-process, by reflection, the way net/rpc would over the network.
+type rpcServices struct {
+	services map[string]interface{} // Registered services, by name
+	mu       sync.Mutex             // A mutex to protect services
+}
+
+// InMemoryTransport represents a node's transport on an InMemoryNetwork.
+type InMemoryTransport struct {
+	rpcServices
+	network  *InMemoryNetwork
+	endpoint string         // The endpoint the node listens on ("" until Listen)
+	peers    map[int]string // Endpoints of the connected peers, by ID
+	mu       sync.Mutex     // A mutex to protect peers
+}
+
+/*
+ * NewInMemoryTransport initializes a transport on the given network.
+ */
+func NewInMemoryTransport(network *InMemoryNetwork) *InMemoryTransport {
+	return &InMemoryTransport{
+		rpcServices: rpcServices{services: make(map[string]interface{})},
+		network:     network,
+		peers:       make(map[int]string),
+	}
+}
+
+/*
+ * Register registers a service whose methods can be called by peers.
+ */
+func (s *rpcServices) Register(name string, service interface{}) error {
+	s.mu.Lock()
+	defer s.mu.Unlock()
+
+	if _, ok := s.services[name]; ok {
+		return fmt.Errorf("service %s is already registered", name)
+	}
+	s.services[name] = service
+	return nil
+}
+
+/*
+ * Listen adds the node's inbox to the network and starts serving the calls
+ * delivered to it, each in its own goroutine like net/rpc does.
+ */
+func (t *InMemoryTransport) Listen(endpoint string) error {
+	t.network.mu.Lock()
+	defer t.network.mu.Unlock()
+
+	if _, ok := t.network.listeners[endpoint]; ok {
+		return fmt.Errorf("%s is already in use", endpoint)
+	}
+
+	listener := &inMemoryListener{
+		inbox:   make(chan *inMemoryCall),
+		stopped: make(chan struct{}),
+	}
+	t.network.listeners[endpoint] = listener
+	t.endpoint = endpoint
+
+	go func() {
+		for {
+			select {
+			case call := <-listener.inbox:
+				go func() {
+					reply, err := t.serve(call.method, call.args)
+					call.done <- inMemoryResult{reply: reply, err: err}
+				}()
+			case <-listener.stopped:
+				return
+			}
+		}
+	}()
+
+	return nil
+}
+
+/*
+ * Close removes the node's inbox from the network, so that calls to it fail
+ * with ErrUnreachable from then on, and forgets the node's peers.
+ */
+func (t *InMemoryTransport) Close() error {
+	t.network.mu.Lock()
+	if listener, ok := t.network.listeners[t.endpoint]; ok {
+		delete(t.network.listeners, t.endpoint)
+		close(listener.stopped)
+	}
+	t.network.mu.Unlock()
+
+	t.mu.Lock()
+	defer t.mu.Unlock()
+
+	t.peers = make(map[int]string)
+	return nil
+}
+
+/*
+ * Connect connects to the peer listening on endpoint.
+ */
+func (t *InMemoryTransport) Connect(peer int, endpoint string) error {
+	if t.network.listener(endpoint) == nil {
+		return ErrUnreachable
+	}
+
+	t.mu.Lock()
+	defer t.mu.Unlock()
+
+	t.peers[peer] = endpoint
+	return nil
+}
+
+/*
+ * Disconnect forgets a peer.
+ */
+func (t *InMemoryTransport) Disconnect(peer int) error {
+	t.mu.Lock()
+	defer t.mu.Unlock()
+
+	delete(t.peers, peer)
+	return nil
+}
+
+/*
+ * Health returns the peer's endpoint, if the node is connected to it.
+ */
+func (t *InMemoryTransport) Health(peer int) PeerHealth {
+	t.mu.Lock()
+	defer t.mu.Unlock()
+
+	endpoint, ok := t.peers[peer]
+	return PeerHealth{Endpoint: endpoint, Connected: ok}
+}
+
+/*
+ * Call delivers a call to the peer's inbox and waits for the result, or
+ * until the call times out.
+ */
+func (t *InMemoryTransport) Call(peer int, method string, args, reply interface{}) error {
+	t.mu.Lock()
+	endpoint, ok := t.peers[peer]
+	t.mu.Unlock()
+	if !ok {
+		return fmt.Errorf("not connected to peer %d", peer)
+	}
+
+	var buffer bytes.Buffer
+	if err := gob.NewEncoder(&buffer).Encode(args); err != nil {
+		return err
+	}
+
+	call := &inMemoryCall{
+		method: method,
+		args:   buffer.Bytes(),
+		done:   make(chan inMemoryResult, 1),
+	}
+	go t.network.deliver(endpoint, call)
+
+	var result inMemoryResult
+	select {
+	case result = <-call.done:
+	case <-time.After(callTimeout(method)):
+		return ErrCallTimeout
+	}
+	if result.err != nil {
+		return result.err
+	}
+	return gob.NewDecoder(bytes.NewReader(result.reply)).Decode(reply)
+}
+
+/*
+ * serve decodes the arguments of a call, calls the method on the registered
+ * service and returns the encoded reply.
+ */
+func (s *rpcServices) serve(method string, args []byte) ([]byte, error) {
+	dot := strings.LastIndex(method, ".")
+	if dot < 0 {
+		return nil, fmt.Errorf("malformed method %s", method)
+	}
+
+	s.mu.Lock()
+	service, ok := s.services[method[:dot]]
+	s.mu.Unlock()
+	if !ok {
+		return nil, fmt.Errorf("unknown service %s", method[:dot])
+	}
+
+	fn := reflect.ValueOf(service).MethodByName(method[dot+1:])
+	if !fn.IsValid() || fn.Type().NumIn() != 2 || fn.Type().In(1).Kind() != reflect.Ptr ||
+		fn.Type().NumOut() != 1 {
+		return nil, fmt.Errorf("unknown method %s", method)
+	}
+
+	argv := reflect.New(fn.Type().In(0))
+	if err := gob.NewDecoder(bytes.NewReader(args)).Decode(argv.Interface()); err != nil {
+		return nil, err
+	}
+	replyv := reflect.New(fn.Type().In(1).Elem())
+
+	out := fn.Call([]reflect.Value{argv.Elem(), replyv})
+	if err, _ := out[0].Interface().(error); err != nil {
+		return nil, err
+	}
+
+	var buffer bytes.Buffer
+	if err := gob.NewEncoder(&buffer).Encode(replyv.Interface()); err != nil {
+		return nil, err
+	}
+	return buffer.Bytes(), nil
+}
@@ -1,22 +1,63 @@
 package main
 
+import (
+	"errors"
+	"time"
+)
+
+// ErrNotLeader is returned for requests that only the leader can serve. Its
+// text is what clients see in DataMessage.Error.
+var ErrNotLeader = errors.New("not the leader")
+
+// ErrSessionExpired is returned for commands from a client session that
+// expired (or was never registered); the client has to register again.
+var ErrSessionExpired = errors.New("session expired")
+
+// ErrCommitTimeout, ErrNotCommitted and ErrReplacedBySnapshot are returned for
+// writes whose outcome is unknown, usually because the leader changed while
+// they were being replicated; the write may or may not have been applied. A
+// client can resend it to the new leader in the same session to find out.
+var (
+	ErrCommitTimeout      = errors.New("timed out waiting for commit")
+	ErrNotCommitted       = errors.New("command was not committed")
+	ErrReplacedBySnapshot = errors.New("command was replaced by a snapshot")
+)
+
 // DataMessage represents a data message (relating to the data store) sent to
 // the backend server over a TCP connection containing the method being called
 // with optional index and an optional albumArray holding the album(s)
 // requested
 type DataMessage struct {
-	Method     string   // The method being called
-	Index      string   // The index of the album in the in-memory database
-	AlbumArray []*Album // The album(s)
-	Status     bool     // Boolean to determine if the request was successful
+	Method       string        // The method being called
+	Index        string        // The index of the album in the in-memory database
+	AlbumArray   []*Album      // The album(s)
+	Status       bool          // Boolean to determine if the request was successful
+	ReadLevel    ReadLevel     // How consistent a GetAllAlbums or GetAlbum read must be
+	MaxStaleness time.Duration // READ_BOUNDED: how far behind the leader the read may be
+	Leader       string        // The leader's endpoint, if this node couldn't serve the request
+	Error        string        // Why the request failed, if it did
+	ClientID     string        // The client's session, for writes and RegisterClient
+	Sequence     int           // The write's sequence number within the session, starting at 1
 }
 
+// ReadLevel represents one of the consistency levels a client can ask reads to
+// be served at: (0) Linearizable, (1) Local, and (2) Bounded.
+type ReadLevel int
+
+const (
+	READ_LINEARIZABLE ReadLevel = 0 // Served by the leader, reflects every write committed before it
+	READ_LOCAL        ReadLevel = 1 // Served from the node's own database, which may be stale
+	READ_BOUNDED      ReadLevel = 2 // Served by any node at most MaxStaleness behind the leader
+)
+
 // NodeMessage represents a raft message (relating to the communication between
-// client and nodes in the cluser).
+// client and nodes in the cluser). A backend answers a GetLeader DataMessage
+// with a NodeMessage naming the node it thinks is the leader.
 type NodeMessage struct {
-	Method string // The method being called
-	ID     string // The ID of the node
-	Term   int    // The current term
+	Method   string // The method being called
+	ID       string // The ID of the node ("" if unknown)
+	Term     int    // The current term
+	Endpoint string // The node's client endpoint ("" if unknown)
 }
 
 // ============================= REQUEST VOTE RPC =============================
@@ -24,16 +65,17 @@ type NodeMessage struct {
 // RequestVoteArgs represents the arguments passed to the RequestVote RPC. It's
 // invoked by candidates to gather votes.
 type RequestVoteArgs struct {
-	term         int // Candidate's term
-	candidateID  int // Candidate requesting vote
-	lastLogIndex int // Index of candidate's last log entry
-	lastLogTerm  int // Term of candidate's last log entry
+	Term         int  // Candidate's term
+	CandidateID  int  // Candidate requesting vote
+	LastLogIndex int  // Index of candidate's last log entry
+	LastLogTerm  int  // Term of candidate's last log entry
+	PreVote      bool // True if this asks whether the vote would be granted, without a real election
 }
 
 // RequestVoteReply represents the reply to the RequestVote RPC.
 type RequestVoteReply struct {
-	term        int  // currentTerm, for the candidate to update itself
-	voteGranted bool // True means the candidate received a vote
+	Term        int  // currentTerm, for the candidate to update itself
+	VoteGranted bool // True means the candidate received a vote
 }
 
 // ============================ APPEND ENTRIES RPC ============================
@@ -41,16 +83,158 @@ type RequestVoteReply struct {
 // AppendEntriesArgs represents the arguments to the AppendEntries RPC. It's
 // invoked by the leader t replicate log entries; also used as a heartbeat.
 type AppendEntriesArgs struct {
-	term         int        // The leader's term
-	leaderId     int        // So the follower can redirect clients
-	prevLogIndex int        // Index of log entry immediately preceding new ones
-	prevLogTerm  int        // Term of prevLogIndex entry
-	entries      []LogEntry // Log entries to store (empty for heartbeat)
-	leaderCommit int        // Leader's commitIndex
+	Term         int        // The leader's term
+	LeaderId     int        // So the follower can redirect clients
+	PrevLogIndex int        // Index of log entry immediately preceding new ones
+	PrevLogTerm  int        // Term of prevLogIndex entry
+	Entries      []LogEntry // Log entries to store (empty for heartbeat)
+	LeaderCommit int        // Leader's commitIndex
+
+	Checksum *ChecksumPoint // The leader's latest database checksum (nil if it keeps none; see checksum.go)
 }
 
 // AppendEntriesReply represents the reply to the AppendEntries RPC.
 type AppendEntriesReply struct {
-	term    int  // currentTerm, for the leader to update itself
-	success bool // True if follower contained entry matching prevLogIndex and preLogTerm
+	Term          int  // currentTerm, for the leader to update itself
+	Success       bool // True if follower contained entry matching prevLogIndex and preLogTerm
+	ConflictTerm  int  // On rejection, the term of the follower's entry at prevLogIndex (-1 if it has none)
+	ConflictIndex int  // On rejection, the first index of ConflictTerm (or the end of the log + 1)
+}
+
+// =========================== INSTALL SNAPSHOT RPC ===========================
+
+// InstallSnapshotArgs represents the arguments to the InstallSnapshot RPC. It's
+// invoked by the leader to send a snapshot to a follower that is missing
+// entries the leader has already compacted away.
+type InstallSnapshotArgs struct {
+	Term              int           // The leader's term
+	LeaderId          int           // So the follower can redirect clients
+	LastIncludedIndex int           // The snapshot replaces all entries up to this index
+	LastIncludedTerm  int           // Term of lastIncludedIndex
+	Configuration     Configuration // The cluster configuration as of lastIncludedIndex
+	Data              []byte        // The snapshot's encoded in-memory database
+}
+
+// InstallSnapshotReply represents the reply to the InstallSnapshot RPC.
+type InstallSnapshotReply struct {
+	Term int // currentTerm, for the leader to update itself
+}
+
+// ============================== TIMEOUT NOW RPC =============================
+
+// TimeoutNowArgs represents the arguments to the TimeoutNow RPC. It's invoked
+// by a leader handing off leadership, to tell the target (whose log is up to
+// date) to start an election right away.
+type TimeoutNowArgs struct {
+	Term     int // The leader's term
+	LeaderId int // The leader handing off leadership
+}
+
+// TimeoutNowReply represents the reply to the TimeoutNow RPC.
+type TimeoutNowReply struct {
+	Term int // currentTerm, for the leader to update itself
+}
+
+// ============================== CHECKSUMS RPC ===============================
+
+// ChecksumPoint represents a node's database checksum after applying the
+// entry at Index.
+type ChecksumPoint struct {
+	Index    int    // Index of the last entry applied
+	Checksum uint64 // The database's checksum right after it was applied
+}
+
+// ChecksumsArgs represents the arguments to the Checksums RPC. It's invoked
+// by a follower whose checksum differs from the leader's, to find the first
+// index at which they differ.
+type ChecksumsArgs struct {
+	From int // Index of the first checksum wanted
+	To   int // Index of the last checksum wanted
+}
+
+// ChecksumsReply represents the reply to the Checksums RPC.
+type ChecksumsReply struct {
+	From      int      // Index of the first checksum in Checksums
+	Checksums []uint64 // The checksums the node still keeps in the range, in order
+}
+
+// Divergence represents the point at which a node's database was found to
+// differ from another node's.
+type Divergence struct {
+	Peer   int    // The node whose checksum differed from ours
+	Index  int    // The first index at which the checksums differ
+	Exact  bool   // False if the earlier checksums were gone, so the databases may differ from before Index
+	Ours   uint64 // Our checksum at Index
+	Theirs uint64 // The peer's checksum at Index
+}
+
+// ================================ ADMIN RPCS ================================
+
+// MembershipChangeArgs represents the arguments to the Admin.AddServer,
+// Admin.AddLearner, Admin.PromoteLearner and Admin.RemoveServer RPCs, which
+// add a node to the cluster, promote a learner to a voter or remove a node.
+type MembershipChangeArgs struct {
+	ID       int    // ID of the node to add, promote or remove
+	Endpoint string // Client endpoint of the node (only for AddServer and AddLearner)
+}
+
+// AdminReply represents the reply to an admin RPC.
+type AdminReply struct {
+	Status  bool   // True if the operation succeeded
+	Message string // A description of the result, or why the operation failed
+}
+
+// StatusArgs represents the arguments to the Admin.Status RPC, which reports
+// a backend's Raft state.
+type StatusArgs struct{}
+
+// NodeStatus represents the reply to the Admin.Status RPC.
+type NodeStatus struct {
+	ID             int           // ID of the node
+	Endpoint       string        // Client endpoint of the node ("" until it has joined)
+	State          string        // "follower", "candidate", "leader" or "dead"
+	Learner        bool          // True if the node doesn't vote
+	CurrentTerm    int           // Latest term the node has seen
+	VotedFor       int           // Who the node voted for in currentTerm (-1 if nobody)
+	LeaderID       int           // Who the node thinks the leader is (-1 if unknown)
+	LeaderEndpoint string        // Client endpoint of that leader
+	CommitIndex    int           // Index of highest log entry known to be committed
+	LastApplied    int           // Index of highest log entry passed to the database
+	LastLogIndex   int           // Index of the last entry in the log
+	LogLength      int           // Entries in the log after the snapshot
+	SnapshotIndex  int           // Index of the last entry included in the snapshot
+	Checksum       ChecksumPoint // The database's latest checksum (Index -1 if none)
+	Divergence     *Divergence   // Where the database was found to differ from the leader's (nil if it wasn't)
+	Peers          []PeerStatus  // The other members, by ID
+}
+
+// PeerStatus represents what a node knows about one of its peers.
+type PeerStatus struct {
+	ID         int    // ID of the peer
+	Endpoint   string // Client endpoint of the peer
+	Learner    bool   // True if the peer doesn't vote
+	NextIndex  int    // Index of the next entry to send the peer (-1 unless we lead)
+	MatchIndex int    // Index of highest entry known to be on the peer (-1 unless we lead)
+	Connected  bool   // Whether calls are being sent to the peer
+	Failures   int    // Failed dials or calls since the last success
+	LastError  string // Why the last dial or call failed ("" if none has)
+}
+
+// AlbumsArgs represents the arguments to the Admin.Albums RPC, which returns
+// the backend's whole database, to compare with the other nodes'.
+type AlbumsArgs struct{}
+
+// AlbumsReply represents the reply to the Admin.Albums RPC.
+type AlbumsReply struct {
+	ID           int           // ID of the node
+	AppliedIndex int           // Index of the last entry applied to the database
+	Checksum     uint64        // The database's checksum
+	CurrID       int           // The next album ID to be assigned
+	Albums       map[int]Album // Every album, by ID
+}
+
+// TransferLeadershipArgs represents the arguments to the
+// Admin.TransferLeadership RPC, which hands leadership to another node.
+type TransferLeadershipArgs struct {
+	ID int // ID of the node that should become the leader
 }
@@ -0,0 +1,318 @@
+package main
+
+// The metrics.go file keeps counters and histograms and exports them, along
+// with gauges computed when they are read, in the Prometheus text exposition
+// format (version 0.0.4), which is what a Prometheus server scrapes from a
+// /metrics endpoint. Each metric may have labels; a series is created the
+// first time a combination of label values is used.
+
+import (
+	"fmt"
+	"io"
+	"math"
+	"net/http"
+	"sort"
+	"strconv"
+	"strings"
+	"sync"
+)
+
+// metricsContentType is the content type of the text exposition format.
+const metricsContentType = "text/plain; version=0.0.4; charset=utf-8"
+
+// latencyBuckets are the upper bounds, in seconds, of the buckets of the
+// latency histograms.
+var latencyBuckets = []float64{0.0005, 0.001, 0.0025, 0.005, 0.01, 0.025, 0.05, 0.1, 0.25, 0.5, 1, 2.5, 5, 10}
+
+// ================================= REGISTRY =================================
+
+// Metric represents anything a Registry can export.
+type Metric interface {
+	// writeTo writes the metric's HELP and TYPE lines and its samples.
+	writeTo(w io.Writer)
+}
+
+// Registry represents the set of metrics a /metrics endpoint exports.
+type Registry struct {
+	metrics []Metric   // In the order they were registered
+	mu      sync.Mutex // A mutex to protect metrics
+}
+
+/*
+ * NewRegistry initializes an empty registry.
+ */
+func NewRegistry() *Registry {
+	return &Registry{}
+}
+
+/*
+ * Register adds metrics to the registry.
+ */
+func (r *Registry) Register(metrics ...Metric) {
+	r.mu.Lock()
+	defer r.mu.Unlock()
+
+	r.metrics = append(r.metrics, metrics...)
+}
+
+/*
+ * Write writes every metric in the registry in the text exposition format.
+ */
+func (r *Registry) Write(w io.Writer) {
+	r.mu.Lock()
+	metrics := append([]Metric(nil), r.metrics...)
+	r.mu.Unlock()
+
+	for _, metric := range metrics {
+		metric.writeTo(w)
+	}
+}
+
+/*
+ * ServeHTTP answers a scrape with every metric in the registry.
+ */
+func (r *Registry) ServeHTTP(w http.ResponseWriter, req *http.Request) {
+	w.Header().Set("Content-Type", metricsContentType)
+	r.Write(w)
+}
+
+// ================================== COUNTER =================================
+
+// Counter represents a metric that only goes up, such as a number of
+// requests.
+type Counter struct {
+	name   string
+	help   string
+	labels []string
+	series map[string]*counterSeries // By joined label values
+	mu     sync.Mutex                // A mutex to protect series
+}
+
+// counterSeries represents a counter's value for one set of label values.
+type counterSeries struct {
+	values []string
+	value  float64
+}
+
+/*
+ * NewCounter initializes a counter with the given label names.
+ */
+func NewCounter(name, help string, labels ...string) *Counter {
+	return &Counter{name: name, help: help, labels: labels, series: make(map[string]*counterSeries)}
+}
+
+/*
+ * Add adds delta to the series with the given label values (one per label
+ * name, in order).
+ */
+func (c *Counter) Add(delta float64, values ...string) {
+	c.mu.Lock()
+	defer c.mu.Unlock()
+
+	key := seriesKey(values)
+	series, ok := c.series[key]
+	if !ok {
+		series = &counterSeries{values: values}
+		c.series[key] = series
+	}
+	series.value += delta
+}
+
+/*
+ * Inc adds one to the series with the given label values.
+ */
+func (c *Counter) Inc(values ...string) {
+	c.Add(1, values...)
+}
+
+func (c *Counter) writeTo(w io.Writer) {
+	c.mu.Lock()
+	defer c.mu.Unlock()
+
+	// Series are listed in the same order on every scrape.
+	keys := make([]string, 0, len(c.series))
+	for key := range c.series {
+		keys = append(keys, key)
+	}
+	sort.Strings(keys)
+
+	writeHeader(w, c.name, c.help, "counter")
+	for _, key := range keys {
+		series := c.series[key]
+		writeSample(w, c.name, c.labels, series.values, "", series.value)
+	}
+
+	// A counter without labels is 0 until it is first incremented.
+	if len(c.labels) == 0 && len(keys) == 0 {
+		writeSample(w, c.name, nil, nil, "", 0)
+	}
+}
+
+// ================================= GAUGE FUNC ===============================
+
+// GaugeFunc represents a metric that can go up and down, such as a term or an
+// index, whose samples are computed each time it is scraped.
+type GaugeFunc struct {
+	name    string
+	help    string
+	labels  []string
+	collect func(emit func(value float64, values ...string))
+}
+
+/*
+ * NewGaugeFunc initializes a gauge whose samples are computed by collect, which
+ * calls emit once per series with its value and label values.
+ */
+func NewGaugeFunc(name, help string, labels []string, collect func(emit func(value float64, values ...string))) *GaugeFunc {
+	return &GaugeFunc{name: name, help: help, labels: labels, collect: collect}
+}
+
+func (g *GaugeFunc) writeTo(w io.Writer) {
+	writeHeader(w, g.name, g.help, "gauge")
+	g.collect(func(value float64, values ...string) {
+		writeSample(w, g.name, g.labels, values, "", value)
+	})
+}
+
+// ================================= HISTOGRAM ================================
+
+// Histogram represents a metric that counts observations, such as request
+// latencies, in buckets, along with their count and sum.
+type Histogram struct {
+	name    string
+	help    string
+	labels  []string
+	buckets []float64                   // Upper bounds of the buckets, in increasing order
+	series  map[string]*histogramSeries // By joined label values
+	mu      sync.Mutex                  // A mutex to protect series
+}
+
+// histogramSeries represents a histogram's observations for one set of label
+// values.
+type histogramSeries struct {
+	values []string
+	counts []uint64 // Observations per bucket (not cumulative)
+	count  uint64
+	sum    float64
+}
+
+/*
+ * NewHistogram initializes a histogram with the given buckets and label
+ * names.
+ */
+func NewHistogram(name, help string, buckets []float64, labels ...string) *Histogram {
+	return &Histogram{name: name, help: help, labels: labels, buckets: buckets, series: make(map[string]*histogramSeries)}
+}
+
+/*
+ * Observe records an observation in the series with the given label values.
+ */
+func (h *Histogram) Observe(value float64, values ...string) {
+	h.mu.Lock()
+	defer h.mu.Unlock()
+
+	key := seriesKey(values)
+	series, ok := h.series[key]
+	if !ok {
+		series = &histogramSeries{values: values, counts: make([]uint64, len(h.buckets))}
+		h.series[key] = series
+	}
+	if i := sort.SearchFloat64s(h.buckets, value); i < len(h.buckets) {
+		series.counts[i]++
+	}
+	series.count++
+	series.sum += value
+}
+
+func (h *Histogram) writeTo(w io.Writer) {
+	h.mu.Lock()
+	defer h.mu.Unlock()
+
+	keys := make([]string, 0, len(h.series))
+	for key := range h.series {
+		keys = append(keys, key)
+	}
+	sort.Strings(keys)
+
+	writeHeader(w, h.name, h.help, "histogram")
+	labels := append(append([]string(nil), h.labels...), "le")
+	for _, key := range keys {
+		series := h.series[key]
+
+		cumulative := uint64(0)
+		for i, bound := range h.buckets {
+			cumulative += series.counts[i]
+			values := append(append([]string(nil), series.values...), formatValue(bound))
+			writeSample(w, h.name, labels, values, "_bucket", float64(cumulative))
+		}
+		values := append(append([]string(nil), series.values...), "+Inf")
+		writeSample(w, h.name, labels, values, "_bucket", float64(series.count))
+		writeSample(w, h.name, h.labels, series.values, "_sum", series.sum)
+		writeSample(w, h.name, h.labels, series.values, "_count", float64(series.count))
+	}
+}
+
+// ================================ FORMATTING ================================
+
+/*
+ * seriesKey joins label values into a map key.
+ */
+func seriesKey(values []string) string {
+	return strings.Join(values, "\xff")
+}
+
+/*
+ * writeHeader writes a metric's HELP and TYPE lines.
+ */
+func writeHeader(w io.Writer, name, help, kind string) {
+	help = strings.NewReplacer(`\`, `\\`, "\n", `\n`).Replace(help)
+	fmt.Fprintf(w, "# HELP %s %s\n# TYPE %s %s\n", name, help, name, kind)
+}
+
+/*
+ * writeSample writes one sample line: the metric's name with the suffix, the
+ * labels and the value.
+ */
+func writeSample(w io.Writer, name string, labels, values []string, suffix string, value float64) {
+	var b strings.Builder
+	b.WriteString(name + suffix)
+	if len(labels) > 0 {
+		b.WriteString("{")
+		for i, label := range labels {
+			if i > 0 {
+				b.WriteString(",")
+			}
+			value := ""
+			if i < len(values) {
+				value = values[i]
+			}
+			b.WriteString(label + `="` + escapeLabelValue(value) + `"`)
+		}
+		b.WriteString("}")
+	}
+	b.WriteString(" " + formatValue(value) + "\n")
+	io.WriteString(w, b.String())
+}
+
+/*
+ * escapeLabelValue escapes the backslashes, double quotes and line feeds in a
+ * label value.
+ */
+func escapeLabelValue(value string) string {
+	return strings.NewReplacer(`\`, `\\`, `"`, `\"`, "\n", `\n`).Replace(value)
+}
+
+/*
+ * formatValue formats a sample value or bucket bound.
+ */
+func formatValue(value float64) string {
+	switch {
+	case math.IsInf(value, 1):
+		return "+Inf"
+	case math.IsInf(value, -1):
+		return "-Inf"
+	case math.IsNaN(value):
+		return "NaN"
+	}
+	return strconv.FormatFloat(value, 'g', -1, 64)
+}
@@ -2,49 +2,61 @@ package main
 
 import (
 	"fmt"
+	"net"
 	"os"
+	"strconv"
 	"strings"
 )
 
+// peerPortOffset is added to a backend's client port to get the port on which
+// it listens for RPCs from the other backends in the cluster.
+const peerPortOffset = 1000
+
+// metricsPortOffset is added to a backend's client port to get the port on
+// which it serves /metrics.
+const metricsPortOffset = 2000
+
 func ParseListenFlag(args []string, i int) string {
+	port := ":" + ParseValueFlag(args, i)
+	return port
+}
+
+func ParseValueFlag(args []string, i int) string {
 	if len(args) <= i+1 {
-		fmt.Println("incorrect usage")
+		fmt.Println(args[i] + " needs a value")
 		os.Exit(1)
 	}
-	port := ":" + args[i+1]
-	return port
+	return args[i+1]
+}
+
+func ParseIntFlag(args []string, i int) int {
+	value, err := strconv.Atoi(ParseValueFlag(args, i))
+	if err != nil || value < 0 {
+		fmt.Printf("%s must be a non-negative integer, not %q\n", args[i], args[i+1])
+		os.Exit(1)
+	}
+	return value
 }
 
 func ParseEndpoint(endpoint string) string {
-	hostname := "localhost"
-	port := ""
-	if strings.Contains(endpoint, ":") {
-		arr := strings.Split(endpoint, ":")
-		if len(arr) > 2 {
-			fmt.Println("incorrect usage")
-			os.Exit(1)
-		}
-		if arr[0] != "" {
-			hostname = arr[0]
-		}
-		port = arr[1]
-	} else {
-		fmt.Println("incorrect usage")
+	// SplitHostPort also takes IPv6 addresses, such as [::1]:8090.
+	hostname, port, err := net.SplitHostPort(endpoint)
+	if err != nil {
+		fmt.Printf("invalid endpoint %q; expected host:port\n", endpoint)
 		os.Exit(1)
 	}
+	if hostname == "" {
+		hostname = "localhost"
+	}
 
-	return hostname + ":" + port
+	return net.JoinHostPort(hostname, port)
 }
 
 func ParseBackendEndpointsFlag(args []string, i int) []string {
 	endpoints := []string{}
 
 	// If the flag doesn't contain an input, exit.
-	if len(args) == i+1 {
-		fmt.Println("incorrect usage")
-		os.Exit(1)
-	}
-	input := args[i+1]
+	input := ParseValueFlag(args, i)
 
 	// Check if there is a seperated list of backend endpoints.
 	if strings.Contains(input, ",") {
@@ -62,3 +74,35 @@ func ParseBackendEndpointsFlag(args []string, i int) []string {
 
 	return endpoints
 }
+
+// PeerEndpoint returns the address on which the backend with the given client
+// endpoint listens for RPCs from its peers, or an error if the endpoint has no
+// such address.
+func PeerEndpoint(endpoint string) (string, error) {
+	address, err := OffsetAddress(endpoint, peerPortOffset)
+	if err != nil {
+		return "", fmt.Errorf("invalid endpoint %q: %v", endpoint, err)
+	}
+	return address, nil
+}
+
+// OffsetAddress returns the address with the same host as the given one
+// ("localhost" if it has none) and its port plus offset, or an error if the
+// address isn't a host and a port or the new port is out of range.
+func OffsetAddress(address string, offset int) (string, error) {
+	host, port, err := net.SplitHostPort(address)
+	if err != nil {
+		return "", err
+	}
+	n, err := strconv.Atoi(port)
+	if err != nil {
+		return "", fmt.Errorf("invalid port %q", port)
+	}
+	if n+offset <= 0 || n+offset > 65535 {
+		return "", fmt.Errorf("port %d plus %d is out of range", n, offset)
+	}
+	if host == "" {
+		host = "localhost"
+	}
+	return net.JoinHostPort(host, strconv.Itoa(n+offset)), nil
+}
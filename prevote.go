@@ -0,0 +1,107 @@
+package main
+
+// The prevote.go file implements the Pre-Vote extension, as described in
+// section 9.6 of Diego Ongaro's dissertation "Consensus: Bridging Theory and
+// Practice". A node whose election timer fires first asks its peers whether
+// they would vote for it, without incrementing its term. Only if a majority
+// would does it start a real election, so a node that was partitioned away
+// can't force a healthy leader to step down when it rejoins.
+
+// =================================== PRE-VOTE ===============================
+
+/*
+ * SetPreVote sets whether the node runs a pre-vote before each election. Must
+ * be called before Start.
+ */
+func (node *ConsensusModule) SetPreVote(enabled bool) {
+	node.mu.Lock()
+	defer node.mu.Unlock()
+
+	node.preVote = enabled
+}
+
+/*
+ * StartPreVote asks every peer whether it would vote for the node in the next
+ * term. The node stays a follower in its current term; it starts a real
+ * election once a quorum answers yes, unless it hears from a leader (or votes
+ * for another candidate) first.
+ */
+func (node *ConsensusModule) StartPreVote() {
+	node.mu.Lock()
+	defer node.mu.Unlock()
+
+	// The node may have won an election since its timer fired. A candidate
+	// whose election timed out goes back to being a follower until the
+	// pre-vote for its next election succeeds.
+	if node.state != FOLLOWER && node.state != CANDIDATE {
+		return
+	}
+	node.state = FOLLOWER
+	node.electionResetEvent = node.runtime.Now()
+	start := node.electionResetEvent
+	term := node.currentTerm
+
+	// The round is still on if nothing has reset the election timer since.
+	votes := 1
+	stillRunning := func() bool {
+		return node.state == FOLLOWER && node.currentTerm == term &&
+			node.electionResetEvent.Equal(start) && !node.hasQuorum(votes)
+	}
+
+	if node.hasQuorum(votes) {
+		node.startElection()
+		return
+	}
+
+	args := RequestVoteArgs{
+		Term:         term + 1,
+		CandidateID:  node.id,
+		LastLogIndex: node.lastLogIndex(),
+		LastLogTerm:  node.lastLogTerm(),
+		PreVote:      true,
+	}
+	for _, peer := range node.voterPeers() {
+		peer := peer
+		node.runtime.Go(func() {
+			var reply RequestVoteReply
+			if err := node.DoRPC(peer, "ConsensusModule.RequestVote", args, &reply); err != nil {
+				return
+			}
+
+			node.mu.Lock()
+			defer node.mu.Unlock()
+
+			if reply.Term > node.currentTerm {
+				node.BecomeFollower(reply.Term)
+				return
+			}
+			if !stillRunning() || !reply.VoteGranted {
+				return
+			}
+
+			votes += 1
+			if node.hasQuorum(votes) {
+				node.startElection()
+			}
+		})
+	}
+
+	// If the pre-vote doesn't succeed, the node tries again after another
+	// timeout.
+	node.runtime.Go(node.StartElectionTimer)
+}
+
+/*
+ * handlePreVote answers a pre-vote request. The vote would be granted if the
+ * candidate's next term is ahead of ours, its log is at least as up-to-date
+ * as ours and we haven't heard from a leader within the minimum election
+ * timeout. Nothing is changed or persisted.
+ */
+func (node *ConsensusModule) handlePreVote(args RequestVoteArgs, reply *RequestVoteReply) {
+	heardFromLeader := node.state == LEADER ||
+		(node.leaderId != -1 && node.runtime.Now().Sub(node.electionResetEvent) < minElectionTimeout)
+
+	reply.Term = node.currentTerm
+	reply.VoteGranted = args.Term > node.currentTerm && !heardFromLeader &&
+		node.isUpToDate(args.LastLogIndex, args.LastLogTerm)
+}
@@ -4,11 +4,9 @@ package main
 // Understandable Consensus Algorithm" by Diego Ongaro and John Ousterhout.
 
 import (
-	"fmt"
-	"math/rand"
-	"net"
-	"net/rpc"
-	"os"
+	"log"
+	"sort"
+	"strconv"
 	"sync"
 	"time"
 )
@@ -26,6 +24,23 @@ const (
 	DEAD      NodeState = 3
 )
 
+/*
+ * String returns the name of the state, as reported by Admin.Status.
+ */
+func (state NodeState) String() string {
+	switch state {
+	case FOLLOWER:
+		return "follower"
+	case CANDIDATE:
+		return "candidate"
+	case LEADER:
+		return "leader"
+	case DEAD:
+		return "dead"
+	}
+	return "unknown"
+}
+
 // ============================= CONSENSUS MODULE =============================
 
 // ConsensusModule represents an instance of a node in the raft algorithm.
@@ -34,7 +49,13 @@ type ConsensusModule struct {
 	id          int        // ID of the current node
 	currentTerm int        // Latest term node has seen
 	votedFor    int        // Candidate that recieve vote in current term
-	log         []LogEntry // Log entries
+	log         []LogEntry // Log entries following the snapshot
+
+	// Snapshot (the log entries it replaced are no longer kept):
+	snapshot        *Snapshot // The latest snapshot, or nil if none was taken
+	snapshotIndex   int       // Index of the last entry included in the snapshot
+	snapshotTerm    int       // Term of the last entry included in the snapshot
+	pendingSnapshot *Snapshot // A snapshot from the leader yet to be passed to the commit channel
 
 	// Volatile state on all nodes:
 	state       NodeState // The current state of the node
@@ -43,85 +64,506 @@ type ConsensusModule struct {
 	votes       int       // The number of votes a node has (used for elections)
 
 	// Volatile state on leaders (reinitialized after election):
-	nextIndex  []int // For each server, index of the next log entry to send to that server
-	matchIndex []int // For each server, index of highest log entry known to be replicated on server
+	nextIndex  map[int]int           // For each server, index of the next log entry to send to that server
+	matchIndex map[int]int           // For each server, index of highest log entry known to be replicated on server
+	progress   map[int]*peerProgress // For each server, the AppendEntries in flight to it (see replication.go)
+	proposals  []LogEntry            // Commands submitted but not yet appended to the log
+
+	// Replication limits (see replication.go)
+	batchEntries int // Most entries sent per AppendEntries
+	batchBytes   int // Approximate most bytes of entries sent per AppendEntries
+	maxInflight  int // Most AppendEntries in flight to a follower
+
+	// Cluster membership (see membership.go):
+	config         Configuration // The latest configuration in the log
+	configIndex    int           // Index of the entry holding config (-1 if it came from the snapshot)
+	snapshotConfig Configuration // The configuration as of the snapshot
 
 	// Election and peers
-	leader  string              // Who the node thinks the leader is
-	peerIds []int               // A list of all other node peers in the cluser
-	peers   map[int]*rpc.Client // A list of all other node peers RPC clients
+	preVote        bool      // Whether elections start with a pre-vote (see prevote.go)
+	leaderId       int       // Who the node thinks the leader is (-1 if unknown)
+	transferTarget int       // The node leadership is being handed to (-1 if none)
+	leaderContact  time.Time // When the node last heard from the leader
+	leaderCommit   int       // The leader's commitIndex as of leaderContact
+	peerIds        []int     // A list of all other node peers in the cluser
+	transport      Transport // How RPCs reach the peers (and admin clients reach us)
+	runtime        Runtime   // The node's clock, randomness and goroutines (see runtime.go)
+
+	// Durable storage (nil if the node keeps its state in memory only)
+	storage *Storage
+
+	// What the node counts as it runs (see RegisterMetrics)
+	metrics *raftMetrics
+
+	// The checksums of the database the node's entries are applied to (nil if
+	// not kept; see checksum.go)
+	checksums *ChecksumLog
 
 	// Concurrency and timing
 	mu                 sync.Mutex           // A mutex to protect node data
 	electionResetEvent time.Time            // Time of last election
 	commitChannel      chan<- EntryToCommit // The channel that the node will pass committed log entries
+	newCommitReady     Signal               // Signals that commitIndex has advanced
 }
 
-// ======================= COMMUNICATION TO OTHER PEERS =======================
+/*
+ * NewConsensusModule initializes a new node with the given ID. The node starts
+ * with an empty configuration; it learns the members of the cluster from its
+ * log (see Restore, Bootstrap and membership.go). Committed entries will be
+ * passed to the commitChannel in log order. If storage is non-nil, the node's
+ * persistent state is written to it before the node acts on that state. RPCs
+ * to and from peers go through the transport (see transport.go), and the node
+ * gets the time, random numbers and goroutines from the runtime (see
+ * runtime.go).
+ */
+func NewConsensusModule(id int, storage *Storage, transport Transport, runtime Runtime, commitChannel chan<- EntryToCommit) *ConsensusModule {
+	node := &ConsensusModule{
+		id:             id,
+		votedFor:       -1,
+		log:            make([]LogEntry, 0),
+		state:          FOLLOWER,
+		leaderId:       -1,
+		transferTarget: -1,
+		leaderCommit:   -1,
+		snapshotIndex:  -1,
+		snapshotTerm:   -1,
+		commitIndex:    -1,
+		lastApplied:    -1,
+		nextIndex:      make(map[int]int),
+		matchIndex:     make(map[int]int),
+		progress:       make(map[int]*peerProgress),
+		batchEntries:   defaultBatchEntries,
+		batchBytes:     defaultBatchBytes,
+		maxInflight:    defaultMaxInflight,
+		config:         Configuration{},
+		configIndex:    -1,
+		snapshotConfig: Configuration{},
+		peerIds:        []int{},
+		transport:      transport,
+		runtime:        runtime,
+		storage:        storage,
+		metrics:        newRaftMetrics(),
+		commitChannel:  commitChannel,
+		newCommitReady: runtime.NewSignal(),
+	}
+
+	if err := transport.Register("ConsensusModule", node); err != nil {
+		log.Fatalln("[ConsensusModule]", err)
+	}
+
+	return node
+}
 
-func (node *ConsensusModule) GetPeer(peer int) *rpc.Client {
+/*
+ * Restore sets the node's persistent state to the state recovered from its
+ * storage. The snapshot and the entries up to the recovered commit index are
+ * considered applied, so the caller must have already applied them to its
+ * state machine (see Reconstruct). Must be called before Start.
+ */
+func (node *ConsensusModule) Restore(state *PersistentState) {
 	node.mu.Lock()
 	defer node.mu.Unlock()
 
-	return node.peers[peer]
+	if state.Snapshot != nil {
+		node.snapshot = state.Snapshot
+		node.snapshotIndex = state.Snapshot.LastIncludedIndex
+		node.snapshotTerm = state.Snapshot.LastIncludedTerm
+		node.snapshotConfig = state.Snapshot.Configuration
+	}
+
+	node.currentTerm = state.CurrentTerm
+	node.votedFor = state.VotedFor
+	node.log = state.Log.Entries
+	node.commitIndex = state.CommitIndex
+	node.lastApplied = state.CommitIndex
+	node.updateConfig()
+}
+
+/*
+ * Start starts the node as a follower; it starts the election timer and the
+ * goroutine that passes committed entries to the commit channel.
+ */
+func (node *ConsensusModule) Start() {
+	node.mu.Lock()
+	node.electionResetEvent = node.runtime.Now()
+	node.mu.Unlock()
+
+	node.runtime.Go(node.StartElectionTimer)
+	node.runtime.Go(node.commitChanSender)
 }
 
-func (node *ConsensusModule) SetPeer(peer int, client *rpc.Client) {
+/*
+ * Stop stops the node for good. The node moves to the DEAD state, in which
+ * its timers and loops exit and it ignores RPCs; its storage is synced and
+ * closed, and its transport stops serving and calling peers. Committed
+ * entries that weren't passed to the commit channel yet are dropped (they are
+ * replayed from storage on restart), and the channel is closed.
+ */
+func (node *ConsensusModule) Stop() {
+	node.mu.Lock()
+	if node.state == DEAD {
+		node.mu.Unlock()
+		return
+	}
+	node.state = DEAD
+	node.leaderId = -1
+	node.proposals = nil
+	node.transferTarget = -1
+
+	// The persist functions skip a node without storage, so replies that
+	// are still coming in can't write to the closed log.
+	if node.storage != nil {
+		if err := node.storage.Close(); err != nil {
+			log.Println("[ConsensusModule] Stop", err)
+		}
+		node.storage = nil
+	}
+	node.mu.Unlock()
+
+	node.signalCommit()
+	if err := node.transport.Close(); err != nil {
+		log.Println("[ConsensusModule] Stop", err)
+	}
+	log.Println("[ConsensusModule] Stopped")
+}
+
+// ============================== CLIENT COMMANDS =============================
+
+/*
+ * Submit appends a new command to the leader's log, along with any others
+ * submitted at the same moment (see replication.go). It returns the index and
+ * term the new entry will have and whether this node is the leader; if it
+ * isn't, the command is ignored and the client should try another node.
+ */
+func (node *ConsensusModule) Submit(command *Command) (int, int, bool) {
 	node.mu.Lock()
 	defer node.mu.Unlock()
 
-	node.peers[peer] = client
+	// A leader handing off leadership stops taking new commands, so that the
+	// target can catch up.
+	if node.state != LEADER || node.transferTarget != -1 {
+		return -1, -1, false
+	}
+
+	return node.propose(command), node.currentTerm, true
 }
 
 /*
- * ConnectToPeer connects to a peer given its ID and network address.
+ * commitChanSender waits for commitIndex to advance and then passes every
+ * newly committed entry to the commit channel, in order. A snapshot installed
+ * by the leader is passed on before the entries that follow it.
  */
-func (node *ConsensusModule) ConnectToPeer(peer int, addr net.Addr) error {
-	if node.GetPeer(peer) == nil {
-		client, err := rpc.Dial(addr.Network(), addr.String())
-		if err != nil {
-			return err
+func (node *ConsensusModule) commitChanSender() {
+	for {
+		node.newCommitReady.Wait()
+		node.mu.Lock()
+		if node.state == DEAD {
+			node.mu.Unlock()
+			close(node.commitChannel)
+			return
+		}
+		snapshot := node.pendingSnapshot
+		node.pendingSnapshot = nil
+		if snapshot != nil && snapshot.LastIncludedIndex > node.lastApplied {
+			node.lastApplied = snapshot.LastIncludedIndex
+		} else {
+			snapshot = nil
+		}
+
+		lastApplied := node.lastApplied
+		var entries []LogEntry
+		if node.commitIndex > node.lastApplied {
+			entries = node.entriesBetween(node.lastApplied+1, node.commitIndex+1)
+			node.lastApplied = node.commitIndex
 		}
+		node.mu.Unlock()
 
-		node.SetPeer(peer, client)
+		if snapshot != nil {
+			node.commitChannel <- EntryToCommit{
+				Term:     snapshot.LastIncludedTerm,
+				Index:    snapshot.LastIncludedIndex,
+				Snapshot: snapshot,
+			}
+		}
+
+		for i, entry := range entries {
+			node.commitChannel <- EntryToCommit{
+				Command: entry.Command,
+				Term:    entry.Term,
+				Index:   lastApplied + i + 1,
+			}
+		}
 	}
+}
 
-	return nil
+/*
+ * signalCommit notifies commitChanSender that commitIndex has advanced. It
+ * never blocks; a pending signal already covers the new entries.
+ */
+func (node *ConsensusModule) signalCommit() {
+	node.newCommitReady.Notify()
+}
+
+// ======================= COMMUNICATION TO OTHER PEERS =======================
+
+/*
+ * ConnectToPeer connects to a peer given its ID and endpoint.
+ */
+func (node *ConsensusModule) ConnectToPeer(peer int, endpoint string) error {
+	return node.transport.Connect(peer, endpoint)
 }
 
 /*
  * DisconnectFromPeer disconnects from a peer given its ID.
  */
 func (node *ConsensusModule) DisconnectFromPeer(peer int) error {
-	if node.GetPeer(peer) != nil {
-		err := node.peers[peer].Close()
-		node.SetPeer(peer, nil)
-		return err
-	}
-	return nil
+	return node.transport.Disconnect(peer)
 }
 
 /*
  * DoRPC performs an RPC to a peer.
  */
 func (node *ConsensusModule) DoRPC(peer int, method string, args, reply interface{}) error {
-	client := node.GetPeer(peer)
+	return node.transport.Call(peer, method, args, reply)
+}
+
+/*
+ * RegisterService registers another RPC service (such as the admin service)
+ * to be served next to the node's own RPC handlers.
+ */
+func (node *ConsensusModule) RegisterService(name string, service interface{}) error {
+	return node.transport.Register(name, service)
+}
+
+/*
+ * ListenForPeers serves RPCs from the other nodes in the cluster (and admin
+ * clients) for the node at the given endpoint.
+ */
+func (node *ConsensusModule) ListenForPeers(endpoint string) error {
+	return node.transport.Listen(endpoint)
+}
+
+// =============================== RPC HANDLERS ===============================
 
-	if client == nil {
-		return fmt.Errorf("Client is nil.")
+/*
+ * RequestVote handles a RequestVote RPC from a candidate. A vote is granted
+ * if the node hasn't voted for anyone else in the candidate's term and the
+ * candidate's log is at least as up-to-date as its own.
+ */
+func (node *ConsensusModule) RequestVote(args RequestVoteArgs, reply *RequestVoteReply) error {
+	node.mu.Lock()
+	defer node.mu.Unlock()
+
+	if node.state == DEAD {
+		return nil
+	}
+
+	// Pre-votes don't change any state; see prevote.go.
+	if args.PreVote {
+		node.handlePreVote(args, reply)
+		return nil
+	}
+
+	// A newer term always turns us into a follower of that term.
+	if args.Term > node.currentTerm {
+		node.BecomeFollower(args.Term)
+	}
+
+	if args.Term == node.currentTerm &&
+		(node.votedFor == -1 || node.votedFor == args.CandidateID) &&
+		node.isUpToDate(args.LastLogIndex, args.LastLogTerm) {
+		reply.VoteGranted = true
+		node.votedFor = args.CandidateID
+		node.persistState()
+		node.electionResetEvent = node.runtime.Now()
+	} else {
+		reply.VoteGranted = false
+	}
+
+	reply.Term = node.currentTerm
+	return nil
+}
+
+/*
+ * AppendEntries handles an AppendEntries RPC from the leader. If the node's
+ * log contains the entry preceding the new ones, any conflicting entries are
+ * truncated, the new entries are appended and the commit index follows the
+ * leader's.
+ */
+func (node *ConsensusModule) AppendEntries(args AppendEntriesArgs, reply *AppendEntriesReply) error {
+	node.mu.Lock()
+	defer node.mu.Unlock()
+
+	if node.state == DEAD {
+		return nil
+	}
+
+	if args.Term > node.currentTerm {
+		node.BecomeFollower(args.Term)
+	}
+
+	reply.Success = false
+	if args.Term == node.currentTerm {
+		// There is a leader in our term, so a candidate steps down.
+		if node.state != FOLLOWER {
+			node.BecomeFollower(args.Term)
+		}
+		node.electionResetEvent = node.runtime.Now()
+		node.leaderId = args.LeaderId
+		node.leaderContact = node.runtime.Now()
+		node.leaderCommit = args.LeaderCommit
+		if args.Checksum != nil && node.checksums != nil {
+			node.checksums.Compare(args.LeaderId, *args.Checksum)
+		}
+
+		// Entries up to our snapshot are committed, so they match the
+		// leader's; only the entries after it need to be checked.
+		prevLogIndex, prevLogTerm, entries := args.PrevLogIndex, args.PrevLogTerm, args.Entries
+		if prevLogIndex < node.snapshotIndex {
+			skip := node.snapshotIndex - prevLogIndex
+			if skip > len(entries) {
+				skip = len(entries)
+			}
+			prevLogIndex, prevLogTerm, entries = node.snapshotIndex, node.snapshotTerm, entries[skip:]
+		}
+
+		// Check that our log contains the entry at prevLogIndex with a
+		// matching term.
+		if prevLogIndex <= node.lastLogIndex() && prevLogTerm == node.termAt(prevLogIndex) {
+			reply.Success = true
+
+			// Skip the entries we already have; stop at the first conflict.
+			logIndex := prevLogIndex + 1
+			entriesIndex := 0
+			for logIndex <= node.lastLogIndex() && entriesIndex < len(entries) {
+				if node.termAt(logIndex) != entries[entriesIndex].Term {
+					break
+				}
+				logIndex++
+				entriesIndex++
+			}
+
+			// Truncate the conflicting entries and append the new ones.
+			if entriesIndex < len(entries) {
+				node.appendToLog(logIndex, entries[entriesIndex:])
+			}
+
+			// Only the entries up to the last one the leader sent are known
+			// to match its log; any after it may be stale.
+			commitIndex := args.LeaderCommit
+			if lastNewIndex := prevLogIndex + len(entries); commitIndex > lastNewIndex {
+				commitIndex = lastNewIndex
+			}
+			if commitIndex > node.commitIndex {
+				node.commitIndex = commitIndex
+				node.persistCommitIndex()
+				node.signalCommit()
+			}
+		} else {
+			node.findConflict(prevLogIndex, reply)
+		}
+	}
+
+	reply.Term = node.currentTerm
+	return nil
+}
+
+/*
+ * findConflict fills in where our log diverges from the leader's, for an
+ * AppendEntries we rejected at prevLogIndex. If our log is too short, the
+ * leader should continue from its end; otherwise it can skip every entry of
+ * the conflicting term at once instead of backing up one entry per round trip.
+ */
+func (node *ConsensusModule) findConflict(prevLogIndex int, reply *AppendEntriesReply) {
+	if prevLogIndex > node.lastLogIndex() {
+		reply.ConflictTerm = -1
+		reply.ConflictIndex = node.lastLogIndex() + 1
+		return
+	}
+
+	reply.ConflictTerm = node.termAt(prevLogIndex)
+	reply.ConflictIndex = prevLogIndex
+	for reply.ConflictIndex-1 > node.snapshotIndex && node.termAt(reply.ConflictIndex-1) == reply.ConflictTerm {
+		reply.ConflictIndex--
+	}
+}
+
+/*
+ * InstallSnapshot handles an InstallSnapshot RPC from the leader. The node's
+ * log is replaced by the snapshot, keeping only the entries that follow it if
+ * they agree with the snapshot, and the snapshot is passed on to the state
+ * machine through the commit channel.
+ */
+func (node *ConsensusModule) InstallSnapshot(args InstallSnapshotArgs, reply *InstallSnapshotReply) error {
+	node.mu.Lock()
+	defer node.mu.Unlock()
+
+	if node.state == DEAD {
+		return nil
+	}
+
+	if args.Term > node.currentTerm {
+		node.BecomeFollower(args.Term)
+	}
+
+	reply.Term = node.currentTerm
+	if args.Term < node.currentTerm {
+		return nil
 	}
 
-	return client.Call(method, args, reply)
+	if node.state != FOLLOWER {
+		node.BecomeFollower(args.Term)
+	}
+	node.electionResetEvent = node.runtime.Now()
+	node.leaderId = args.LeaderId
+
+	// Everything up to our commit index is already known; an older snapshot
+	// has nothing new for us.
+	if args.LastIncludedIndex <= node.commitIndex {
+		return nil
+	}
+
+	// Keep the entries that follow the snapshot if our log agrees with it at
+	// the last included entry; otherwise the whole log is replaced.
+	if args.LastIncludedIndex <= node.lastLogIndex() &&
+		node.termAt(args.LastIncludedIndex) == args.LastIncludedTerm {
+		node.log = node.entriesBetween(args.LastIncludedIndex+1, node.lastLogIndex()+1)
+	} else {
+		node.log = make([]LogEntry, 0)
+	}
+
+	snapshot := &Snapshot{
+		LastIncludedIndex: args.LastIncludedIndex,
+		LastIncludedTerm:  args.LastIncludedTerm,
+		Configuration:     args.Configuration,
+		Data:              args.Data,
+	}
+	node.snapshot = snapshot
+	node.snapshotIndex = snapshot.LastIncludedIndex
+	node.snapshotTerm = snapshot.LastIncludedTerm
+	node.snapshotConfig = snapshot.Configuration
+	node.commitIndex = snapshot.LastIncludedIndex
+	node.updateConfig()
+	node.persistSnapshot()
+
+	node.pendingSnapshot = snapshot
+	node.signalCommit()
+
+	return nil
 }
 
 // ================================= LOG INFO =================================
 
+// Log indices count every entry since the start of the log, including the
+// ones a snapshot replaced; node.log[i] holds the entry at index
+// snapshotIndex+1+i.
+
 /*
  * lastLogTerm returns the last log term of the node.
  */
 func (node *ConsensusModule) lastLogTerm() int {
 	if len(node.log) == 0 {
-		return -1
+		return node.snapshotTerm
 	}
 	return node.log[len(node.log)-1].Term
 }
@@ -130,7 +572,55 @@ func (node *ConsensusModule) lastLogTerm() int {
  * lastLogIndex returns the last log index of the node.
  */
 func (node *ConsensusModule) lastLogIndex() int {
-	return len(node.log) - 1
+	return node.snapshotIndex + len(node.log)
+}
+
+/*
+ * isUpToDate returns true if a log ending with the given index and term is at
+ * least as up-to-date as the node's log: its last term is later than ours, or
+ * the terms match and it is at least as long.
+ */
+func (node *ConsensusModule) isUpToDate(lastLogIndex, lastLogTerm int) bool {
+	ourLastLogTerm := node.lastLogTerm()
+	return lastLogTerm > ourLastLogTerm ||
+		(lastLogTerm == ourLastLogTerm && lastLogIndex >= node.lastLogIndex())
+}
+
+/*
+ * termAt returns the term of the entry at the given index, which must either
+ * be in the log or be the last index included in the snapshot.
+ */
+func (node *ConsensusModule) termAt(index int) int {
+	if index == node.snapshotIndex {
+		return node.snapshotTerm
+	}
+	return node.log[index-node.snapshotIndex-1].Term
+}
+
+/*
+ * entriesBetween returns a copy of the entries from index start up to (but
+ * not including) index end.
+ */
+func (node *ConsensusModule) entriesBetween(start, end int) []LogEntry {
+	entries := make([]LogEntry, end-start)
+	copy(entries, node.log[start-node.snapshotIndex-1:end-node.snapshotIndex-1])
+	return entries
+}
+
+/*
+ * appendToLog writes entries to the log starting at the given index, replacing
+ * any entries at or after it, and persists them.
+ */
+func (node *ConsensusModule) appendToLog(index int, entries []LogEntry) {
+	truncated := index <= node.lastLogIndex()
+	node.log = append(node.log[:index-node.snapshotIndex-1], entries...)
+	node.persistEntries(index, entries)
+
+	// A configuration takes effect as soon as it is in the log, and a
+	// truncated one no longer applies.
+	if truncated || hasConfiguration(entries) {
+		node.updateConfig()
+	}
 }
 
 /*
@@ -138,18 +628,75 @@ func (node *ConsensusModule) lastLogIndex() int {
  */
 func (node *ConsensusModule) UpdatePeerIndicies() {
 	for _, peer := range node.peerIds {
-		node.nextIndex[peer] = len(node.log)
-		node.matchIndex[peer] = -1
+		node.resetProgress(peer)
+	}
+}
+
+// ============================== LOG COMPACTION ==============================
+
+/*
+ * LogSize returns the number of entries that have been applied but are still
+ * kept in the log, and their approximate size in bytes. These are the entries
+ * a snapshot taken now would let the node discard.
+ */
+func (node *ConsensusModule) LogSize() (int, int) {
+	node.mu.Lock()
+	defer node.mu.Unlock()
+
+	// A snapshot from the leader may not have been applied yet.
+	count := node.lastApplied - node.snapshotIndex
+	if count < 0 {
+		count = 0
+	}
+
+	size := 0
+	for _, entry := range node.log[:count] {
+		size += entry.Size()
+	}
+	return count, size
+}
+
+/*
+ * Snapshot tells the node that the state machine's state after applying every
+ * entry up to and including index is captured in data. The snapshot is stored
+ * and the log entries it covers are discarded.
+ */
+func (node *ConsensusModule) Snapshot(index int, data []byte) {
+	node.mu.Lock()
+	defer node.mu.Unlock()
+
+	// Only entries that were already applied can be part of a snapshot.
+	if node.state == DEAD || index <= node.snapshotIndex || index > node.lastApplied {
+		return
+	}
+
+	snapshot := &Snapshot{
+		LastIncludedIndex: index,
+		LastIncludedTerm:  node.termAt(index),
+		Configuration:     node.configAt(index),
+		Data:              data,
 	}
+	node.log = node.entriesBetween(index+1, node.lastLogIndex()+1)
+	node.snapshot = snapshot
+	node.snapshotIndex = snapshot.LastIncludedIndex
+	node.snapshotTerm = snapshot.LastIncludedTerm
+	node.snapshotConfig = snapshot.Configuration
+	node.updateConfig()
+	node.persistSnapshot()
+
+	log.Printf("[ConsensusModule] Took snapshot at index %d, %d entries left in log", index, len(node.log))
 }
 
 // ============================= ELECTION PROCESS =============================
 
+// minElectionTimeout is the shortest election timeout a node can pick.
+const minElectionTimeout = 100 * time.Millisecond
+
 /*
  * getElectionTimeout returns a random election timeout between 100-200ms.
  */
 func (node *ConsensusModule) getElectionTimeout() time.Duration {
-	return time.Millisecond * time.Duration(100+rand.Intn(100))
+	return minElectionTimeout + time.Millisecond*time.Duration(node.runtime.Intn(100))
 }
 
 /*
@@ -163,28 +710,44 @@ func (node *ConsensusModule) StartElectionTimer() {
 	term := node.currentTerm
 	node.mu.Unlock()
 
-	// Make a new ticker for 10 milliseconds.
-	ticker := time.NewTicker(10 * time.Millisecond)
-	defer ticker.Stop()
+	// Check the timer every 10 milliseconds.
 	for {
-		// Blocks until we receive a message in this ticker channel.
-		<-ticker.C
+		node.runtime.Sleep(10 * time.Millisecond)
 		node.mu.Lock()
-		defer node.mu.Unlock()
 
-		// In followers, this loop should run forever. There are two ways in
+		// In followers, this loop should run forever. There are three ways in
 		// which the loop is broken...
 
-		// (1) if the current term is not the term we started with (new leader)
+		// (1) if the node became the leader, it no longer needs the timer
+		if node.state != CANDIDATE && node.state != FOLLOWER {
+			node.mu.Unlock()
+			return
+		}
+
+		// (2) if the current term is not the term we started with (new leader)
 		if node.currentTerm != term {
+			node.mu.Unlock()
 			return
 		}
 
-		// (2) if we haven't received any heartbeats from the leader within our
-		// timeout duration, in which case we start a new election process
-		last := time.Since(node.electionResetEvent)
+		// (3) if we haven't received any heartbeats from the leader within our
+		// timeout duration, in which case we start a new election process.
+		// Only voters start elections; learners and nodes outside the
+		// configuration wait to be promoted, added (or stay removed).
+		last := node.runtime.Now().Sub(node.electionResetEvent)
+		if last >= duration && !node.isVoter(node.id) {
+			node.electionResetEvent = node.runtime.Now()
+			node.mu.Unlock()
+			continue
+		}
+		preVote := node.preVote
+		node.mu.Unlock()
 		if last >= duration {
-			node.StartElectionProcess()
+			if preVote {
+				node.StartPreVote()
+			} else {
+				node.StartElectionProcess()
+			}
 			return
 		}
 	}
@@ -202,23 +765,23 @@ func (node *ConsensusModule) prepareRequestVoteForPeer(peer, currTerm int) {
 
 	// Create a RequestVoteArgs message.
 	requestVoteArgs := RequestVoteArgs{
-		term:         currTerm,
-		candidateID:  node.id,
-		lastLogIndex: lastLogIndex,
-		lastLogTerm:  lastLogTerm,
+		Term:         currTerm,
+		CandidateID:  node.id,
+		LastLogIndex: lastLogIndex,
+		LastLogTerm:  lastLogTerm,
 	}
 
 	var requestVoteReply RequestVoteReply
 
-	err := node.DoRPC(peer, "RequestVote", requestVoteArgs, &requestVoteReply)
+	err := node.DoRPC(peer, "ConsensusModule.RequestVote", requestVoteArgs, &requestVoteReply)
 	if err == nil {
 		node.mu.Lock()
 		defer node.mu.Unlock()
 
 		// If the reply's term is greater tham ours, stop being the candidate
 		// and become a follower again.
-		if requestVoteReply.term > currTerm {
-			node.BecomeFollower(requestVoteReply.term)
+		if requestVoteReply.Term > currTerm {
+			node.BecomeFollower(requestVoteReply.Term)
 		}
 
 		// Continuing on from the last if statement, if we are no longer a
@@ -229,9 +792,9 @@ func (node *ConsensusModule) prepareRequestVoteForPeer(peer, currTerm int) {
 
 		// If the reply's term matches our term and they voted for us, increase
 		// the vote count and check if we have a quorum.
-		if requestVoteReply.term == currTerm && requestVoteReply.voteGranted {
+		if requestVoteReply.Term == currTerm && requestVoteReply.VoteGranted {
 			node.votes += 1
-			if (node.votes * 2) > len(node.peers) {
+			if node.hasQuorum(node.votes) {
 				node.BecomeLeader()
 				return
 			}
@@ -247,6 +810,17 @@ func (node *ConsensusModule) StartElectionProcess() {
 	node.mu.Lock()
 	defer node.mu.Unlock()
 
+	if node.state == DEAD {
+		return
+	}
+	node.startElection()
+}
+
+/*
+ * startElection does the work of StartElectionProcess; the caller must hold
+ * the lock.
+ */
+func (node *ConsensusModule) startElection() {
 	// 1. Change the state of the current node to become a candidate.
 	node.state = CANDIDATE
 
@@ -257,23 +831,34 @@ func (node *ConsensusModule) StartElectionProcess() {
 	// 3. Note the current term and the time.
 	node.currentTerm += 1
 	term := node.currentTerm
-	node.electionResetEvent = time.Now()
+	node.electionResetEvent = node.runtime.Now()
+	node.persistState()
+	node.metrics.electionsStarted.Inc()
+	log.Println("[ConsensusModule] Starting an election for term", term)
+
+	// 4. A node without peers has already won the election.
+	if node.hasQuorum(node.votes) {
+		node.BecomeLeader()
+		return
+	}
 
-	// 4. For each peer, send them for a request vote message.
-	for _, peer := range node.peerIds {
-		go node.prepareRequestVoteForPeer(peer, term)
+	// 5. For each voting peer, send them for a request vote message.
+	for _, peer := range node.voterPeers() {
+		peer := peer
+		node.runtime.Go(func() { node.prepareRequestVoteForPeer(peer, term) })
 	}
 
-	go node.StartElectionTimer()
+	node.runtime.Go(node.StartElectionTimer)
 }
 
 // ============================ LEADER OPERATIONS =============================
 
 /*
- * true if the number of votes constitutes a quorum (majority)
+ * true if the number of votes constitutes a quorum (majority) of the voting
+ * members of the latest configuration
  */
 func (node *ConsensusModule) hasQuorum(votes int) bool {
-	return (votes*2 > len(node.peerIds)+1)
+	return (votes*2 > node.config.Voters())
 }
 
 func (node *ConsensusModule) checkIfStillLeader() bool {
@@ -287,12 +872,10 @@ func (node *ConsensusModule) checkIfStillLeader() bool {
  * LeaderLoop will run as long as the node is the leader.
  */
 func (node *ConsensusModule) LeaderLoop() {
-	ticker := time.NewTicker(50 * time.Millisecond)
-	defer ticker.Stop()
-
 	for {
 		node.SendHeartbeats()
-		<-ticker.C
+		node.runtime.Sleep(50 * time.Millisecond)
+		node.checkQuorum()
 
 		if !node.checkIfStillLeader() {
 			return
@@ -301,56 +884,93 @@ func (node *ConsensusModule) LeaderLoop() {
 
 }
 
-func (node *ConsensusModule) prepareAppendEntriesForPeer(peer, term int) {
+/*
+ * prepareAppendEntriesForPeer sends a peer the next batch of entries it is
+ * missing (or none, as a heartbeat) and waits for the answer. Returns true if
+ * the peer acknowledged us as the leader of the given term.
+ */
+func (node *ConsensusModule) prepareAppendEntriesForPeer(peer, term int) bool {
 	node.mu.Lock()
-	next := node.nextIndex[peer]
-	prev := next - 1
-	prevLogTerm := -1
-	if prev >= 0 {
-		prevLogTerm = node.log[prev].Term
+	request := node.nextAppendRequest(peer, term, true)
+	node.mu.Unlock()
+
+	if request == nil {
+		return false
 	}
+	return node.sendAppendRequest(peer, term, request)
+}
 
-	entries := node.log[next:]
+/*
+ * backtrack returns the nextIndex to try for a peer that rejected the entries
+ * starting at next. If we have entries of the peer's conflicting term, the
+ * peer's log can match ours up to the last of them; otherwise none of the
+ * peer's entries of that term can match, and we skip them all.
+ */
+func (node *ConsensusModule) backtrack(next int, reply AppendEntriesReply) int {
+	if reply.ConflictIndex < 0 || reply.ConflictIndex >= next {
+		return next - 1
+	}
 
-	appendEntriesArgs := AppendEntriesArgs{
-		term:         term,
-		leaderId:     node.id,
-		prevLogIndex: prev,
-		prevLogTerm:  prevLogTerm,
-		entries:      entries,
-		leaderCommit: node.commitIndex,
+	if reply.ConflictTerm != -1 {
+		for index := next - 1; index > node.snapshotIndex; index-- {
+			term := node.termAt(index)
+			if term == reply.ConflictTerm {
+				return index + 1
+			}
+			if term < reply.ConflictTerm {
+				break
+			}
+		}
 	}
+	return reply.ConflictIndex
+}
 
+/*
+ * prepareInstallSnapshotForPeer sends our latest snapshot to a peer whose
+ * next entry has already been compacted away. Returns true if the peer
+ * acknowledged us as the leader of the given term.
+ */
+func (node *ConsensusModule) prepareInstallSnapshotForPeer(peer, term int) bool {
+	node.mu.Lock()
+	snapshot := node.snapshot
+	args := InstallSnapshotArgs{
+		Term:              term,
+		LeaderId:          node.id,
+		LastIncludedIndex: snapshot.LastIncludedIndex,
+		LastIncludedTerm:  snapshot.LastIncludedTerm,
+		Configuration:     snapshot.Configuration,
+		Data:              snapshot.Data,
+	}
 	node.mu.Unlock()
 
-	var reply AppendEntriesReply
-	err := node.DoRPC(peer, "AppendEntries", appendEntriesArgs, &reply)
-
+	var reply InstallSnapshotReply
+	err := node.DoRPC(peer, "ConsensusModule.InstallSnapshot", args, &reply)
 	if err != nil {
-		fmt.Println(err)
-		os.Exit(1)
-	} else {
-		node.mu.Lock()
-		defer node.mu.Unlock()
-
-		// If the reply's term is greater than our saved term, that
-		// means that the leader is out of sync and is thus no longer
-		// the leader.
-		if reply.term > term {
-			node.BecomeFollower(reply.term)
-			return
+		if err != ErrUnreachable {
+			log.Println("[ConsensusModule] InstallSnapshot", peer, err)
 		}
+		return false
+	}
 
-		if node.state == LEADER && term == reply.term {
-			// If the AppendEntries request was not successful, return the
-			// nextIndex pointer to next - 1.
-			if !reply.success {
-				node.nextIndex[peer] = next - 1
-				return
-			}
-			node.updateEntries(peer, next, entries)
+	node.mu.Lock()
+	defer node.mu.Unlock()
+
+	if reply.Term > term {
+		node.BecomeFollower(reply.Term)
+		return false
+	}
+
+	// The peer now has every entry up to the end of the snapshot.
+	if node.state == LEADER && term == reply.Term {
+		node.heardFrom(peer)
+		if node.matchIndex[peer] < snapshot.LastIncludedIndex {
+			node.matchIndex[peer] = snapshot.LastIncludedIndex
 		}
+		node.nextIndex[peer] = node.matchIndex[peer] + 1
+		node.advanceCommitIndex()
+		return true
 	}
+	return false
 }
 
 /*
@@ -363,25 +983,31 @@ func (node *ConsensusModule) SendHeartbeats() {
 
 	// Concurrently prepare to send AppendEntries messages to our peers.
 	for _, peer := range node.peerIds {
-		go node.prepareAppendEntriesForPeer(peer, currTerm)
+		peer := peer
+		node.runtime.Go(func() { node.prepareAppendEntriesForPeer(peer, currTerm) })
 	}
 
 }
 
-// updateEntries updated our node's commit index to match that of our peers'
-func (node *ConsensusModule) updateEntries(peer, next int, entries []LogEntry) {
-	node.nextIndex[peer] = next + len(entries)
-	node.matchIndex[peer] = node.nextIndex[peer] - 1
-
-	commitIndex := node.commitIndex + 1
-
-	for commitIndex < len(node.log) {
-		commitIndex++
-		if node.log[commitIndex].Term == node.currentTerm {
-			count := 1
+/*
+ * advanceCommitIndex moves the commit index to the highest entry of the
+ * current term that is replicated on a quorum of nodes, and signals the commit
+ * channel sender if it moved.
+ */
+func (node *ConsensusModule) advanceCommitIndex() {
+	savedCommitIndex := node.commitIndex
+
+	for commitIndex := node.commitIndex + 1; commitIndex <= node.lastLogIndex(); commitIndex++ {
+		if node.termAt(commitIndex) == node.currentTerm {
+			// A leader that is removing itself doesn't count its own entry.
+			count := 0
+			if node.isVoter(node.id) {
+				count = 1
+			}
 
-			// Go through all our peer's indicies to check which are greater than
-			for _, currPeer := range node.peerIds {
+			// Go through all our voting peer's indicies to check which are
+			// greater than (learners don't count)
+			for _, currPeer := range node.voterPeers() {
 				if node.matchIndex[currPeer] >= commitIndex {
 					count += 1
 				}
@@ -393,6 +1019,246 @@ func (node *ConsensusModule) updateEntries(peer, next int, entries []LogEntry) {
 			}
 		}
 	}
+
+	if node.commitIndex != savedCommitIndex {
+		node.persistCommitIndex()
+		node.signalCommit()
+
+		// A leader that removed itself steps down once the removal is
+		// committed.
+		if !node.isMember(node.id) && node.configIndex <= node.commitIndex {
+			log.Println("[ConsensusModule] Removed from the cluster, stepping down")
+			node.BecomeFollower(node.currentTerm)
+		}
+	}
+}
+
+// ================================ INTROSPECTION =============================
+
+/*
+ * Status returns a snapshot of the node's Raft state for operators. Only the
+ * leader tracks its peers' logs, so on other nodes the peers' NextIndex and
+ * MatchIndex are -1; the connection health comes from the transport.
+ */
+func (node *ConsensusModule) Status() NodeStatus {
+	node.mu.Lock()
+	status := NodeStatus{
+		ID:            node.id,
+		State:         node.state.String(),
+		Learner:       node.config[node.id].Learner,
+		CurrentTerm:   node.currentTerm,
+		VotedFor:      node.votedFor,
+		LeaderID:      node.leaderId,
+		CommitIndex:   node.commitIndex,
+		LastApplied:   node.lastApplied,
+		LastLogIndex:  node.lastLogIndex(),
+		LogLength:     len(node.log),
+		SnapshotIndex: node.snapshotIndex,
+	}
+	if member, ok := node.config[node.id]; ok {
+		status.Endpoint = member.Endpoint
+	}
+	if member, ok := node.config[node.leaderId]; ok {
+		status.LeaderEndpoint = member.Endpoint
+	}
+	for _, peer := range node.peerIds {
+		peerStatus := PeerStatus{
+			ID:         peer,
+			Endpoint:   node.config[peer].Endpoint,
+			Learner:    node.config[peer].Learner,
+			NextIndex:  -1,
+			MatchIndex: -1,
+		}
+		if node.state == LEADER {
+			peerStatus.NextIndex = node.nextIndex[peer]
+			peerStatus.MatchIndex = node.matchIndex[peer]
+		}
+		status.Peers = append(status.Peers, peerStatus)
+	}
+	transport := node.transport
+	node.mu.Unlock()
+
+	status.Checksum = ChecksumPoint{Index: -1}
+	if node.checksums != nil {
+		status.Checksum, _ = node.checksums.Latest()
+		status.Divergence = node.checksums.Divergence()
+	}
+
+	// The transport has its own lock, so it is asked without holding ours.
+	for i := range status.Peers {
+		health := transport.Health(status.Peers[i].ID)
+		status.Peers[i].Connected = health.Connected
+		status.Peers[i].Failures = health.Failures
+		status.Peers[i].LastError = health.LastError
+	}
+	sort.Slice(status.Peers, func(i, j int) bool { return status.Peers[i].ID < status.Peers[j].ID })
+	return status
+}
+
+/*
+ * CommitIndex returns the index of the highest log entry known to be
+ * committed.
+ */
+func (node *ConsensusModule) CommitIndex() int {
+	node.mu.Lock()
+	defer node.mu.Unlock()
+
+	return node.commitIndex
+}
+
+// raftMetrics represents the counters and histograms a node updates as it
+// runs. Its other metrics are read from its state when they are scraped.
+type raftMetrics struct {
+	electionsStarted *Counter   // Elections started by this node
+	electionsWon     *Counter   // Elections won by this node
+	appendLatency    *Histogram // AppendEntries round trips, by peer
+	appendFailures   *Counter   // AppendEntries that got no reply, by peer
+}
+
+/*
+ * newRaftMetrics initializes a node's counters and histograms.
+ */
+func newRaftMetrics() *raftMetrics {
+	return &raftMetrics{
+		electionsStarted: NewCounter("musicdb_raft_elections_started_total",
+			"Elections this node started (after winning a pre-vote, if enabled)."),
+		electionsWon: NewCounter("musicdb_raft_elections_won_total",
+			"Elections this node won."),
+		appendLatency: NewHistogram("musicdb_raft_append_entries_duration_seconds",
+			"Round trip time of the AppendEntries RPCs the leader sent, by peer.", latencyBuckets, "peer"),
+		appendFailures: NewCounter("musicdb_raft_append_entries_failures_total",
+			"AppendEntries RPCs that failed or timed out, by peer.", "peer"),
+	}
+}
+
+/*
+ * RegisterMetrics adds the node's metrics to a registry: the counters it
+ * keeps, and gauges of its term, role, indexes, log size, whether its
+ * database diverged and, on the leader, how far behind each peer's log is.
+ */
+func (node *ConsensusModule) RegisterMetrics(registry *Registry) {
+	gauge := func(name, help string, value func() int) *GaugeFunc {
+		return NewGaugeFunc(name, help, nil, func(emit func(float64, ...string)) {
+			node.mu.Lock()
+			v := value()
+			node.mu.Unlock()
+			emit(float64(v))
+		})
+	}
+
+	registry.Register(
+		gauge("musicdb_raft_term", "The node's current term.",
+			func() int { return node.currentTerm }),
+		gauge("musicdb_raft_is_leader", "1 if the node is the leader, 0 otherwise.",
+			func() int {
+				if node.state == LEADER {
+					return 1
+				}
+				return 0
+			}),
+		gauge("musicdb_raft_commit_index", "Index of the highest log entry known to be committed.",
+			func() int { return node.commitIndex }),
+		gauge("musicdb_raft_last_log_index", "Index of the last entry in the log.",
+			func() int { return node.lastLogIndex() }),
+		gauge("musicdb_raft_commit_lag_entries", "Entries in the log not yet known to be committed.",
+			func() int { return node.lastLogIndex() - node.commitIndex }),
+		gauge("musicdb_raft_snapshot_index", "Index of the last entry included in the snapshot.",
+			func() int { return node.snapshotIndex }),
+		gauge("musicdb_raft_log_entries", "Entries kept in the log after the snapshot.",
+			func() int { return len(node.log) }),
+		gauge("musicdb_raft_log_bytes", "Approximate size of the entries kept in the log.",
+			func() int {
+				size := 0
+				for _, entry := range node.log {
+					size += entry.Size()
+				}
+				return size
+			}),
+		NewGaugeFunc("musicdb_raft_peer_lag_entries",
+			"On the leader, entries in its log that each peer isn't known to have.", []string{"peer"},
+			func(emit func(float64, ...string)) {
+				node.mu.Lock()
+				defer node.mu.Unlock()
+				if node.state != LEADER {
+					return
+				}
+				for _, peer := range node.peerIds {
+					emit(float64(node.lastLogIndex()-node.matchIndex[peer]), strconv.Itoa(peer))
+				}
+			}),
+		NewGaugeFunc("musicdb_raft_divergence_index",
+			"First index at which the node's database was found to differ from the leader's (-1 if it wasn't).", nil,
+			func(emit func(float64, ...string)) {
+				index := -1
+				if node.checksums != nil {
+					if divergence := node.checksums.Divergence(); divergence != nil {
+						index = divergence.Index
+					}
+				}
+				emit(float64(index))
+			}),
+		node.metrics.electionsStarted,
+		node.metrics.electionsWon,
+		node.metrics.appendLatency,
+		node.metrics.appendFailures,
+	)
+}
+
+// ================================ PERSISTENCE ===============================
+
+// The persist functions write the node's persistent state to its storage, if
+// it has any, and must be called with the node's mutex held. A node that can't
+// write its state can't safely keep taking part in the cluster, so a storage
+// error is fatal.
+
+/*
+ * persistState writes currentTerm and votedFor.
+ */
+func (node *ConsensusModule) persistState() {
+	if node.storage == nil {
+		return
+	}
+	if err := node.storage.SaveState(node.currentTerm, node.votedFor); err != nil {
+		log.Fatalln("[ConsensusModule] persistState", err)
+	}
+}
+
+/*
+ * persistEntries writes the log entries starting at the given index.
+ */
+func (node *ConsensusModule) persistEntries(index int, entries []LogEntry) {
+	if node.storage == nil {
+		return
+	}
+	if err := node.storage.SaveEntries(index, entries); err != nil {
+		log.Fatalln("[ConsensusModule] persistEntries", err)
+	}
+}
+
+/*
+ * persistSnapshot writes the snapshot and compacts the stored log to the
+ * entries that follow it.
+ */
+func (node *ConsensusModule) persistSnapshot() {
+	if node.storage == nil {
+		return
+	}
+	err := node.storage.SaveSnapshot(node.snapshot, node.currentTerm, node.votedFor, node.commitIndex, node.log)
+	if err != nil {
+		log.Fatalln("[ConsensusModule] persistSnapshot", err)
+	}
+}
+
+/*
+ * persistCommitIndex writes commitIndex.
+ */
+func (node *ConsensusModule) persistCommitIndex() {
+	if node.storage == nil {
+		return
+	}
+	if err := node.storage.SaveCommitIndex(node.commitIndex); err != nil {
+		log.Fatalln("[ConsensusModule] persistCommitIndex", err)
+	}
 }
 
 // ============================ NODE STATE CHANGES ============================
@@ -404,24 +1270,46 @@ func (node *ConsensusModule) updateEntries(peer, next int, entries []LogEntry) {
 func (node *ConsensusModule) BecomeLeader() {
 	// Change the node state to LEADER
 	node.state = LEADER
+	node.leaderId = node.id
+	node.metrics.electionsWon.Inc()
 
 	// Update the indicies for all peers.
 	node.UpdatePeerIndicies()
 
+	// Append a no-op entry so that the leader commits an entry from its own
+	// term (and with it, every entry before it) as soon as possible.
+	node.appendToLog(node.lastLogIndex()+1, []LogEntry{{Command: NewCommand(&NoOpCommand{}), Term: node.currentTerm}})
+	node.advanceCommitIndex()
+
 	// Run the leader loop, concurrently.
-	go node.LeaderLoop()
+	node.runtime.Go(node.LeaderLoop)
 }
 
 /*
  * BecomeFollower changes a node to the FOLLOWER state.
  */
 func (node *ConsensusModule) BecomeFollower(term int) {
-	// Reset fields back to follower defaults.
+	// A stopped node stays stopped, whatever the replies still coming in say.
+	if node.state == DEAD {
+		return
+	}
+
+	// A vote only holds for the term it was cast in, so it is only forgotten
+	// when moving to a newer term.
+	if term > node.currentTerm {
+		node.votedFor = -1
+		node.leaderId = -1
+		node.currentTerm = term
+		node.persistState()
+	}
+
+	// Reset fields back to follower defaults. Commands that weren't appended
+	// yet are dropped; their clients will time out.
 	node.state = FOLLOWER
-	node.votedFor = -1
-	node.currentTerm = term
-	node.electionResetEvent = time.Now()
+	node.proposals = nil
+	node.transferTarget = -1
+	node.electionResetEvent = node.runtime.Now()
 
 	// Start the periodic election timer.
-	go node.StartElectionTimer()
+	node.runtime.Go(node.StartElectionTimer)
 }
@@ -0,0 +1,161 @@
+package main
+
+// The reads.go file implements linearizable reads with the ReadIndex protocol,
+// as described in section 6.4 of Diego Ongaro's dissertation "Consensus:
+// Bridging Theory and Practice". Reads don't go through the log; instead the
+// leader notes its commit index, checks that it is still the leader, and
+// serves the read once its state machine has caught up to that index.
+//
+// Followers can also serve reads that accept bounded staleness: a follower
+// that heard from the leader recently, and has committed everything the leader
+// had committed then, is at most that far behind.
+
+import (
+	"errors"
+	"time"
+)
+
+// ErrStale is returned for bounded-staleness reads a follower is too far
+// behind the leader to serve.
+var ErrStale = errors.New("too far behind the leader")
+
+// readIndexTimeout is how long a leader keeps trying to confirm its
+// leadership for a read before giving up.
+const readIndexTimeout = 1 * time.Second
+
+// ================================ READ INDEX ================================
+
+/*
+ * ReadIndex returns an index such that a read served once the state machine
+ * has applied it reflects every write committed before ReadIndex was called.
+ *
+ * Only the leader can answer. A new leader first waits for an entry of its own
+ * term (the entry appended by BecomeLeader) to commit, so that its commit
+ * index is up to date, and every read needs a quorum to acknowledge it as the
+ * leader, so that a deposed leader can't serve stale data.
+ */
+func (node *ConsensusModule) ReadIndex() (int, error) {
+	deadline := node.runtime.Now().Add(readIndexTimeout)
+
+	for {
+		node.mu.Lock()
+		if node.state != LEADER {
+			node.mu.Unlock()
+			return -1, ErrNotLeader
+		}
+		committed := node.termAt(node.commitIndex) == node.currentTerm
+		index := node.commitIndex
+		term := node.currentTerm
+		node.mu.Unlock()
+
+		// The heartbeat round also replicates the entry the leader is
+		// waiting on, if it hasn't committed yet.
+		if node.confirmLeadership(term) && committed {
+			return index, nil
+		}
+
+		if node.runtime.Now().After(deadline) {
+			return -1, errors.New("couldn't confirm leadership")
+		}
+		node.runtime.Sleep(10 * time.Millisecond)
+	}
+}
+
+/*
+ * confirmLeadership sends a round of heartbeats to the voters and returns
+ * true once a quorum of them (ourselves included) has acknowledged us as the
+ * leader of the given term.
+ */
+func (node *ConsensusModule) confirmLeadership(term int) bool {
+	node.mu.Lock()
+	acks := 0
+	if node.isVoter(node.id) {
+		acks = 1
+	}
+	if node.hasQuorum(acks) {
+		node.mu.Unlock()
+		return true
+	}
+	peers := node.voterPeers()
+	node.mu.Unlock()
+
+	// The heartbeats count their answers under the node's mutex and notify
+	// us after each one.
+	answered := 0
+	answer := node.runtime.NewSignal()
+	for _, peer := range peers {
+		peer := peer
+		node.runtime.Go(func() {
+			ok := node.prepareAppendEntriesForPeer(peer, term)
+			node.mu.Lock()
+			answered += 1
+			if ok {
+				acks += 1
+			}
+			node.mu.Unlock()
+			answer.Notify()
+		})
+	}
+
+	for {
+		answer.Wait()
+
+		node.mu.Lock()
+		quorum := node.state == LEADER && node.currentTerm == term && node.hasQuorum(acks)
+		done := answered == len(peers)
+		node.mu.Unlock()
+		if quorum {
+			return true
+		}
+		if done {
+			return false
+		}
+	}
+}
+
+// ============================== FOLLOWER READS ==============================
+
+/*
+ * BoundedReadIndex returns an index such that a read served once the state
+ * machine has applied it is at most maxStaleness behind the leader. The
+ * leader answers with ReadIndex. A follower answers if it heard from the
+ * leader within maxStaleness and its log has committed everything the leader
+ * had committed then; otherwise it returns ErrStale.
+ */
+func (node *ConsensusModule) BoundedReadIndex(maxStaleness time.Duration) (int, error) {
+	node.mu.Lock()
+	if node.state == LEADER {
+		node.mu.Unlock()
+		return node.ReadIndex()
+	}
+	defer node.mu.Unlock()
+
+	if node.leaderId == -1 || node.runtime.Now().Sub(node.leaderContact) > maxStaleness ||
+		node.commitIndex < node.leaderCommit {
+		return -1, ErrStale
+	}
+	return node.leaderCommit, nil
+}
+
+/*
+ * Leader returns the ID and client endpoint of the node this node thinks is
+ * the leader (-1 and "" if it doesn't know), and the current term.
+ */
+func (node *ConsensusModule) Leader() (int, string, int) {
+	node.mu.Lock()
+	defer node.mu.Unlock()
+
+	if node.leaderId == -1 {
+		return -1, "", node.currentTerm
+	}
+	return node.leaderId, node.config[node.leaderId].Endpoint, node.currentTerm
+}
+
+/*
+ * LeaderEndpoint returns the client endpoint of the node this node thinks is
+ * the leader, or "" if it doesn't know.
+ */
+func (node *ConsensusModule) LeaderEndpoint() string {
+	_, endpoint, _ := node.Leader()
+	return endpoint
+}
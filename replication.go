@@ -0,0 +1,338 @@
+package main
+
+// The replication.go file implements batching and pipelining of log entries,
+// as described in section 10.2.2 of Diego Ongaro's dissertation "Consensus:
+// Bridging Theory and Practice". Commands submitted at the same moment are
+// appended to the leader's log (and written to its storage) together, and the
+// leader sends each follower its missing entries in bounded batches, with
+// several AppendEntries in flight at once. A follower only gets one batch at a
+// time while the leader is still finding where their logs match, so that a
+// rejection doesn't leave a window of doomed requests behind it.
+
+import (
+	"strconv"
+	"time"
+)
+
+// The default limits on replication, used unless SetReplication is called.
+const (
+	defaultBatchEntries = 512     // Entries per AppendEntries
+	defaultBatchBytes   = 1 << 20 // Approximate bytes of entries per AppendEntries
+	defaultMaxInflight  = 8       // AppendEntries in flight per follower
+)
+
+// inflightTimeout is how long a leader waits for the AppendEntries it has in
+// flight to a follower to be answered before assuming they were lost and
+// sending the entries again.
+const inflightTimeout = 200 * time.Millisecond
+
+// peerProgress represents what a leader knows about the AppendEntries it has
+// in flight to a follower. Along with nextIndex and matchIndex, it is
+// reinitialized after each election.
+type peerProgress struct {
+	inflight   int       // Batches (or snapshots) sent and not yet answered
+	probing    bool      // True until the follower's log is known to match ours at nextIndex-1
+	generation int       // Incremented whenever the batches in flight are given up on
+	lastReply  time.Time // When the follower last answered a batch (or the first one was sent)
+
+	lastContact time.Time // When the follower last answered us as the leader (see checkquorum.go)
+}
+
+// appendRequest represents an AppendEntries a leader is about to send a
+// follower.
+type appendRequest struct {
+	args       AppendEntriesArgs // The arguments (unless snapshot is set)
+	snapshot   bool              // Send our snapshot instead; the entries the follower needs are gone
+	counted    bool              // Whether the request counts against the follower's window
+	generation int               // The follower's generation when the request was made
+}
+
+// ============================== CONFIGURATION ===============================
+
+/*
+ * SetReplication sets how many entries (and roughly how many bytes of
+ * entries) a leader sends a follower per AppendEntries, and how many
+ * AppendEntries it keeps in flight to each follower. Must be called before
+ * Start.
+ */
+func (node *ConsensusModule) SetReplication(batchEntries, batchBytes, maxInflight int) {
+	node.mu.Lock()
+	defer node.mu.Unlock()
+
+	node.batchEntries = batchEntries
+	node.batchBytes = batchBytes
+	node.maxInflight = maxInflight
+}
+
+// ============================= GROUPED APPENDS ==============================
+
+/*
+ * propose queues a command to be appended to the leader's log and returns
+ * the index it will have. Commands proposed before the queue is flushed are
+ * appended, persisted and replicated together. Must be called with the
+ * node's mutex held, by the leader.
+ */
+func (node *ConsensusModule) propose(command *Command) int {
+	node.proposals = append(node.proposals, LogEntry{Command: command, Term: node.currentTerm})
+
+	// The first command of a group schedules the append; the others join it
+	// while it waits for the mutex.
+	if len(node.proposals) == 1 {
+		node.runtime.Go(func() {
+			node.mu.Lock()
+			defer node.mu.Unlock()
+
+			if node.state == LEADER {
+				node.appendProposals()
+			}
+		})
+	}
+	return node.lastLogIndex() + len(node.proposals)
+}
+
+/*
+ * appendProposals appends the queued commands to the leader's log and starts
+ * replicating them. Anything else the leader appends must come after them, so
+ * it calls this first. Must be called with the node's mutex held.
+ */
+func (node *ConsensusModule) appendProposals() {
+	if len(node.proposals) == 0 {
+		return
+	}
+
+	node.appendToLog(node.lastLogIndex()+1, node.proposals)
+	node.proposals = nil
+
+	// A cluster of one node commits its entries right away.
+	node.advanceCommitIndex()
+
+	for _, peer := range node.peerIds {
+		peer := peer
+		term := node.currentTerm
+		node.runtime.Go(func() { node.replicateToPeer(peer, term) })
+	}
+}
+
+// =============================== REPLICATION ================================
+
+/*
+ * resetProgress forgets what the leader knew about a follower's log. Must be
+ * called with the node's mutex held.
+ */
+func (node *ConsensusModule) resetProgress(peer int) {
+	node.nextIndex[peer] = node.lastLogIndex() + 1
+	node.matchIndex[peer] = -1
+	node.progress[peer] = &peerProgress{probing: true, lastContact: node.runtime.Now()}
+}
+
+/*
+ * batchFrom returns a copy of the entries starting at the given index, up to
+ * the batch limits (but at least one entry).
+ */
+func (node *ConsensusModule) batchFrom(start int) []LogEntry {
+	end := start
+	size := 0
+	for end <= node.lastLogIndex() && end-start < node.batchEntries {
+		size += node.log[end-node.snapshotIndex-1].Size()
+		if end > start && size > node.batchBytes {
+			break
+		}
+		end++
+	}
+	return node.entriesBetween(start, end)
+}
+
+/*
+ * nextAppendRequest prepares the next request to send a follower: the next
+ * batch of entries it is missing if the window allows, or else (if heartbeat
+ * is set) an empty AppendEntries that only asserts our leadership. Returns nil
+ * if there is nothing to send. Must be called with the node's mutex held.
+ */
+func (node *ConsensusModule) nextAppendRequest(peer, term int, heartbeat bool) *appendRequest {
+	progress := node.progress[peer]
+	if node.state != LEADER || node.currentTerm != term || progress == nil {
+		return nil
+	}
+
+	// Batches that went unanswered for too long were probably lost; start
+	// again from the last entry the follower is known to have.
+	if progress.inflight > 0 && node.runtime.Now().Sub(progress.lastReply) > inflightTimeout {
+		progress.inflight = 0
+		progress.generation++
+		progress.probing = true
+		node.nextIndex[peer] = node.matchIndex[peer] + 1
+	}
+
+	window := node.maxInflight
+	if progress.probing {
+		window = 1
+	}
+
+	next := node.nextIndex[peer]
+	if progress.inflight < window && (next <= node.lastLogIndex() || next <= node.snapshotIndex) {
+		if progress.inflight == 0 {
+			progress.lastReply = node.runtime.Now()
+		}
+		progress.inflight++
+		request := &appendRequest{counted: true, generation: progress.generation}
+
+		// The entries the follower needs next were compacted away, so it
+		// gets our snapshot instead.
+		if next <= node.snapshotIndex {
+			request.snapshot = true
+			return request
+		}
+
+		// The next batch goes out before the earlier ones are answered.
+		entries := node.batchFrom(next)
+		node.nextIndex[peer] = next + len(entries)
+		request.args = AppendEntriesArgs{
+			Term:         term,
+			LeaderId:     node.id,
+			PrevLogIndex: next - 1,
+			PrevLogTerm:  node.termAt(next - 1),
+			Entries:      entries,
+			LeaderCommit: node.commitIndex,
+			Checksum:     node.latestChecksum(),
+		}
+		return request
+	}
+
+	if !heartbeat || next <= node.snapshotIndex {
+		return nil
+	}
+
+	// The entries after the follower's last known match may still be on
+	// their way, so a heartbeat refers to the match instead.
+	prev := next - 1
+	if progress.inflight > 0 {
+		prev = node.matchIndex[peer]
+		if prev < node.snapshotIndex {
+			prev = node.snapshotIndex
+		}
+	}
+	return &appendRequest{
+		args: AppendEntriesArgs{
+			Term:         term,
+			LeaderId:     node.id,
+			PrevLogIndex: prev,
+			PrevLogTerm:  node.termAt(prev),
+			LeaderCommit: node.commitIndex,
+			Checksum:     node.latestChecksum(),
+		},
+		generation: progress.generation,
+	}
+}
+
+/*
+ * replicateToPeer sends a follower as many batches of the entries it is
+ * missing as its window allows, without waiting for the answers.
+ */
+func (node *ConsensusModule) replicateToPeer(peer, term int) {
+	for {
+		node.mu.Lock()
+		request := node.nextAppendRequest(peer, term, false)
+		node.mu.Unlock()
+
+		if request == nil {
+			return
+		}
+		node.runtime.Go(func() { node.sendAppendRequest(peer, term, request) })
+	}
+}
+
+/*
+ * sendAppendRequest sends a request prepared by nextAppendRequest and handles
+ * the answer. Returns true if the follower acknowledged us as the leader of
+ * the given term.
+ */
+func (node *ConsensusModule) sendAppendRequest(peer, term int, request *appendRequest) bool {
+	if request.snapshot {
+		ok := node.prepareInstallSnapshotForPeer(peer, term)
+
+		node.mu.Lock()
+		defer node.mu.Unlock()
+		if progress := node.progress[peer]; progress != nil && node.currentTerm == term &&
+			progress.generation == request.generation {
+			progress.inflight--
+			if ok {
+				progress.probing = false
+				node.runtime.Go(func() { node.replicateToPeer(peer, term) })
+			}
+		}
+		return ok
+	}
+
+	var reply AppendEntriesReply
+	start := node.runtime.Now()
+	err := node.DoRPC(peer, "ConsensusModule.AppendEntries", request.args, &reply)
+	if err != nil {
+		node.metrics.appendFailures.Inc(strconv.Itoa(peer))
+	} else {
+		node.metrics.appendLatency.Observe(node.runtime.Now().Sub(start).Seconds(), strconv.Itoa(peer))
+	}
+
+	node.mu.Lock()
+	defer node.mu.Unlock()
+
+	// The peer is down or unreachable (the transport keeps trying to reach
+	// it). The batches in flight are given up on, and the next heartbeat
+	// starts again from the peer's last known match.
+	if err != nil {
+		progress := node.progress[peer]
+		if request.counted && progress != nil && node.currentTerm == term &&
+			progress.generation == request.generation {
+			progress.inflight = 0
+			progress.generation++
+			progress.probing = true
+			node.nextIndex[peer] = node.matchIndex[peer] + 1
+		}
+		return false
+	}
+
+	// If the reply's term is greater than our saved term, that means that
+	// the leader is out of sync and is thus no longer the leader.
+	if reply.Term > term {
+		node.BecomeFollower(reply.Term)
+		return false
+	}
+
+	progress := node.progress[peer]
+	if node.state != LEADER || node.currentTerm != term || reply.Term != term || progress == nil {
+		return false
+	}
+
+	node.heardFrom(peer)
+	current := progress.generation == request.generation
+	if request.counted && current {
+		progress.inflight--
+		progress.lastReply = node.runtime.Now()
+	}
+
+	if reply.Success {
+		match := request.args.PrevLogIndex + len(request.args.Entries)
+		if match > node.matchIndex[peer] {
+			node.matchIndex[peer] = match
+		}
+		if node.nextIndex[peer] <= node.matchIndex[peer] {
+			node.nextIndex[peer] = node.matchIndex[peer] + 1
+		}
+		progress.probing = false
+		node.advanceCommitIndex()
+	} else if current {
+		// Back up past the conflict, give up on the batches sent after this
+		// one (they will be rejected too) and retry right away rather than
+		// on the next heartbeat.
+		next := node.backtrack(request.args.PrevLogIndex+1, reply)
+		if next <= node.matchIndex[peer] {
+			next = node.matchIndex[peer] + 1
+		}
+		node.nextIndex[peer] = next
+		progress.inflight = 0
+		progress.generation++
+		progress.probing = true
+	}
+
+	node.runtime.Go(func() { node.replicateToPeer(peer, term) })
+	return true
+}
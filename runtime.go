@@ -0,0 +1,74 @@
+package main
+
+import (
+	"math/rand"
+	"time"
+)
+
+// ================================== RUNTIME =================================
+
+// Runtime represents everything the consensus module needs from its
+// environment besides the network: the time, random numbers and a way to run
+// code concurrently. Nodes normally use RealRuntime; the simulator (see
+// simulation.go) replaces it with a virtual clock, a seeded random number
+// generator and its own scheduler, so that a whole cluster runs the same way
+// every time.
+//
+// Goroutines started with Go must only block through the runtime (Sleep and
+// Signal.Wait) or the transport, and never while holding the node's mutex.
+type Runtime interface {
+	// Now returns the current time.
+	Now() time.Time
+
+	// Sleep pauses the calling goroutine for at least the given duration.
+	Sleep(d time.Duration)
+
+	// Intn returns a random number in [0, n).
+	Intn(n int) int
+
+	// Go runs f in a new goroutine.
+	Go(f func())
+
+	// NewSignal returns a new Signal.
+	NewSignal() Signal
+}
+
+// Signal represents a wake-up call for one waiting goroutine. Notifications
+// don't pile up: any number of Notify calls before a Wait wake it only once.
+type Signal interface {
+	// Notify wakes the waiting goroutine, or the next one to wait.
+	Notify()
+
+	// Wait blocks until the signal is notified.
+	Wait()
+}
+
+// =============================== REAL RUNTIME ===============================
+
+// RealRuntime represents the runtime of a node running for real: the system
+// clock, the global random number generator and goroutines.
+type RealRuntime struct{}
+
+func (RealRuntime) Now() time.Time        { return time.Now() }
+func (RealRuntime) Sleep(d time.Duration) { time.Sleep(d) }
+func (RealRuntime) Intn(n int) int        { return rand.Intn(n) }
+func (RealRuntime) Go(f func())           { go f() }
+
+func (RealRuntime) NewSignal() Signal {
+	return realSignal(make(chan struct{}, 1))
+}
+
+// realSignal represents a Signal as a channel holding at most one
+// notification.
+type realSignal chan struct{}
+
+func (signal realSignal) Notify() {
+	select {
+	case signal <- struct{}{}:
+	default:
+	}
+}
+
+func (signal realSignal) Wait() {
+	<-signal
+}
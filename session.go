@@ -0,0 +1,111 @@
+package main
+
+// The session.go file implements client sessions, as described in section 6.3
+// of Diego Ongaro's dissertation "Consensus: Bridging Theory and Practice".
+// A client retries a command it got no answer for, so the same command can be
+// committed more than once. Each client registers a session and numbers its
+// commands; the session remembers the last command applied for the client and
+// its result, and a retried command gets that result back instead of being
+// applied again.
+//
+// The session table is part of the replicated state machine (it's kept in the
+// AlbumDB), so every node makes the same decisions, and it survives snapshots.
+// Sessions expire based on the leader timestamps in the log rather than each
+// node's own clock, so they expire at the same point in the log everywhere.
+
+import (
+	"errors"
+	"time"
+)
+
+// sessionTimeout is how long a session may go without a command, in log
+// time, before it expires.
+const sessionTimeout = 1 * time.Hour
+
+// ================================= SESSIONS =================================
+
+// ClientSession represents a client's session: the last command applied for
+// the client and that command's result.
+type ClientSession struct {
+	LastSequence int    // Sequence number of the last command applied for the client
+	LastError    string // The result of that command ("" if it succeeded)
+	LastActive   int64  // Log time (unix nanoseconds) of the client's last command
+}
+
+// SessionTable represents the sessions of every registered client.
+type SessionTable struct {
+	Sessions map[string]*ClientSession // Sessions by client ID
+	Clock    int64                     // The latest leader timestamp applied (unix nanoseconds)
+}
+
+/*
+ * NewSessionTable initializes an empty session table.
+ */
+func NewSessionTable() *SessionTable {
+	return &SessionTable{
+		Sessions: make(map[string]*ClientSession),
+	}
+}
+
+/*
+ * Advance moves the table's clock to the given leader timestamp and expires
+ * the sessions that have been idle for longer than sessionTimeout. Leaders'
+ * clocks may disagree, so the clock never moves backwards.
+ */
+func (table *SessionTable) Advance(timestamp int64) {
+	if timestamp <= table.Clock {
+		return
+	}
+	table.Clock = timestamp
+
+	for id, session := range table.Sessions {
+		if table.Clock-session.LastActive > int64(sessionTimeout) {
+			delete(table.Sessions, id)
+		}
+	}
+}
+
+/*
+ * Register opens a session for the given client. Registering a client that
+ * already has a session (e.g. a retried RegisterClient) keeps that session.
+ */
+func (table *SessionTable) Register(clientID string) {
+	if _, ok := table.Sessions[clientID]; ok {
+		return
+	}
+	table.Sessions[clientID] = &ClientSession{
+		LastSequence: 0,
+		LastActive:   table.Clock,
+	}
+}
+
+/*
+ * Apply applies a command from a client session at most once: apply is called
+ * only if the command's sequence number is new, and its result is recorded.
+ * A command that was already applied gets the recorded result instead.
+ */
+func (table *SessionTable) Apply(cmd *Command, apply func() error) error {
+	session, ok := table.Sessions[cmd.ClientID]
+	if !ok {
+		return ErrSessionExpired
+	}
+	session.LastActive = table.Clock
+
+	if cmd.Sequence < session.LastSequence {
+		return errors.New("command was already answered")
+	}
+	if cmd.Sequence == session.LastSequence {
+		if session.LastError != "" {
+			return errors.New(session.LastError)
+		}
+		return nil
+	}
+
+	err := apply()
+	session.LastSequence = cmd.Sequence
+	session.LastError = ""
+	if err != nil {
+		session.LastError = err.Error()
+	}
+	return err
+}
@@ -0,0 +1,929 @@
+package main
+
+// The simulation.go file runs a whole cluster inside one process, on a virtual
+// clock, so that election and replication bugs can be reproduced. Everything
+// that could make two runs differ is under the simulator's control:
+//
+//   - the nodes get the time, random numbers and goroutines from the simulator
+//     (it implements Runtime, see runtime.go), and the random numbers come
+//     from a single generator seeded by the caller;
+//   - the goroutines run one at a time, in an order decided by the simulator,
+//     until they block on the clock, a Signal or an RPC;
+//   - the network between the nodes is simulated too, and randomly delays,
+//     reorders and drops messages, or partitions the cluster.
+//
+// Virtual time only moves when every goroutine is blocked, so a simulated
+// second takes as long as the work done in it. A run is entirely determined
+// by its seed (and its parameters), and a failing run can be replayed exactly.
+//
+// The cluster checks the safety properties of Raft (see section 3.6 of Diego
+// Ongaro's dissertation "Consensus: Bridging Theory and Practice") as it runs:
+// at most one leader per term, that the logs match, and that every node
+// applies the same entries in the same order and ends up with the same album
+// database.
+
+import (
+	"bytes"
+	"container/heap"
+	"encoding/gob"
+	"errors"
+	"fmt"
+	"hash/fnv"
+	"math/rand"
+	goruntime "runtime"
+	"sort"
+	"time"
+)
+
+// ================================ SIMULATOR =================================
+
+// simEpoch is the virtual time at which every simulation starts.
+var simEpoch = time.Date(2020, time.January, 1, 0, 0, 0, 0, time.UTC)
+
+// simEvent represents something that happens at a given virtual time, such as
+// a goroutine waking up or a message arriving.
+type simEvent struct {
+	at  time.Time
+	seq int    // Orders the events due at the same time by when they were scheduled
+	fn  func() // Runs on the simulator's goroutine
+}
+
+// simEventQueue represents the pending events, as a heap ordered by time.
+type simEventQueue []*simEvent
+
+func (queue simEventQueue) Len() int { return len(queue) }
+func (queue simEventQueue) Less(i, j int) bool {
+	if queue[i].at.Equal(queue[j].at) {
+		return queue[i].seq < queue[j].seq
+	}
+	return queue[i].at.Before(queue[j].at)
+}
+func (queue simEventQueue) Swap(i, j int)       { queue[i], queue[j] = queue[j], queue[i] }
+func (queue *simEventQueue) Push(x interface{}) { *queue = append(*queue, x.(*simEvent)) }
+func (queue *simEventQueue) Pop() interface{} {
+	old := *queue
+	event := old[len(old)-1]
+	*queue = old[:len(old)-1]
+	return event
+}
+
+// simTask represents a goroutine started by the simulator. It only runs when
+// the simulator hands it the wake token, and hands control back when it
+// blocks or returns.
+type simTask struct {
+	wake   chan struct{} // Receives the token when the task may run
+	killed bool          // Set when the simulation is stopped
+}
+
+// Simulator represents a virtual clock and scheduler. It implements Runtime,
+// so it can be given to consensus modules in place of RealRuntime.
+type Simulator struct {
+	now     time.Time
+	rand    *rand.Rand
+	events  simEventQueue
+	seq     int
+	current *simTask          // The task running right now (nil if none)
+	tasks   map[*simTask]bool // Tasks that haven't returned yet
+	yield   chan struct{}     // The running task hands control back on it
+	Steps   int               // The number of events processed so far
+}
+
+/*
+ * NewSimulator initializes a simulator whose random numbers come from the
+ * given seed.
+ */
+func NewSimulator(seed int64) *Simulator {
+	return &Simulator{
+		now:   simEpoch,
+		rand:  rand.New(rand.NewSource(seed)),
+		tasks: make(map[*simTask]bool),
+		yield: make(chan struct{}),
+	}
+}
+
+/*
+ * Now returns the virtual time.
+ */
+func (sim *Simulator) Now() time.Time {
+	return sim.now
+}
+
+/*
+ * Elapsed returns the virtual time since the simulation started.
+ */
+func (sim *Simulator) Elapsed() time.Duration {
+	return sim.now.Sub(simEpoch)
+}
+
+/*
+ * Intn returns a random number in [0, n) from the seeded generator.
+ */
+func (sim *Simulator) Intn(n int) int {
+	return sim.rand.Intn(n)
+}
+
+/*
+ * Float64 returns a random number in [0.0, 1.0) from the seeded generator.
+ */
+func (sim *Simulator) Float64() float64 {
+	return sim.rand.Float64()
+}
+
+/*
+ * After schedules fn to run on the simulator's goroutine once d has passed.
+ */
+func (sim *Simulator) After(d time.Duration, fn func()) {
+	sim.seq += 1
+	heap.Push(&sim.events, &simEvent{at: sim.now.Add(d), seq: sim.seq, fn: fn})
+}
+
+/*
+ * Go starts f in a new task, which first runs once the tasks that are due
+ * before it have run.
+ */
+func (sim *Simulator) Go(f func()) {
+	task := &simTask{wake: make(chan struct{}, 1)}
+	sim.tasks[task] = true
+
+	go func() {
+		<-task.wake
+		if task.killed {
+			return
+		}
+		f()
+		delete(sim.tasks, task)
+		sim.yield <- struct{}{}
+	}()
+
+	sim.After(0, func() { sim.resume(task) })
+}
+
+/*
+ * Sleep blocks the running task for d of virtual time.
+ */
+func (sim *Simulator) Sleep(d time.Duration) {
+	task := sim.running()
+	sim.After(d, func() { sim.resume(task) })
+	sim.park()
+}
+
+/*
+ * NewSignal returns a Signal whose waiters are tasks.
+ */
+func (sim *Simulator) NewSignal() Signal {
+	return &simSignal{sim: sim}
+}
+
+/*
+ * running returns the running task. Blocking is only possible inside a task,
+ * since the simulator's goroutine has nothing else to run in the meantime.
+ */
+func (sim *Simulator) running() *simTask {
+	if sim.current == nil {
+		panic("simulator: blocking outside of a simulated goroutine")
+	}
+	return sim.current
+}
+
+/*
+ * resume runs a task until it blocks or returns. Must be called on the
+ * simulator's goroutine.
+ */
+func (sim *Simulator) resume(task *simTask) {
+	sim.current = task
+	task.wake <- struct{}{}
+	<-sim.yield
+	sim.current = nil
+}
+
+/*
+ * park hands control back to the simulator and blocks the running task until
+ * something resumes it. A task parked when the simulation is stopped never
+ * resumes; its goroutine exits instead.
+ */
+func (sim *Simulator) park() {
+	task := sim.running()
+	sim.yield <- struct{}{}
+	<-task.wake
+	if task.killed {
+		goruntime.Goexit()
+	}
+}
+
+/*
+ * Run processes events in order until the virtual time reaches until or there
+ * is nothing left to do. check is called after every event, and the run stops
+ * with the first error it returns.
+ */
+func (sim *Simulator) Run(until time.Time, check func() error) error {
+	for len(sim.events) > 0 && !sim.events[0].at.After(until) {
+		event := heap.Pop(&sim.events).(*simEvent)
+		sim.now = event.at
+		event.fn()
+		sim.Steps += 1
+
+		if check != nil {
+			if err := check(); err != nil {
+				return err
+			}
+		}
+	}
+
+	if sim.now.Before(until) {
+		sim.now = until
+	}
+	return nil
+}
+
+/*
+ * Stop ends the simulation: the tasks that are still blocked are discarded.
+ * The simulator can't be used afterwards.
+ */
+func (sim *Simulator) Stop() {
+	for task := range sim.tasks {
+		task.killed = true
+		task.wake <- struct{}{}
+	}
+	sim.tasks = nil
+	sim.events = nil
+}
+
+// simSignal represents a Signal in a simulation.
+type simSignal struct {
+	sim      *Simulator
+	notified bool     // A notification is waiting for the next Wait
+	waiter   *simTask // The task blocked in Wait, if any
+}
+
+func (signal *simSignal) Notify() {
+	if signal.waiter != nil {
+		task := signal.waiter
+		signal.waiter = nil
+		signal.sim.After(0, func() { signal.sim.resume(task) })
+		return
+	}
+	signal.notified = true
+}
+
+func (signal *simSignal) Wait() {
+	if signal.notified {
+		signal.notified = false
+		return
+	}
+	signal.waiter = signal.sim.running()
+	signal.sim.park()
+}
+
+// ============================ SIMULATED NETWORK =============================
+
+// SimNetwork represents the network between the nodes of a simulation. Each
+// message (a call or its reply) takes a random time between MinDelay and
+// MaxDelay to arrive, so messages can overtake each other. A message is lost
+// with probability DropRate, or if a partition separates the two nodes when
+// it is sent or when it arrives. A call whose request or reply is lost never
+// returns, like a call on a connection that hangs.
+type SimNetwork struct {
+	sim      *Simulator
+	nodes    map[string]*SimTransport // The listening nodes, by endpoint
+	group    map[string]int           // The side of the partition each endpoint is on
+	DropRate float64
+	MinDelay time.Duration
+	MaxDelay time.Duration
+	Sent     int // The number of messages sent so far
+	Dropped  int // The number of those that were lost
+}
+
+/*
+ * NewSimNetwork initializes a network with no partitions, no losses and
+ * delays between 1 and 10ms.
+ */
+func NewSimNetwork(sim *Simulator) *SimNetwork {
+	return &SimNetwork{
+		sim:      sim,
+		nodes:    make(map[string]*SimTransport),
+		group:    make(map[string]int),
+		MinDelay: 1 * time.Millisecond,
+		MaxDelay: 10 * time.Millisecond,
+	}
+}
+
+/*
+ * Partition splits the network: each group of endpoints can only reach the
+ * endpoints in the same group, and the endpoints that aren't in any group can
+ * only reach each other. Replaces any previous partition.
+ */
+func (network *SimNetwork) Partition(groups ...[]string) {
+	network.group = make(map[string]int)
+	for i, group := range groups {
+		for _, endpoint := range group {
+			network.group[endpoint] = i + 1
+		}
+	}
+}
+
+/*
+ * Heal removes the partition.
+ */
+func (network *SimNetwork) Heal() {
+	network.group = make(map[string]int)
+}
+
+/*
+ * reachable returns true if no partition separates the two endpoints.
+ */
+func (network *SimNetwork) reachable(from, to string) bool {
+	return network.group[from] == network.group[to]
+}
+
+/*
+ * send sends a message from one endpoint to another; deliver is called when
+ * it arrives, unless it is lost on the way.
+ */
+func (network *SimNetwork) send(from, to string, deliver func()) {
+	network.Sent += 1
+	if !network.reachable(from, to) || network.sim.Float64() < network.DropRate {
+		network.Dropped += 1
+		return
+	}
+
+	delay := network.MinDelay
+	if network.MaxDelay > network.MinDelay {
+		delay += time.Duration(network.sim.rand.Int63n(int64(network.MaxDelay - network.MinDelay + 1)))
+	}
+	network.sim.After(delay, func() {
+		if !network.reachable(from, to) {
+			network.Dropped += 1
+			return
+		}
+		deliver()
+	})
+}
+
+// SimTransport represents a node's transport on a SimNetwork. Like the
+// simulator itself, it is only used by one task at a time, so it needs no
+// locking.
+type SimTransport struct {
+	rpcServices
+	network  *SimNetwork
+	endpoint string         // The endpoint the node listens on
+	peers    map[int]string // Endpoints of the connected peers, by ID
+}
+
+/*
+ * NewSimTransport initializes a transport on the given network.
+ */
+func NewSimTransport(network *SimNetwork) *SimTransport {
+	return &SimTransport{
+		rpcServices: rpcServices{services: make(map[string]interface{})},
+		network:     network,
+		peers:       make(map[int]string),
+	}
+}
+
+/*
+ * Listen adds the node to the network.
+ */
+func (t *SimTransport) Listen(endpoint string) error {
+	if _, ok := t.network.nodes[endpoint]; ok {
+		return fmt.Errorf("%s is already in use", endpoint)
+	}
+	t.network.nodes[endpoint] = t
+	t.endpoint = endpoint
+	return nil
+}
+
+/*
+ * Close removes the node from the network and forgets its peers. Calls to the
+ * node are lost from then on.
+ */
+func (t *SimTransport) Close() error {
+	if t.network.nodes[t.endpoint] == t {
+		delete(t.network.nodes, t.endpoint)
+	}
+	t.peers = make(map[int]string)
+	return nil
+}
+
+/*
+ * Connect connects to the peer listening on endpoint.
+ */
+func (t *SimTransport) Connect(peer int, endpoint string) error {
+	if _, ok := t.network.nodes[endpoint]; !ok {
+		return ErrUnreachable
+	}
+	t.peers[peer] = endpoint
+	return nil
+}
+
+/*
+ * Disconnect forgets a peer.
+ */
+func (t *SimTransport) Disconnect(peer int) error {
+	delete(t.peers, peer)
+	return nil
+}
+
+/*
+ * Health returns the peer's endpoint, if the node is connected to it.
+ */
+func (t *SimTransport) Health(peer int) PeerHealth {
+	endpoint, ok := t.peers[peer]
+	return PeerHealth{Endpoint: endpoint, Connected: ok}
+}
+
+/*
+ * Call sends a call to the peer and blocks the running task until the reply
+ * arrives, or until the call times out on the virtual clock. The callee serves
+ * the call in a task of its own.
+ */
+func (t *SimTransport) Call(peer int, method string, args, reply interface{}) error {
+	endpoint, ok := t.peers[peer]
+	if !ok {
+		return fmt.Errorf("not connected to peer %d", peer)
+	}
+
+	var buffer bytes.Buffer
+	if err := gob.NewEncoder(&buffer).Encode(args); err != nil {
+		return err
+	}
+
+	sim := t.network.sim
+	caller := sim.running()
+	var result inMemoryResult
+	answered := false
+
+	t.network.send(t.endpoint, endpoint, func() {
+		callee, ok := t.network.nodes[endpoint]
+		if !ok {
+			return
+		}
+		sim.Go(func() {
+			encoded, err := callee.serve(method, buffer.Bytes())
+			t.network.send(endpoint, t.endpoint, func() {
+				if !answered {
+					answered = true
+					result = inMemoryResult{reply: encoded, err: err}
+					sim.resume(caller)
+				}
+			})
+		})
+	})
+	sim.After(callTimeout(method), func() {
+		if !answered {
+			answered = true
+			result = inMemoryResult{err: ErrCallTimeout}
+			sim.resume(caller)
+		}
+	})
+	sim.park()
+
+	if result.err != nil {
+		return result.err
+	}
+	return gob.NewDecoder(bytes.NewReader(result.reply)).Decode(reply)
+}
+
+// ============================= SIMULATED CLUSTER ============================
+
+// simCommitBuffer is the capacity of a simulated node's commit channel. The
+// cluster empties the channels after every event, so they never fill up.
+const simCommitBuffer = 1 << 16
+
+// SimNode represents a node of a simulated cluster: a consensus module and
+// the album database its committed entries are applied to.
+type SimNode struct {
+	ID        int
+	Endpoint  string
+	Consensus *ConsensusModule
+	DB        *AlbumDB
+	Transport *SimTransport
+	Checksums *ChecksumLog // DB's checksum after each applied entry
+	commits   chan EntryToCommit
+	applied   int  // Index of the last entry applied to DB
+	corruptAt int  // Index after which DB is made to differ from the other nodes' (0 if never)
+	corrupted bool // Whether DB was made to differ
+}
+
+/*
+ * State returns the node's current term and whether it is the leader.
+ */
+func (node *SimNode) State() (int, bool) {
+	node.Consensus.mu.Lock()
+	defer node.Consensus.mu.Unlock()
+
+	return node.Consensus.currentTerm, node.Consensus.state == LEADER
+}
+
+/*
+ * Learner returns true if the node is a learner in its own configuration.
+ */
+func (node *SimNode) Learner() bool {
+	node.Consensus.mu.Lock()
+	defer node.Consensus.mu.Unlock()
+
+	member, ok := node.Consensus.config[node.ID]
+	return ok && member.Learner
+}
+
+// SimCluster represents a cluster running in a simulation, together with the
+// history the safety checks need.
+type SimCluster struct {
+	Sim             *Simulator
+	Network         *SimNetwork
+	Nodes           []*SimNode
+	SnapshotEntries int // Applied entries in the log that make a node snapshot (0 never does)
+
+	leaders        map[int]int    // The leader seen in each term
+	appliedEntries map[int]string // The entry applied at each index
+	appliedStates  map[int]uint64 // The database digest after applying each index
+}
+
+/*
+ * NewSimCluster initializes a simulation of a new cluster of n nodes, the
+ * last few of which are learners, with or without pre-vote, whose random
+ * choices all come from the given seed. The nodes are started by Start.
+ */
+func NewSimCluster(seed int64, n, learners int, preVote bool) *SimCluster {
+	sim := NewSimulator(seed)
+	cluster := &SimCluster{
+		Sim:            sim,
+		Network:        NewSimNetwork(sim),
+		leaders:        make(map[int]int),
+		appliedEntries: make(map[int]string),
+		appliedStates:  make(map[int]uint64),
+	}
+
+	config := Configuration{}
+	for id := 0; id < n; id++ {
+		config[id] = Member{Endpoint: fmt.Sprintf("node%d", id), Learner: id >= n-learners}
+	}
+
+	for id := 0; id < n; id++ {
+		cluster.Nodes = append(cluster.Nodes, cluster.newNode(id, config[id].Endpoint, config, preVote))
+	}
+
+	return cluster
+}
+
+/*
+ * newNode initializes a node of the cluster. The node starts a new cluster of
+ * the members of config, or, if config is nil, waits with an empty log to be
+ * added to the cluster, like a backend started with --join.
+ */
+func (cluster *SimCluster) newNode(id int, endpoint string, config Configuration, preVote bool) *SimNode {
+	transport := NewSimTransport(cluster.Network)
+	commits := make(chan EntryToCommit, simCommitBuffer)
+	consensus := NewConsensusModule(id, nil, transport, cluster.Sim, commits)
+	consensus.SetPreVote(preVote)
+	if err := consensus.ListenForPeers(endpoint); err != nil {
+		panic(err)
+	}
+
+	// A node that joins later applies the configuration entry at index 0
+	// too, once it gets it from the leader.
+	applied := -1
+	if config != nil {
+		consensus.Bootstrap(config)
+		applied = 0
+	}
+
+	db := NewAlbumDB()
+	checksums := NewChecksumLog()
+	checksums.Record(applied, db.Checksum())
+	consensus.SetChecksumLog(checksums)
+
+	return &SimNode{
+		ID:        id,
+		Endpoint:  endpoint,
+		Consensus: consensus,
+		DB:        db,
+		Transport: transport,
+		Checksums: checksums,
+		commits:   commits,
+		applied:   applied,
+	}
+}
+
+/*
+ * AddNode starts a new node with an empty log, which waits to be added to the
+ * cluster by the leader (see membership.go).
+ */
+func (cluster *SimCluster) AddNode(preVote bool) *SimNode {
+	id := len(cluster.Nodes)
+	node := cluster.newNode(id, fmt.Sprintf("node%d", id), nil, preVote)
+	cluster.Nodes = append(cluster.Nodes, node)
+	node.Consensus.Start()
+	return node
+}
+
+/*
+ * Start starts every node.
+ */
+func (cluster *SimCluster) Start() {
+	for _, node := range cluster.Nodes {
+		node.Consensus.Start()
+	}
+}
+
+/*
+ * Stop stops the simulation.
+ */
+func (cluster *SimCluster) Stop() {
+	cluster.Sim.Stop()
+}
+
+/*
+ * Run runs the cluster for d of virtual time, applying the committed entries
+ * and checking the safety properties after every event. Returns the first
+ * violation found.
+ */
+func (cluster *SimCluster) Run(d time.Duration) error {
+	err := cluster.Sim.Run(cluster.Sim.Now().Add(d), cluster.step)
+	if err != nil {
+		return err
+	}
+	return cluster.checkLogs()
+}
+
+/*
+ * step applies what was committed during the last event and checks the
+ * cluster. The logs are only compared every so often, since that takes a
+ * while.
+ */
+func (cluster *SimCluster) step() error {
+	for _, node := range cluster.Nodes {
+		if err := cluster.applyCommitted(node); err != nil {
+			return err
+		}
+	}
+	if err := cluster.checkLeaders(); err != nil {
+		return err
+	}
+	if err := cluster.checkDivergences(); err != nil {
+		return err
+	}
+	if cluster.Sim.Steps%100 == 0 {
+		return cluster.checkLogs()
+	}
+	return nil
+}
+
+/*
+ * Leader returns the node that is the leader in the highest term, or nil if
+ * there is none.
+ */
+func (cluster *SimCluster) Leader() *SimNode {
+	var leader *SimNode
+	leaderTerm := -1
+	for _, node := range cluster.Nodes {
+		term, isLeader := node.State()
+		if isLeader && term > leaderTerm {
+			leader, leaderTerm = node, term
+		}
+	}
+	return leader
+}
+
+/*
+ * Submit submits a command to the given node, stamped with the virtual time.
+ * Returns true if the node is the leader and took the command.
+ */
+func (cluster *SimCluster) Submit(node *SimNode, command *Command) bool {
+	command.Timestamp = cluster.Sim.Now().UnixNano()
+	_, _, ok := node.Consensus.Submit(command)
+	return ok
+}
+
+/*
+ * applyCommitted applies the entries the node has committed to its album
+ * database, like a backend does, and checks that it applies the same entries
+ * and reaches the same state as every other node.
+ */
+func (cluster *SimCluster) applyCommitted(node *SimNode) error {
+	for {
+		var entry EntryToCommit
+		select {
+		case entry = <-node.commits:
+		default:
+			return nil
+		}
+
+		if entry.Snapshot != nil {
+			if entry.Index <= node.applied {
+				return fmt.Errorf("node %d installed a snapshot at index %d after applying index %d",
+					node.ID, entry.Index, node.applied)
+			}
+			if err := node.DB.RestoreSnapshot(entry.Snapshot.Data); err != nil {
+				return fmt.Errorf("node %d restoring a snapshot: %v", node.ID, err)
+			}
+		} else {
+			if entry.Index != node.applied+1 {
+				return fmt.Errorf("node %d applied index %d after index %d", node.ID, entry.Index, node.applied)
+			}
+			err := applyCommand(node.DB, &LogEntry{Command: entry.Command, Term: entry.Term})
+			if errors.Is(err, ErrInvalidCommand) {
+				return fmt.Errorf("node %d can't apply index %d: %v", node.ID, entry.Index, err)
+			}
+			if entry.Index == node.corruptAt {
+				// As if applying the command weren't deterministic.
+				node.DB.AddAlbum("Nondeterministic album", "Artist", "", "2020")
+				node.corrupted = true
+			}
+
+			key := entryKey(LogEntry{Command: entry.Command, Term: entry.Term})
+			if applied, ok := cluster.appliedEntries[entry.Index]; !ok {
+				cluster.appliedEntries[entry.Index] = key
+			} else if applied != key {
+				return fmt.Errorf("node %d applied %s at index %d, but another node applied %s",
+					node.ID, key, entry.Index, applied)
+			}
+		}
+		node.applied = entry.Index
+		node.Checksums.Record(entry.Index, node.DB.Checksum())
+
+		// A node whose database was made to differ is left out.
+		if digest := dbDigest(node.DB); !node.corrupted {
+			if state, ok := cluster.appliedStates[entry.Index]; !ok {
+				cluster.appliedStates[entry.Index] = digest
+			} else if state != digest {
+				return fmt.Errorf("node %d's database after index %d differs from another node's",
+					node.ID, entry.Index)
+			}
+		}
+
+		if cluster.SnapshotEntries > 0 {
+			if entries, _ := node.Consensus.LogSize(); entries >= cluster.SnapshotEntries {
+				data, err := node.DB.Snapshot()
+				if err != nil {
+					return err
+				}
+				node.Consensus.Snapshot(node.applied, data)
+			}
+		}
+	}
+}
+
+/*
+ * checkDivergences checks that no node flagged its database as differing
+ * from another node's unless one of the two was made to differ.
+ */
+func (cluster *SimCluster) checkDivergences() error {
+	for _, node := range cluster.Nodes {
+		divergence := node.Checksums.Divergence()
+		if divergence != nil && !node.corrupted && !cluster.Nodes[divergence.Peer].corrupted {
+			return fmt.Errorf("node %d found its database differs from node %d's at index %d, but they are the same",
+				node.ID, divergence.Peer, divergence.Index)
+		}
+	}
+	return nil
+}
+
+/*
+ * checkLeaders checks that there is at most one leader per term, and that no
+ * learner is a leader.
+ */
+func (cluster *SimCluster) checkLeaders() error {
+	for _, node := range cluster.Nodes {
+		term, isLeader := node.State()
+		if !isLeader {
+			continue
+		}
+		if node.Learner() {
+			return fmt.Errorf("node %d is a learner but became the leader in term %d", node.ID, term)
+		}
+		if leader, ok := cluster.leaders[term]; !ok {
+			cluster.leaders[term] = node.ID
+		} else if leader != node.ID {
+			return fmt.Errorf("nodes %d and %d were both leaders in term %d", leader, node.ID, term)
+		}
+	}
+	return nil
+}
+
+/*
+ * checkLogs checks the Log Matching Property: if two logs have an entry with
+ * the same index and term, they are identical up to that index. Only the
+ * entries that neither node has compacted away are compared.
+ */
+func (cluster *SimCluster) checkLogs() error {
+	type nodeLog struct {
+		snapshotIndex int
+		entries       []LogEntry
+	}
+
+	logs := make([]nodeLog, len(cluster.Nodes))
+	for i, node := range cluster.Nodes {
+		node.Consensus.mu.Lock()
+		logs[i] = nodeLog{node.Consensus.snapshotIndex, append([]LogEntry{}, node.Consensus.log...)}
+		node.Consensus.mu.Unlock()
+	}
+
+	for a := range logs {
+		for b := a + 1; b < len(logs); b++ {
+			first := logs[a].snapshotIndex + 1
+			if logs[b].snapshotIndex+1 > first {
+				first = logs[b].snapshotIndex + 1
+			}
+			last := logs[a].snapshotIndex + len(logs[a].entries)
+			if other := logs[b].snapshotIndex + len(logs[b].entries); other < last {
+				last = other
+			}
+
+			entryAt := func(l nodeLog, index int) LogEntry {
+				return l.entries[index-l.snapshotIndex-1]
+			}
+
+			// Find the last index at which both logs have the same term;
+			// everything before it must match.
+			match := last
+			for match >= first && entryAt(logs[a], match).Term != entryAt(logs[b], match).Term {
+				match--
+			}
+			for index := first; index <= match; index++ {
+				keyA, keyB := entryKey(entryAt(logs[a], index)), entryKey(entryAt(logs[b], index))
+				if keyA != keyB {
+					return fmt.Errorf("logs of nodes %d and %d match at index %d but differ at index %d: %s and %s",
+						a, b, match, index, keyA, keyB)
+				}
+			}
+		}
+	}
+	return nil
+}
+
+/*
+ * CheckConverged checks that every node has applied the same entries as the
+ * leader, once the cluster has had time to settle.
+ */
+func (cluster *SimCluster) CheckConverged() error {
+	leader := cluster.Leader()
+	if leader == nil {
+		return errors.New("no leader")
+	}
+	for _, node := range cluster.Nodes {
+		if node.applied != leader.applied {
+			return fmt.Errorf("node %d applied up to index %d but the leader (node %d) applied up to index %d",
+				node.ID, node.applied, leader.ID, leader.applied)
+		}
+	}
+	return nil
+}
+
+/*
+ * Summary describes the state of every node in one line each. Two runs with
+ * the same seed and parameters have the same summary.
+ */
+func (cluster *SimCluster) Summary() string {
+	var buffer bytes.Buffer
+	fmt.Fprintf(&buffer, "%v virtual, %d events, %d messages (%d lost)\n",
+		cluster.Sim.Elapsed(), cluster.Sim.Steps, cluster.Network.Sent, cluster.Network.Dropped)
+	for _, node := range cluster.Nodes {
+		term, isLeader := node.State()
+		role := "follower"
+		if isLeader {
+			role = "leader"
+		}
+		fmt.Fprintf(&buffer, "  node %d: %-8s term %-3d applied %-4d albums %-3d digest %016x\n",
+			node.ID, role, term, node.applied, len(node.DB.Data), dbDigest(node.DB))
+	}
+	return buffer.String()
+}
+
+/*
+ * entryKey describes a log entry; two entries are the same if their keys are.
+ */
+func entryKey(entry LogEntry) string {
+	cmd := entry.Command
+	return fmt.Sprintf("%d:%s v%d %s%q %s/%d@%d",
+		entry.Term, cmd.Method, cmd.Version, cmd.Payload, cmd.Arguments, cmd.ClientID, cmd.Sequence, cmd.Timestamp)
+}
+
+/*
+ * dbDigest returns a hash of the contents of an album database (including the
+ * client sessions), independent of map order.
+ */
+func dbDigest(db *AlbumDB) uint64 {
+	hash := fnv.New64a()
+	fmt.Fprintf(hash, "%d;", db.CurrID)
+
+	ids := make([]int, 0, len(db.Data))
+	for id := range db.Data {
+		ids = append(ids, id)
+	}
+	sort.Ints(ids)
+	for _, id := range ids {
+		fmt.Fprintf(hash, "%d=%+v;", id, *db.Data[id])
+	}
+
+	clients := make([]string, 0, len(db.Sessions.Sessions))
+	for client := range db.Sessions.Sessions {
+		clients = append(clients, client)
+	}
+	sort.Strings(clients)
+	fmt.Fprintf(hash, "%d;", db.Sessions.Clock)
+	for _, client := range clients {
+		fmt.Fprintf(hash, "%s=%+v;", client, *db.Sessions.Sessions[client])
+	}
+
+	return hash.Sum64()
+}
@@ -0,0 +1,390 @@
+package main
+
+import (
+	"bufio"
+	"bytes"
+	"encoding/binary"
+	"encoding/gob"
+	"errors"
+	"fmt"
+	"hash/crc32"
+	"io"
+	"os"
+	"path/filepath"
+	"sync"
+)
+
+// ================================== STORAGE =================================
+
+// walFileName is the name of the write-ahead log inside a node's data dir.
+const walFileName = "raft.wal"
+
+// snapshotFileName is the name of the latest snapshot inside a node's data dir.
+const snapshotFileName = "snapshot"
+
+// maxWALRecordSize bounds the size of a single record, so that a corrupted
+// length can't make Load allocate an arbitrary amount of memory.
+const maxWALRecordSize = 1 << 28
+
+// walRecordKind represents one of the kinds of records in the write-ahead log:
+// (0) State, (1) Entries, and (2) Commit.
+type walRecordKind int
+
+const (
+	WAL_STATE   walRecordKind = 0 // currentTerm and votedFor changed
+	WAL_ENTRIES walRecordKind = 1 // Entries were written starting at Index
+	WAL_COMMIT  walRecordKind = 2 // commitIndex advanced
+)
+
+// walRecord represents a single record in the write-ahead log. Only the
+// fields relevant to the record's kind are set.
+type walRecord struct {
+	Kind        walRecordKind
+	Term        int        // WAL_STATE: currentTerm
+	VotedFor    int        // WAL_STATE: votedFor
+	Index       int        // WAL_ENTRIES: index of the first entry
+	Entries     []LogEntry // WAL_ENTRIES: the entries; replaces the log from Index on
+	CommitIndex int        // WAL_COMMIT: commitIndex
+}
+
+// PersistentState represents the state of a node recovered from disk.
+type PersistentState struct {
+	CurrentTerm int        // Latest term the node had seen
+	VotedFor    int        // Candidate that received the node's vote in CurrentTerm
+	CommitIndex int        // Highest log entry the node knew to be committed
+	Snapshot    *Snapshot  // The latest snapshot, or nil if none was taken
+	Log         CommandLog // Log entries following the snapshot
+}
+
+// Storage represents the durable storage of a node: an append-only
+// write-ahead log in the node's data directory. State and entry records are
+// written to disk (fsync) before the call that wrote them returns.
+//
+// Each record is framed as a 4-byte length, a 4-byte CRC-32 checksum and the
+// gob-encoded walRecord, so a record torn by a crash can be detected and
+// discarded on load.
+type Storage struct {
+	dir string     // The node's data directory
+	wal *os.File   // The write-ahead log, opened for appending
+	mu  sync.Mutex // A mutex to protect the file
+}
+
+/*
+ * OpenStorage opens the write-ahead log in the given directory, creating the
+ * directory and the log if they don't exist yet.
+ */
+func OpenStorage(dir string) (*Storage, error) {
+	if err := os.MkdirAll(dir, 0755); err != nil {
+		return nil, err
+	}
+
+	wal, err := os.OpenFile(filepath.Join(dir, walFileName), os.O_RDWR|os.O_CREATE, 0644)
+	if err != nil {
+		return nil, err
+	}
+
+	return &Storage{
+		dir: dir,
+		wal: wal,
+	}, nil
+}
+
+/*
+ * Load replays the write-ahead log and returns the state it describes. A torn
+ * record at the end of the log (from a crash mid-write) is discarded, and the
+ * log is truncated so that new records follow the last good one.
+ */
+func (s *Storage) Load() (*PersistentState, error) {
+	s.mu.Lock()
+	defer s.mu.Unlock()
+
+	state := &PersistentState{
+		VotedFor:    -1,
+		CommitIndex: -1,
+	}
+
+	snapshot, err := s.loadSnapshot()
+	if err != nil {
+		return nil, err
+	}
+	state.Snapshot = snapshot
+
+	// Entries in the log are numbered from the entry after the snapshot.
+	first := 0
+	if snapshot != nil {
+		first = snapshot.LastIncludedIndex + 1
+	}
+
+	if _, err := s.wal.Seek(0, io.SeekStart); err != nil {
+		return nil, err
+	}
+	reader := bufio.NewReader(s.wal)
+
+	var offset int64
+	for {
+		record, size, err := readWALRecord(reader)
+		if err != nil {
+			break
+		}
+		offset += size
+
+		switch record.Kind {
+		case WAL_STATE:
+			state.CurrentTerm = record.Term
+			state.VotedFor = record.VotedFor
+		case WAL_ENTRIES:
+			// Skip the entries that are already part of the snapshot.
+			index, entries := record.Index-first, record.Entries
+			if index < 0 {
+				if -index >= len(entries) {
+					continue
+				}
+				index, entries = 0, entries[-index:]
+			}
+
+			if index > len(state.Log.Entries) {
+				return nil, fmt.Errorf("write-ahead log has a gap at index %d", record.Index)
+			}
+			state.Log.Entries = append(state.Log.Entries[:index], entries...)
+		case WAL_COMMIT:
+			state.CommitIndex = record.CommitIndex
+		}
+	}
+
+	// Drop anything after the last good record and append from there on.
+	if err := s.wal.Truncate(offset); err != nil {
+		return nil, err
+	}
+	if _, err := s.wal.Seek(offset, io.SeekStart); err != nil {
+		return nil, err
+	}
+
+	// Everything in the snapshot is committed; nothing past the log is.
+	if state.CommitIndex < first-1 {
+		state.CommitIndex = first - 1
+	}
+	if state.CommitIndex >= first+len(state.Log.Entries) {
+		state.CommitIndex = first + len(state.Log.Entries) - 1
+	}
+
+	return state, nil
+}
+
+/*
+ * SaveState durably records the node's currentTerm and votedFor.
+ */
+func (s *Storage) SaveState(term, votedFor int) error {
+	return s.append(&walRecord{Kind: WAL_STATE, Term: term, VotedFor: votedFor}, true)
+}
+
+/*
+ * SaveEntries durably records log entries starting at the given index; any
+ * entries previously stored at or after that index are replaced.
+ */
+func (s *Storage) SaveEntries(index int, entries []LogEntry) error {
+	return s.append(&walRecord{Kind: WAL_ENTRIES, Index: index, Entries: entries}, true)
+}
+
+/*
+ * SaveCommitIndex records the node's commitIndex. It isn't synced, since a
+ * commit index that is lost in a crash is learned again from the leader.
+ */
+func (s *Storage) SaveCommitIndex(commitIndex int) error {
+	return s.append(&walRecord{Kind: WAL_COMMIT, CommitIndex: commitIndex}, false)
+}
+
+/*
+ * SaveSnapshot durably stores a snapshot and compacts the write-ahead log: the
+ * log is rewritten to hold only the node's state and the entries that follow
+ * the snapshot. The snapshot is written first, so a crash in between leaves
+ * the old log, whose extra entries are skipped on load.
+ */
+func (s *Storage) SaveSnapshot(snapshot *Snapshot, term, votedFor, commitIndex int, entries []LogEntry) error {
+	var buffer bytes.Buffer
+	if err := gob.NewEncoder(&buffer).Encode(snapshot); err != nil {
+		return err
+	}
+
+	// Encode the records of the compacted log.
+	var wal bytes.Buffer
+	records := []*walRecord{
+		{Kind: WAL_STATE, Term: term, VotedFor: votedFor},
+		{Kind: WAL_ENTRIES, Index: snapshot.LastIncludedIndex + 1, Entries: entries},
+		{Kind: WAL_COMMIT, CommitIndex: commitIndex},
+	}
+	for _, record := range records {
+		frame, err := encodeWALRecord(record)
+		if err != nil {
+			return err
+		}
+		wal.Write(frame)
+	}
+
+	s.mu.Lock()
+	defer s.mu.Unlock()
+
+	if err := writeFileAtomic(filepath.Join(s.dir, snapshotFileName), buffer.Bytes()); err != nil {
+		return err
+	}
+
+	path := filepath.Join(s.dir, walFileName)
+	if err := writeFileAtomic(path, wal.Bytes()); err != nil {
+		return err
+	}
+
+	// Reopen the new log for appending.
+	s.wal.Close()
+	file, err := os.OpenFile(path, os.O_RDWR, 0644)
+	if err != nil {
+		return err
+	}
+	if _, err := file.Seek(0, io.SeekEnd); err != nil {
+		file.Close()
+		return err
+	}
+	s.wal = file
+
+	return nil
+}
+
+/*
+ * loadSnapshot reads the latest snapshot, or returns nil if there is none.
+ */
+func (s *Storage) loadSnapshot() (*Snapshot, error) {
+	data, err := os.ReadFile(filepath.Join(s.dir, snapshotFileName))
+	if os.IsNotExist(err) {
+		return nil, nil
+	} else if err != nil {
+		return nil, err
+	}
+
+	snapshot := &Snapshot{}
+	if err := gob.NewDecoder(bytes.NewReader(data)).Decode(snapshot); err != nil {
+		return nil, err
+	}
+	return snapshot, nil
+}
+
+/*
+ * Close syncs the write-ahead log to disk and closes it.
+ */
+func (s *Storage) Close() error {
+	s.mu.Lock()
+	defer s.mu.Unlock()
+
+	if err := s.wal.Sync(); err != nil {
+		s.wal.Close()
+		return err
+	}
+	return s.wal.Close()
+}
+
+// ============================== RECORD FRAMING ==============================
+
+/*
+ * append frames and writes a record at the end of the write-ahead log, and
+ * syncs it to disk if sync is set.
+ */
+func (s *Storage) append(record *walRecord, sync bool) error {
+	frame, err := encodeWALRecord(record)
+	if err != nil {
+		return err
+	}
+
+	s.mu.Lock()
+	defer s.mu.Unlock()
+
+	if _, err := s.wal.Write(frame); err != nil {
+		return err
+	}
+	if sync {
+		return s.wal.Sync()
+	}
+	return nil
+}
+
+/*
+ * encodeWALRecord encodes a record and frames it with its length and checksum.
+ */
+func encodeWALRecord(record *walRecord) ([]byte, error) {
+	var payload bytes.Buffer
+	if err := gob.NewEncoder(&payload).Encode(record); err != nil {
+		return nil, err
+	}
+
+	frame := make([]byte, 8+payload.Len())
+	binary.BigEndian.PutUint32(frame[0:4], uint32(payload.Len()))
+	binary.BigEndian.PutUint32(frame[4:8], crc32.ChecksumIEEE(payload.Bytes()))
+	copy(frame[8:], payload.Bytes())
+
+	return frame, nil
+}
+
+/*
+ * readWALRecord reads a single framed record. Returns the record and the
+ * number of bytes it took up, or an error if the record is incomplete or its
+ * checksum doesn't match.
+ */
+func readWALRecord(reader io.Reader) (*walRecord, int64, error) {
+	header := make([]byte, 8)
+	if _, err := io.ReadFull(reader, header); err != nil {
+		return nil, 0, err
+	}
+
+	size := binary.BigEndian.Uint32(header[0:4])
+	checksum := binary.BigEndian.Uint32(header[4:8])
+	if size > maxWALRecordSize {
+		return nil, 0, errors.New("write-ahead log record is too large")
+	}
+
+	payload := make([]byte, size)
+	if _, err := io.ReadFull(reader, payload); err != nil {
+		return nil, 0, err
+	}
+	if crc32.ChecksumIEEE(payload) != checksum {
+		return nil, 0, errors.New("write-ahead log record has a bad checksum")
+	}
+
+	record := &walRecord{}
+	if err := gob.NewDecoder(bytes.NewReader(payload)).Decode(record); err != nil {
+		return nil, 0, err
+	}
+
+	return record, int64(8 + size), nil
+}
+
+/*
+ * writeFileAtomic replaces the file at path with the given data. The data is
+ * written to a temporary file and synced before it is renamed over the old
+ * file, so readers see either the old or the new contents, never a mix.
+ */
+func writeFileAtomic(path string, data []byte) error {
+	tmp := path + ".tmp"
+	file, err := os.OpenFile(tmp, os.O_WRONLY|os.O_CREATE|os.O_TRUNC, 0644)
+	if err != nil {
+		return err
+	}
+
+	if _, err := file.Write(data); err != nil {
+		file.Close()
+		return err
+	}
+	if err := file.Sync(); err != nil {
+		file.Close()
+		return err
+	}
+	if err := file.Close(); err != nil {
+		return err
+	}
+	if err := os.Rename(tmp, path); err != nil {
+		return err
+	}
+
+	// Sync the directory so that the rename itself is durable.
+	dir, err := os.Open(filepath.Dir(path))
+	if err != nil {
+		return err
+	}
+	defer dir.Close()
+	return dir.Sync()
+}
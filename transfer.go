@@ -0,0 +1,160 @@
+package main
+
+// The transfer.go file implements leadership transfer, as described in
+// section 3.10 of Diego Ongaro's dissertation "Consensus: Bridging Theory and
+// Practice". The leader stops accepting commands, brings the target's log up
+// to date and then tells it to start an election immediately; since the
+// target's log is as up-to-date as anyone's, it wins the election.
+
+import (
+	"errors"
+	"fmt"
+	"log"
+	"time"
+)
+
+// leadershipTransferTimeout is how long a leader tries to hand off leadership
+// before it gives up and starts accepting commands again.
+const leadershipTransferTimeout = 1 * time.Second
+
+// ============================ LEADERSHIP TRANSFER ===========================
+
+/*
+ * TransferLeadership hands leadership to the given member of the cluster. It
+ * blocks until this node has stepped down, or returns an error if the target
+ * didn't take over within leadershipTransferTimeout, in which case this node
+ * stays the leader.
+ */
+func (node *ConsensusModule) TransferLeadership(target int) error {
+	node.mu.Lock()
+	if node.state != LEADER {
+		node.mu.Unlock()
+		return ErrNotLeader
+	}
+	if target == node.id {
+		node.mu.Unlock()
+		return errors.New("already the leader")
+	}
+	if !node.isVoter(target) {
+		node.mu.Unlock()
+		return fmt.Errorf("node %d is not a voter", target)
+	}
+	if node.transferTarget != -1 {
+		node.mu.Unlock()
+		return errors.New("a leadership transfer is already in progress")
+	}
+	node.transferTarget = target
+	node.appendProposals()
+	term := node.currentTerm
+	node.mu.Unlock()
+
+	log.Println("[ConsensusModule] Transferring leadership to", target)
+	deadline := node.runtime.Now().Add(leadershipTransferTimeout)
+
+	// 1. Catch the target up with our log; no new entries are being added.
+	for {
+		node.mu.Lock()
+		if node.state != LEADER || node.currentTerm != term {
+			node.mu.Unlock()
+			return nil
+		}
+		caughtUp := node.matchIndex[target] == node.lastLogIndex()
+		node.mu.Unlock()
+
+		if caughtUp {
+			break
+		}
+		if node.runtime.Now().After(deadline) {
+			node.abortTransfer(term)
+			return errors.New("timed out catching up the target")
+		}
+
+		node.prepareAppendEntriesForPeer(target, term)
+		node.runtime.Sleep(10 * time.Millisecond)
+	}
+
+	// 2. Tell the target to start an election right away.
+	var reply TimeoutNowReply
+	args := TimeoutNowArgs{Term: term, LeaderId: node.id}
+	if err := node.DoRPC(target, "ConsensusModule.TimeoutNow", args, &reply); err != nil {
+		node.abortTransfer(term)
+		return err
+	}
+
+	// 3. Wait for the target's election to make us step down.
+	for node.runtime.Now().Before(deadline) {
+		if !node.checkIfStillLeader() {
+			return nil
+		}
+		node.runtime.Sleep(10 * time.Millisecond)
+	}
+
+	node.abortTransfer(term)
+	return errors.New("timed out waiting for the target to take over")
+}
+
+/*
+ * StepDown hands leadership to the voter whose log is the most up to date,
+ * so that a leader about to stop doesn't leave the cluster waiting for an
+ * election timeout. Does nothing if this node isn't the leader or is the only
+ * voter.
+ */
+func (node *ConsensusModule) StepDown() error {
+	node.mu.Lock()
+	if node.state != LEADER {
+		node.mu.Unlock()
+		return nil
+	}
+	target := -1
+	for _, peer := range node.voterPeers() {
+		if target == -1 || node.matchIndex[peer] > node.matchIndex[target] {
+			target = peer
+		}
+	}
+	node.mu.Unlock()
+
+	if target == -1 {
+		return nil
+	}
+	return node.TransferLeadership(target)
+}
+
+/*
+ * abortTransfer gives up on a leadership transfer started in the given term,
+ * so the leader accepts commands again.
+ */
+func (node *ConsensusModule) abortTransfer(term int) {
+	node.mu.Lock()
+	defer node.mu.Unlock()
+
+	if node.state == LEADER && node.currentTerm == term {
+		node.transferTarget = -1
+	}
+	log.Println("[ConsensusModule] Leadership transfer aborted")
+}
+
+/*
+ * TimeoutNow handles a TimeoutNow RPC from a leader that is handing off its
+ * leadership to this node: the node starts an election without waiting for
+ * its election timeout.
+ */
+func (node *ConsensusModule) TimeoutNow(args TimeoutNowArgs, reply *TimeoutNowReply) error {
+	node.mu.Lock()
+	defer node.mu.Unlock()
+
+	if node.state == DEAD {
+		return nil
+	}
+
+	if args.Term > node.currentTerm {
+		node.BecomeFollower(args.Term)
+	}
+
+	reply.Term = node.currentTerm
+	if args.Term == node.currentTerm && node.state == FOLLOWER && node.isVoter(node.id) {
+		log.Println("[ConsensusModule] Leader", args.LeaderId, "is handing off leadership")
+		node.startElection()
+	}
+
+	return nil
+}
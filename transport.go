@@ -0,0 +1,450 @@
+package main
+
+import (
+	"errors"
+	"fmt"
+	"log"
+	"math/rand"
+	"net"
+	"net/rpc"
+	"strings"
+	"sync"
+	"time"
+)
+
+// ================================= TRANSPORT ================================
+
+// Transport represents the way a node exchanges RPCs with its peers. The
+// consensus module only deals with peer IDs and method names (such as
+// "ConsensusModule.AppendEntries"); how calls reach the other nodes is up to
+// the transport.
+//
+// Nodes are addressed by their endpoint in the configuration (the endpoint
+// clients use); each transport maps it to an address of its own.
+type Transport interface {
+	// Register makes the exported methods of service callable by peers as
+	// "name.Method". Methods must look like net/rpc methods:
+	// func (t *T) Method(args A, reply *R) error
+	Register(name string, service interface{}) error
+
+	// Listen starts serving calls from peers for the node at endpoint.
+	Listen(endpoint string) error
+
+	// Connect tells the transport that the peer with the given ID is at
+	// endpoint. The transport may not connect until the first call.
+	Connect(peer int, endpoint string) error
+
+	// Disconnect closes the connection to a peer, if any, and forgets it.
+	Disconnect(peer int) error
+
+	// Health returns what the transport knows about its connection to a peer.
+	Health(peer int) PeerHealth
+
+	// Call calls a method on a peer and waits for its reply, or fails after
+	// callTimeout(method).
+	Call(peer int, method string, args, reply interface{}) error
+
+	// Close stops serving calls and disconnects from every peer.
+	Close() error
+}
+
+// ErrUnreachable is returned for calls to a peer the transport can't reach
+// (e.g. one that was stopped), without waiting for a timeout.
+var ErrUnreachable = errors.New("node is unreachable")
+
+// ErrCallTimeout is returned for calls that weren't answered in time.
+var ErrCallTimeout = errors.New("call timed out")
+
+// PeerHealth represents what a transport knows about its connection to a
+// peer.
+type PeerHealth struct {
+	Endpoint    string    // The peer's endpoint
+	Connected   bool      // Whether calls are being sent to the peer
+	Failures    int       // Failed dials or calls since the last success
+	LastError   string    // Why the last dial or call failed ("" if none has)
+	LastSuccess time.Time // When a call to the peer last succeeded
+}
+
+// peerCallTimeout is how long a call to a peer may take, except for
+// InstallSnapshot calls, which get peerSnapshotTimeout since snapshots can be
+// large.
+const (
+	peerCallTimeout     = 1 * time.Second
+	peerSnapshotTimeout = 10 * time.Second
+)
+
+/*
+ * callTimeout returns how long a call to the given method may take.
+ */
+func callTimeout(method string) time.Duration {
+	if strings.HasSuffix(method, ".InstallSnapshot") {
+		return peerSnapshotTimeout
+	}
+	return peerCallTimeout
+}
+
+// =============================== TCP TRANSPORT ==============================
+
+// The TCP transport dials a peer the first time it is called. If the dial
+// fails, or a connection breaks, it redials in the background with an
+// exponential backoff, and calls to the peer fail right away with
+// ErrUnreachable until it is connected again.
+const (
+	peerDialTimeout = 500 * time.Millisecond // How long a dial may take
+	peerBackoffMin  = 50 * time.Millisecond  // The first wait before redialing
+	peerBackoffMax  = 2 * time.Second        // The longest wait before redialing
+	peerMaxTimeouts = 3                      // Timeouts in a row that break a connection
+)
+
+// TCPTransport represents a transport that sends RPCs over TCP with net/rpc.
+// A node serves its peers (and admin clients) on the peer address the
+// cluster configuration file gives it, or else on its client port plus
+// peerPortOffset.
+type TCPTransport struct {
+	addresses map[string]string // Peer addresses by client endpoint (see cluster.go)
+
+	server   *rpc.Server           // The RPC server for peers and admin clients
+	listener net.Listener          // Accepts connections from peers (nil until Listen)
+	served   map[net.Conn]struct{} // The connections being served
+	peers    map[int]*tcpPeer      // The known peers, by ID
+	closed   bool                  // True once Close was called
+	mu       sync.Mutex            // A mutex to protect the fields above and the peers' state
+}
+
+// tcpPeer represents the transport's connection to a peer.
+type tcpPeer struct {
+	endpoint     string      // The peer's endpoint
+	client       *rpc.Client // The connection (nil while disconnected)
+	dialing      bool        // True while a dial (or the redial loop) is running
+	timeouts     int         // Calls in a row that timed out
+	health       PeerHealth  // What is known about the connection
+	disconnected bool        // True once Disconnect forgot the peer
+}
+
+/*
+ * NewTCPTransport initializes a new TCP transport. The addresses map a node's
+ * client endpoint to the address it serves RPCs on; nodes that aren't in it
+ * (or all of them, if it is nil) are reached at PeerEndpoint(endpoint).
+ */
+func NewTCPTransport(addresses map[string]string) *TCPTransport {
+	return &TCPTransport{
+		addresses: addresses,
+		server:    rpc.NewServer(),
+		served:    make(map[net.Conn]struct{}),
+		peers:     make(map[int]*tcpPeer),
+	}
+}
+
+/*
+ * Register registers an RPC service with the transport's net/rpc server.
+ */
+func (t *TCPTransport) Register(name string, service interface{}) error {
+	return t.server.RegisterName(name, service)
+}
+
+/*
+ * peerAddress returns the address the node with the given client endpoint
+ * serves RPCs on, or an error if it has none.
+ */
+func (t *TCPTransport) peerAddress(endpoint string) (string, error) {
+	if address, ok := t.addresses[endpoint]; ok {
+		return address, nil
+	}
+	return PeerEndpoint(endpoint)
+}
+
+/*
+ * Listen serves RPCs from the other nodes in the cluster (and admin clients)
+ * on the peer address of the given endpoint.
+ */
+func (t *TCPTransport) Listen(endpoint string) error {
+	address, err := t.peerAddress(endpoint)
+	if err != nil {
+		return err
+	}
+	listener, err := net.Listen("tcp", address)
+	if err != nil {
+		return err
+	}
+
+	t.mu.Lock()
+	t.listener = listener
+	t.mu.Unlock()
+
+	// Continously accept connections from peers.
+	go func() {
+		for {
+			conn, err := listener.Accept()
+			if err != nil {
+				if !t.isClosed() {
+					log.Println("[TCPTransport] Listen", err)
+				}
+				return
+			}
+			go t.serve(conn)
+		}
+	}()
+
+	return nil
+}
+
+/*
+ * serve serves the RPCs sent over a connection until it is closed, by the
+ * peer or by Close.
+ */
+func (t *TCPTransport) serve(conn net.Conn) {
+	t.mu.Lock()
+	if t.closed {
+		t.mu.Unlock()
+		conn.Close()
+		return
+	}
+	t.served[conn] = struct{}{}
+	t.mu.Unlock()
+
+	t.server.ServeConn(conn)
+
+	t.mu.Lock()
+	delete(t.served, conn)
+	t.mu.Unlock()
+}
+
+/*
+ * Close stops accepting connections from peers, closes the ones being served
+ * and disconnects from every peer. Calls fail from then on.
+ */
+func (t *TCPTransport) Close() error {
+	t.mu.Lock()
+	defer t.mu.Unlock()
+
+	if t.closed {
+		return nil
+	}
+	t.closed = true
+
+	var err error
+	if t.listener != nil {
+		err = t.listener.Close()
+	}
+	for conn := range t.served {
+		conn.Close()
+	}
+	for peer, p := range t.peers {
+		t.forget(peer, p)
+	}
+	return err
+}
+
+/*
+ * isClosed returns true once Close was called.
+ */
+func (t *TCPTransport) isClosed() bool {
+	t.mu.Lock()
+	defer t.mu.Unlock()
+
+	return t.closed
+}
+
+/*
+ * Connect notes the peer's endpoint; the peer is dialed on the first call.
+ */
+func (t *TCPTransport) Connect(peer int, endpoint string) error {
+	t.mu.Lock()
+	defer t.mu.Unlock()
+
+	if t.closed {
+		return ErrUnreachable
+	}
+	if p, ok := t.peers[peer]; ok && p.endpoint == endpoint {
+		return nil
+	} else if ok {
+		t.forget(peer, p)
+	}
+	t.peers[peer] = &tcpPeer{endpoint: endpoint, health: PeerHealth{Endpoint: endpoint}}
+	return nil
+}
+
+/*
+ * Disconnect closes the connection to a peer and stops redialing it.
+ */
+func (t *TCPTransport) Disconnect(peer int) error {
+	t.mu.Lock()
+	defer t.mu.Unlock()
+
+	if p, ok := t.peers[peer]; ok {
+		t.forget(peer, p)
+	}
+	return nil
+}
+
+/*
+ * forget closes the connection to a peer and removes it. Must be called with
+ * the transport's mutex held.
+ */
+func (t *TCPTransport) forget(peer int, p *tcpPeer) {
+	p.disconnected = true
+	if p.client != nil {
+		p.client.Close()
+		p.client = nil
+	}
+	delete(t.peers, peer)
+}
+
+/*
+ * Health returns the state of the connection to a peer.
+ */
+func (t *TCPTransport) Health(peer int) PeerHealth {
+	t.mu.Lock()
+	defer t.mu.Unlock()
+
+	if p, ok := t.peers[peer]; ok {
+		return p.health
+	}
+	return PeerHealth{}
+}
+
+/*
+ * Call performs an RPC to a peer, dialing it first if it was never dialed.
+ */
+func (t *TCPTransport) Call(peer int, method string, args, reply interface{}) error {
+	t.mu.Lock()
+	p, ok := t.peers[peer]
+	if !ok {
+		t.mu.Unlock()
+		return fmt.Errorf("unknown peer %d", peer)
+	}
+	client := p.client
+	dial := client == nil && !p.dialing
+	if dial {
+		p.dialing = true
+	}
+	t.mu.Unlock()
+
+	if client == nil {
+		if !dial {
+			return ErrUnreachable
+		}
+		var err error
+		if client, err = t.dial(peer, p); err != nil {
+			return err
+		}
+	}
+
+	call := client.Go(method, args, reply, make(chan *rpc.Call, 1))
+	var err error
+	select {
+	case <-call.Done:
+		err = call.Error
+	case <-time.After(callTimeout(method)):
+		err = ErrCallTimeout
+	}
+
+	t.mu.Lock()
+	defer t.mu.Unlock()
+
+	// Errors returned by the method itself say nothing about the connection.
+	if _, ok := err.(rpc.ServerError); err == nil || ok {
+		p.timeouts = 0
+		p.health.Failures = 0
+		p.health.LastSuccess = time.Now()
+		return err
+	}
+
+	p.health.Failures += 1
+	p.health.LastError = err.Error()
+	if err == ErrCallTimeout {
+		p.timeouts += 1
+		if p.timeouts < peerMaxTimeouts {
+			return err
+		}
+	}
+
+	// The connection is broken (or hung); redial in the background, unless
+	// that was already done for this connection.
+	if p.client == client && !p.disconnected {
+		log.Printf("[TCPTransport] Lost connection to peer %d at %s: %v", peer, p.endpoint, err)
+		client.Close()
+		p.client = nil
+		p.timeouts = 0
+		p.health.Connected = false
+		p.dialing = true
+		go t.redial(peer, p)
+	}
+	return err
+}
+
+/*
+ * dial connects to a peer, whose dialing flag the caller has set. If the dial
+ * fails, the peer is redialed in the background.
+ */
+func (t *TCPTransport) dial(peer int, p *tcpPeer) (*rpc.Client, error) {
+	client, err := t.tryDial(peer, p)
+	if err != nil {
+		go t.redial(peer, p)
+	}
+	return client, err
+}
+
+/*
+ * redial keeps dialing a peer, waiting twice as long after each failure (up
+ * to peerBackoffMax), until it connects or the peer is disconnected.
+ */
+func (t *TCPTransport) redial(peer int, p *tcpPeer) {
+	backoff := peerBackoffMin
+	for {
+		// Wait between half and all of the backoff, so that nodes that lost
+		// the same peer don't all redial it at the same moment.
+		time.Sleep(backoff/2 + time.Duration(rand.Int63n(int64(backoff/2)+1)))
+
+		if _, err := t.tryDial(peer, p); err == nil || err == errDisconnected {
+			return
+		}
+
+		backoff *= 2
+		if backoff > peerBackoffMax {
+			backoff = peerBackoffMax
+		}
+	}
+}
+
+// errDisconnected is returned by tryDial for a peer that was disconnected.
+var errDisconnected = errors.New("peer was disconnected")
+
+/*
+ * tryDial dials a peer once. On success, calls go to the new connection.
+ */
+func (t *TCPTransport) tryDial(peer int, p *tcpPeer) (*rpc.Client, error) {
+	t.mu.Lock()
+	disconnected := p.disconnected
+	t.mu.Unlock()
+	if disconnected {
+		return nil, errDisconnected
+	}
+
+	// A peer without a valid address is just one that can't be reached.
+	address, err := t.peerAddress(p.endpoint)
+	var conn net.Conn
+	if err == nil {
+		conn, err = net.DialTimeout("tcp", address, peerDialTimeout)
+	}
+
+	t.mu.Lock()
+	defer t.mu.Unlock()
+
+	if err != nil {
+		p.health.Failures += 1
+		p.health.LastError = err.Error()
+		return nil, ErrUnreachable
+	}
+	client := rpc.NewClient(conn)
+	if p.disconnected {
+		client.Close()
+		return nil, errDisconnected
+	}
+
+	p.client = client
+	p.dialing = false
+	p.health.Connected = true
+	log.Println("[TCPTransport] Connected to peer", peer, "at", p.endpoint)
+	return client, nil
+}